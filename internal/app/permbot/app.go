@@ -5,33 +5,86 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
-	"github.com/BurntSushi/toml"
-	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	rbacv1 "k8s.io/api/rbac/v1"
 
-	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer/json"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 
 	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/app"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/audit"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/config"
 	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/k8s"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/metrics"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/notify"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/policy"
 	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
 )
 
+// options holds the values of the command-line flags which are shared between modes
+type options struct {
+	namespace           string
+	global              bool
+	owner               string
+	rulesRef            string
+	prune               bool
+	pruneNamespaces     bool
+	protectedNamespaces []string
+	output              string
+	validateCluster     bool
+	interval            time.Duration
+	configPoll          time.Duration
+	// metrics is nil unless -metrics-addr or -metrics-file is set
+	metrics *metrics.Metrics
+	// metricsFile is where one-shot modes write the metrics when they finish
+	metricsFile string
+	// notifiers are told about every change made in k8s and controller modes
+	notifiers []notify.Notifier
+	// audit is nil unless -audit-log is set
+	audit *audit.Log
+	// policies must all be satisfied by the config before anything is applied
+	policies []policy.Policy
+}
+
 // RunMain is called by the main package in cmd/permbot and is basically just a replacement for main()
 func RunMain() {
 	var err error
-	mode := flag.String("mode", "yaml", "Mode - either yaml or k8s")
-	flagNamespace := flag.String("namespace", "", "Only dump specific namespace - for yaml mode")
+	mode := flag.String("mode", "yaml", "Mode - one of yaml, k8s, plan, check, validate, controller, grant, who-can, what-can, report or lint")
+	flagNamespace := flag.String("namespace", "", "Only dump specific namespace - for yaml mode, the namespace to grant access in - for grant mode, or to query - for who-can mode")
 	flagGlobal := flag.Bool("global", true, "Also create/display globally scoped resources (ClusterRole/ClusterRoleBinding)")
 	flagDebug := flag.Bool("debug", false, "Enable debug logging")
 	flagOwner := flag.String("owner", "permbot", "Owner value for Kubernetes label")
 	flagRulesRef := flag.String("ref", "", "Version of input repository to include in rule annotations (dafni.ac.uk/permbot-rules-ref)")
 	flagVersion := flag.Bool("version", false, "Exit, only printing Permbot version")
+	flagPrune := flag.Bool("prune", true, "Delete owned Roles/RoleBindings (and ClusterRoles/ClusterRoleBindings if -global) no longer in the config - for k8s mode")
+	flagPruneNamespaces := flag.Bool("prune-namespaces", false, "Also delete namespaces created by permbot (createNamespace) which are no longer in the config - for k8s mode")
+	flagProtected := flag.String("protected-namespaces", "kube-system", "Comma-separated list of namespaces in which nothing is ever pruned")
+	flagOutput := flag.String("output", "text", "Output format - text or json, for plan, check, validate, who-can and what-can modes, or markdown (text), csv, html or json for report mode, or text, json or sarif for lint mode")
+	flagValidateCluster := flag.Bool("validate-cluster", false, "Also check referenced ClusterRoles exist in the cluster - for validate mode")
+	flagInterval := flag.Duration("interval", 5*time.Minute, "How often to reconcile regardless of changes - for controller mode")
+	flagConfigPoll := flag.Duration("config-poll", 10*time.Second, "How often to check the config files for changes - for controller mode")
+	flagMetricsAddr := flag.String("metrics-addr", "", "Address (e.g. :9090) on which to serve Prometheus metrics on /metrics - for controller mode only, one-shot modes exit before they can be scraped so use -metrics-file")
+	flagMetricsFile := flag.String("metrics-file", "", "File to write Prometheus metrics to when the run finishes, e.g. for the node_exporter textfile collector - for k8s and check modes")
+	flagNotifySlack := flag.String("notify-slack", "", "Comma-separated list of Slack incoming webhook URLs to notify of changes")
+	flagNotifyTeams := flag.String("notify-teams", "", "Comma-separated list of Microsoft Teams incoming webhook URLs to notify of changes")
+	flagNotifyWebhook := flag.String("notify-webhook", "", "Comma-separated list of URLs to post changes to as JSON")
+	flagNotifyTemplate := flag.String("notify-template", "", "File containing a Go text/template for notification messages")
+	flagAuditLog := flag.String("audit-log", "", "File to append a JSON-lines audit event to for every permission granted or revoked, or - for stdout - for k8s and controller modes")
+	flagUser := flag.String("user", "", "User to grant access to - for grant mode, or to query - for what-can mode")
+	flagRole := flag.String("role", "", "Role from the config to grant - for grant mode")
+	flagDuration := flag.Duration("duration", time.Hour, "How long to grant access for - for grant mode")
+	flagReason := flag.String("reason", "", "Why access is needed, e.g. an incident number, recorded with the grant - for grant mode")
+	flagVerb := flag.String("verb", "", "Verb to query, e.g. create - for who-can mode")
+	flagResource := flag.String("resource", "", "Resource to query, e.g. pods/exec, deployments.apps or /metrics - for who-can mode")
+	flagName := flag.String("name", "", "Name of the object to query, matched against the resourceNames of rules which have them - for who-can mode")
+	flagPolicy := flag.String("policy", "", "Comma-separated list of policy files, directories or globs the config must satisfy before anything is applied - for k8s, plan and controller modes")
+	flagNamespacesFile := flag.String("namespaces-file", "", "File listing the namespaces to apply namespaceSelector projects to, as kubectl get namespaces -o json or one name per line - for yaml, who-can, what-can and report modes")
+	flagConfig := flag.String("config", "", "Comma-separated list of config files, directories or globs - in addition to any given as arguments")
 	flag.Parse()
 	if *flagDebug {
 		log.SetLevel(log.DebugLevel)
@@ -40,15 +93,102 @@ func RunMain() {
 	if *flagVersion {
 		return
 	}
-	var pc types.PermbotConfig
-	if cf := flag.Arg(0); cf != "" {
-		err = DecodeFromFile(cf, &pc)
-	} else {
-		log.Fatal("specify permbot config file on commandline")
+	opts := options{
+		namespace:           *flagNamespace,
+		global:              *flagGlobal,
+		owner:               *flagOwner,
+		rulesRef:            *flagRulesRef,
+		prune:               *flagPrune,
+		pruneNamespaces:     *flagPruneNamespaces,
+		protectedNamespaces: splitList(*flagProtected),
+		output:              *flagOutput,
+		validateCluster:     *flagValidateCluster,
+		interval:            *flagInterval,
+		configPoll:          *flagConfigPoll,
 	}
+	opts.notifiers, err = buildNotifiers(splitList(*flagNotifySlack), splitList(*flagNotifyTeams), splitList(*flagNotifyWebhook), *flagNotifyTemplate)
+	if err != nil {
+		log.WithError(err).Fatal("unable to set up notifications")
+	}
+	if *flagAuditLog != "" {
+		if opts.audit, err = openAuditLog(*flagAuditLog, opts); err != nil {
+			log.WithError(err).Fatal("unable to open audit log")
+		}
+	}
+	if *flagPolicy != "" {
+		if opts.policies, err = loadPolicies(splitList(*flagPolicy)); err != nil {
+			log.WithError(err).Fatal("unable to load policy")
+		}
+	}
+	if *flagMetricsAddr != "" && *mode != "controller" {
+		log.Fatal("-metrics-addr is only for controller mode, one-shot modes exit before it can be scraped - use -metrics-file instead")
+	}
+	if *flagMetricsFile != "" {
+		if *mode != "k8s" && *mode != "check" {
+			log.Fatal("-metrics-file is only for k8s and check modes")
+		}
+		opts.metrics = metrics.New()
+		opts.metricsFile = *flagMetricsFile
+	}
+	if *flagMetricsAddr != "" {
+		opts.metrics = metrics.New()
+		go func() {
+			log.WithField("addr", *flagMetricsAddr).Info("serving metrics")
+			if err := opts.metrics.Serve(*flagMetricsAddr); err != nil {
+				log.WithError(err).Error("unable to serve metrics")
+			}
+		}()
+	}
+	paths := append(splitList(*flagConfig), flag.Args()...)
+	if len(paths) == 0 {
+		log.Fatal("specify permbot config files or directories on commandline")
+	}
+	if *mode == "validate" || *mode == "lint" {
+		// validate and lint decode the files themselves, so that they can report problems
+		// against the file and line they are on
+		files, err := config.Files(paths)
+		if err != nil {
+			log.WithError(err).Fatal("unable to find config")
+		}
+		if *mode == "lint" {
+			runLint(files, opts)
+		} else {
+			runValidate(files, opts)
+		}
+		return
+	}
+	if *mode == "controller" {
+		// the controller reloads the config itself whenever it changes
+		cl, err := getK8SClient()
+		if err != nil {
+			log.WithError(err).Fatal("unable to create k8s client")
+		}
+		runController(cl, paths, opts)
+		return
+	}
+	loaded, err := config.Load(paths)
 	if err != nil {
 		log.WithError(err).Fatal("unable to parse")
 	}
+	pc := *loaded
+	// Combine (or reject) duplicate roles and projects up front, so every mode sees each
+	// role name and namespace only once
+	merged, err := pc.Merged()
+	if err != nil {
+		log.WithError(err).Fatal("invalid config")
+	}
+	pc = *merged
+	if *flagNamespacesFile != "" {
+		namespaces, err := k8s.ReadNamespaces(*flagNamespacesFile)
+		if err != nil {
+			log.WithError(err).Fatal("unable to read namespaces")
+		}
+		resolved, err := k8s.ResolveSelectors(&pc, namespaces)
+		if err != nil {
+			log.WithError(err).Fatal("unable to resolve namespace selectors")
+		}
+		pc = *resolved
+	}
 	// fmt.Printf("%+v\n", pc)
 	switch *mode {
 	case "k8s":
@@ -56,90 +196,70 @@ func RunMain() {
 		if err != nil {
 			log.WithError(err).Fatal("unable to create k8s client")
 		}
-		rbc := cl.RbacV1()
-		nsc := cl.CoreV1().Namespaces()
-		for pcpi := range pc.Projects {
-			pp := pc.Projects[pcpi]
-			_, err := nsc.Get(pp.Namespace, v1.GetOptions{})
-			if err != nil {
-				log.WithField("namespace", pp.Namespace).WithError(err).Error("problem with namespace - doesn't exist?")
-				continue
-			}
-			// namespace exists - create the resources
-			rl, rb, err := k8s.CreateResourcesForNamespace(&pc, pp.Namespace, *flagRulesRef, *flagOwner)
-			if err != nil {
-				log.WithError(err).Error("unable to define resources for namespace")
-			}
-			for _, rlr := range rl {
-				newrole, err := rbc.Roles(pp.Namespace).Update(&rlr)
-				if err != nil {
-					log.WithError(err).WithField("project", &rlr.Name).Error("unable to update role")
-				} else {
-					log.WithFields(log.Fields{
-						"role":      newrole.ObjectMeta.Name,
-						"namespace": pp.Namespace,
-					}).Info("created/updated role")
-				}
-			}
-			for _, rblr := range rb {
-				newrb, err := rbc.RoleBindings(pp.Namespace).Update(&rblr)
-				if err != nil {
-					log.WithError(err).WithField("project", &rblr.Name).Error("unable to update rolebinding")
-				} else {
-					log.WithFields(log.Fields{
-						"rolebinding": newrb.ObjectMeta.Name,
-						"namespace":   pp.Namespace,
-					}).Info("created/updated rolebinding")
-				}
-			}
+		runK8S(cl, &pc, opts)
+	case "plan":
+		cl, err := getK8SClient()
+		if err != nil {
+			log.WithError(err).Fatal("unable to create k8s client")
 		}
-		if *flagGlobal {
-			// Done with the namespace-scoped resources, next up is the Global ones
-			crl, crb, err := k8s.CreateGlobalResources(&pc, *flagRulesRef, *flagOwner)
-			if err != nil {
-				log.WithError(err).Fatal("unable to create globally scoped resources")
-			}
-			for crli := range crl {
-				newcr, err := rbc.ClusterRoles().Update(&crl[crli])
-				if err != nil {
-					log.WithError(err).WithField("role", crl[crli].Name).Error("unable to update clusterrole")
-				} else {
-					log.WithField("clusterrole", newcr.Name).Info("created/updated clusterrole")
-				}
-			}
-			for crlbi := range crb {
-				newcrb, err := rbc.ClusterRoleBindings().Update(&crb[crlbi])
-				if err != nil {
-					log.WithError(err).WithField("role", &crb[crlbi].Name)
-				} else {
-					log.WithField("clusterrolebinding", newcrb.Name).Info("created/updated clusterrolebinding")
-				}
-			}
+		runPlan(cl, resolveSelectors(cl, &pc), opts)
+	case "check":
+		cl, err := getK8SClient()
+		if err != nil {
+			log.WithError(err).Fatal("unable to create k8s client")
+		}
+		runCheck(cl, resolveSelectors(cl, &pc), opts)
+	case "report":
+		runReport(&pc, opts)
+	case "who-can":
+		runWhoCan(&pc, opts, *flagVerb, *flagResource, *flagName)
+	case "what-can":
+		runWhatCan(&pc, opts, *flagUser)
+	case "grant":
+		cl, err := getK8SClient()
+		if err != nil {
+			log.WithError(err).Fatal("unable to create k8s client")
 		}
+		runGrant(cl, resolveSelectors(cl, &pc), opts, *flagUser, *flagRole, *flagDuration, *flagReason)
 	case "yaml":
-		if *flagNamespace != "" {
-			log.WithField("namespace", *flagNamespace).Debug("dumping single namespace")
-			dumpYAMLNamespace(&pc, *flagNamespace, *flagRulesRef, *flagOwner)
+		if opts.namespace != "" {
+			log.WithField("namespace", opts.namespace).Debug("dumping single namespace")
+			dumpYAMLNamespace(&pc, opts.namespace, opts.rulesRef, opts.owner)
 		} else {
 			log.Debug("no namespace specified - dumping all")
+			warnUnresolved(&pc)
 			for _, nns := range pc.Projects {
-				dumpYAMLNamespace(&pc, nns.Namespace, *flagRulesRef, *flagOwner)
+				if nns.NamespaceSelector != nil {
+					continue
+				}
+				dumpYAMLNamespace(&pc, nns.Namespace, opts.rulesRef, opts.owner)
 				fmt.Println("--")
 			}
 		}
-		if *flagGlobal {
+		if opts.global {
 			fmt.Println("--")
-			crres, crbres, err := k8s.CreateGlobalResources(&pc, *flagRulesRef, *flagOwner)
+			crres, crbres, err := k8s.CreateGlobalResources(&pc, opts.rulesRef, opts.owner)
 			if err != nil {
 				log.WithError(err).Fatal("Failed to create global resources")
 			}
 			dumpGlobalToYaml(crres, crbres)
 		}
 	default:
-		log.Fatal("Unknown mode - use k8s or yaml")
+		log.WithField("mode", *mode).Fatal("Unknown mode - use yaml, k8s, plan, check, validate, controller, grant, who-can, what-can, report or lint")
 	}
 }
 
+// splitList splits a comma-separated flag value, ignoring empty entries
+func splitList(s string) []string {
+	var out []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
 func dumpYAMLNamespace(pc *types.PermbotConfig, ns, rulesRef, owner string) {
 	rres, rbres, err := k8s.CreateResourcesForNamespace(pc, ns, rulesRef, owner)
 	if err != nil {
@@ -232,13 +352,6 @@ func dumpToYaml(rres []rbacv1.Role, rbres []rbacv1.RoleBinding) {
 
 // DecodeFromFile decodes a file from `fn` into the PermbotConfig pointer `into`
 func DecodeFromFile(fn string, into *types.PermbotConfig) error {
-	f, err := os.Open(fn)
-	if err != nil {
-		return errors.Wrap(err, "unable to open config")
-	}
-	_, err = toml.DecodeReader(f, into)
-	if err != nil {
-		return errors.Wrap(err, "unable to decode config")
-	}
+	_, err := config.DecodeFile(fn, into)
 	return err
 }
@@ -0,0 +1,47 @@
+package permbot
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/app"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/audit"
+)
+
+// openAuditLog opens the audit log file for appending, creating it if needed. "-" writes
+// to stdout instead.
+func openAuditLog(fn string, opts options) (*audit.Log, error) {
+	var w io.Writer = os.Stdout
+	if fn != "-" {
+		f, err := os.OpenFile(fn, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to open audit log")
+		}
+		w = f
+	}
+	return audit.NewLog(w, app.Version(), opts.owner, opts.rulesRef), nil
+}
+
+// clusterRules looks up the rules of roles permbot doesn't manage, such as the built-in
+// ClusterRoles, so that the audit log can say what binding to them grants
+func clusterRules(cl kubernetes.Interface) audit.RulesFunc {
+	return func(ref rbacv1.RoleRef, namespace string) []rbacv1.PolicyRule {
+		rbc := cl.RbacV1()
+		switch ref.Kind {
+		case "ClusterRole":
+			if r, err := rbc.ClusterRoles().Get(ref.Name, metav1.GetOptions{}); err == nil {
+				return r.Rules
+			}
+		case "Role":
+			if r, err := rbc.Roles(namespace).Get(ref.Name, metav1.GetOptions{}); err == nil {
+				return r.Rules
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,88 @@
+package permbot
+
+import (
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/app"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/audit"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/k8s"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+// runGrant gives user a role from the config in a namespace straight away, for the given
+// duration, e.g. during an incident. The grant is recorded in the audit log, which is
+// written to stdout if -audit-log isn't set.
+func runGrant(cl kubernetes.Interface, pc *types.PermbotConfig, opts options, user, role string, duration time.Duration, reason string) {
+	if user == "" || role == "" || opts.namespace == "" {
+		log.Fatal("grant mode needs -user, -role and -namespace")
+	}
+	if reason == "" {
+		log.Fatal("grant mode needs a -reason, which is recorded with the grant")
+	}
+	if duration <= 0 {
+		log.Fatal("grant mode needs a positive -duration")
+	}
+	if _, err := cl.CoreV1().Namespaces().Get(opts.namespace, metav1.GetOptions{}); err != nil {
+		log.WithError(err).WithField("namespace", opts.namespace).Fatal("problem with namespace - doesn't exist?")
+	}
+	g, err := k8s.CreateBreakGlass(pc, role, user, opts.namespace, reason, opts.owner, time.Now().Add(duration))
+	if err != nil {
+		log.WithError(err).Fatal("unable to define break-glass grant")
+	}
+	if err := k8s.ApplyBreakGlass(cl, g); err != nil {
+		log.WithError(err).Fatal("unable to grant access")
+	}
+	log.WithFields(log.Fields{
+		"user":        user,
+		"role":        role,
+		"namespace":   opts.namespace,
+		"rolebinding": g.Binding.Name,
+		"expires":     g.Expires.UTC().Format(time.RFC3339),
+	}).Warn("break-glass access granted")
+	if err := breakGlassAudit(opts).Write(audit.BreakGlassEvents(g, audit.ActionGrant, clusterRules(cl))); err != nil {
+		log.WithError(err).Error("unable to write audit log")
+	}
+}
+
+// breakGlassAudit returns the audit log for break-glass grants and their expiry, which are
+// always audited, so on stdout if -audit-log isn't set
+func breakGlassAudit(opts options) *audit.Log {
+	if opts.audit != nil {
+		return opts.audit
+	}
+	return audit.NewLog(os.Stdout, app.Version(), opts.owner, opts.rulesRef)
+}
+
+// expireBreakGlass removes every break-glass grant which has expired, recording each one
+// in the audit log, as runGrant does
+func expireBreakGlass(cl kubernetes.Interface, opts options) {
+	grants, err := k8s.ListBreakGlass(cl, opts.owner)
+	if err != nil {
+		log.WithError(err).Error("unable to find break-glass grants")
+		return
+	}
+	now := time.Now()
+	for i := range grants {
+		g := &grants[i]
+		if !g.Expired(now) {
+			continue
+		}
+		logger := log.WithFields(log.Fields{"rolebinding": g.Binding.Name, "namespace": g.Binding.Namespace})
+		refs := g.Refs()
+		pruned, err := k8s.Prune(cl, refs)
+		opts.metrics.ObjectsPruned(refs, pruned)
+		if err != nil {
+			logger.WithError(err).Error("unable to remove expired break-glass grant")
+			continue
+		}
+		logger.Info("removed expired break-glass grant")
+		if err := breakGlassAudit(opts).Write(audit.BreakGlassEvents(g, audit.ActionRevoke, clusterRules(cl))); err != nil {
+			log.WithError(err).Error("unable to write audit log")
+		}
+	}
+}
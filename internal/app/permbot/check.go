@@ -0,0 +1,37 @@
+package permbot
+
+import (
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+// Exit codes used by check mode. Errors exit via log.Fatal, which uses exitError.
+const (
+	exitInSync  = 0
+	exitError   = 1
+	exitDrifted = 2
+)
+
+// runCheck compares the cluster with the config without changing anything, and exits with
+// exitDrifted if any object has drifted (including objects which are missing, should be
+// pruned, or have been edited by hand).
+func runCheck(cl kubernetes.Interface, pc *types.PermbotConfig, opts options) {
+	drift := buildPlan(cl, pc, opts).Drift()
+	opts.metrics.SetDrift(len(drift.Changes))
+	writeMetricsFile(opts)
+	if !drift.HasChanges() {
+		log.Info("cluster is in sync with config")
+		os.Exit(exitInSync)
+	}
+	writePlan(drift, opts.output)
+	log.WithFields(log.Fields{
+		"missing": drift.Summary.Create,
+		"changed": drift.Summary.Update,
+		"orphans": drift.Summary.Delete,
+	}).Warn("cluster has drifted from config")
+	os.Exit(exitDrifted)
+}
@@ -0,0 +1,43 @@
+package permbot
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/controller"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+// runController runs until interrupted, reconciling the cluster on an interval, when the
+// config files change and when owned objects are edited by hand. Projects are applied as
+// soon as their namespace is created.
+func runController(cl kubernetes.Interface, paths []string, opts options) {
+	ctrl := controller.New(cl, paths, opts.owner, func(pc *types.PermbotConfig) error {
+		return reconcile(cl, pc, opts)
+	})
+	ctrl.ReconcileNamespace = func(pc *types.PermbotConfig, ns string) error {
+		return reconcileNamespace(cl, pc, ns, opts)
+	}
+	ctrl.Interval = opts.interval
+	ctrl.ConfigPoll = opts.configPoll
+
+	stop := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.WithField("signal", sig).Info("shutting down")
+		close(stop)
+	}()
+	log.WithFields(log.Fields{
+		"interval":    opts.interval,
+		"config-poll": opts.configPoll,
+	}).Info("starting controller")
+	if err := ctrl.Run(stop); err != nil {
+		log.WithError(err).Fatal("controller failed")
+	}
+}
@@ -0,0 +1,215 @@
+package permbot
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/k8s"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+// pruneOptions returns the k8s.PruneOptions matching the command-line flags
+func (o options) pruneOptions() k8s.PruneOptions {
+	return k8s.PruneOptions{
+		Owner:               o.owner,
+		ProtectedNamespaces: o.protectedNamespaces,
+		Global:              o.global,
+		Namespaces:          o.pruneNamespaces,
+	}
+}
+
+// desiredState builds the desired state for every project whose namespace exists in the
+// cluster, plus the global resources if enabled.
+func desiredState(cl kubernetes.Interface, pc *types.PermbotConfig, opts options) *k8s.DesiredState {
+	ds, err := buildDesiredState(cl, pc, opts)
+	if err != nil {
+		log.WithError(err).Fatal("unable to define resources")
+	}
+	return ds
+}
+
+// buildDesiredState is desiredState, returning an error instead of exiting
+func buildDesiredState(cl kubernetes.Interface, pc *types.PermbotConfig, opts options) (*k8s.DesiredState, error) {
+	return k8s.CreateDesiredState(pc, opts.rulesRef, opts.owner, opts.global, k8s.NamespaceExists(cl))
+}
+
+// resolveSelectors applies the projects with a namespaceSelector to the namespaces in the
+// cluster they match, exiting on failure
+func resolveSelectors(cl kubernetes.Interface, pc *types.PermbotConfig) *types.PermbotConfig {
+	resolved, err := k8s.ResolveClusterSelectors(cl, pc)
+	if err != nil {
+		log.WithError(err).Fatal("unable to resolve namespace selectors")
+	}
+	return resolved
+}
+
+// runK8S applies the resources defined by the config to the cluster, creating or updating
+// them as required and then pruning anything which is no longer defined.
+func runK8S(cl kubernetes.Interface, pc *types.PermbotConfig, opts options) {
+	err := reconcile(cl, pc, opts)
+	writeMetricsFile(opts)
+	if err != nil {
+		log.WithError(err).Fatal("unable to reconcile")
+	}
+}
+
+// writeMetricsFile writes the metrics to -metrics-file at the end of a one-shot run, if set
+func writeMetricsFile(opts options) {
+	if opts.metricsFile == "" {
+		return
+	}
+	if err := opts.metrics.WriteFile(opts.metricsFile); err != nil {
+		log.WithError(err).Error("unable to write metrics file")
+	}
+}
+
+// reconcile makes a single pass over the cluster, removing expired break-glass grants,
+// applying the resources defined by the config and pruning orphans if enabled. Nothing is
+// applied if the config violates a -policy, but expired grants are always removed. Failures
+// to apply individual objects are logged and counted rather than returned.
+func reconcile(cl kubernetes.Interface, pc *types.PermbotConfig, opts options) (err error) {
+	start := time.Now()
+	defer func() { opts.metrics.ReconcileDone(time.Since(start), err) }()
+	// Break-glass grants are never pruned, but are removed once they expire. This comes
+	// first, as it doesn't depend on the config, so that emergency access is still revoked
+	// when the rest of the pass fails.
+	expireBreakGlass(cl, opts)
+	// Selectors are resolved on every pass, so namespaces created or relabelled since the
+	// last one are picked up
+	if pc, err = k8s.ResolveClusterSelectors(cl, pc); err != nil {
+		return errors.Wrap(err, "unable to resolve namespace selectors")
+	}
+	if err := checkPolicies(pc, opts); err != nil {
+		return err
+	}
+	desired, err := buildDesiredState(cl, pc, opts)
+	if err != nil {
+		return errors.Wrap(err, "unable to define resources")
+	}
+	opts.metrics.SetRoleSubjects(pc)
+	changes := newChangeTracker(cl, desired, opts.prune, opts)
+	defer changes.announce()
+	rec := k8s.NewReconciler(cl)
+	rec.Observer = changes.observe
+	applyDesired(rec, desired)
+	log.WithFields(log.Fields{
+		"created":   rec.Stats.Created,
+		"updated":   rec.Stats.Updated,
+		"unchanged": rec.Stats.Unchanged,
+		"failed":    rec.Stats.Failed,
+	}).Info("reconcile complete")
+	if opts.prune {
+		orphans, err := k8s.FindOrphans(cl, desired, opts.pruneOptions())
+		if err != nil {
+			return errors.Wrap(err, "unable to find objects to prune")
+		}
+		pruned, err := k8s.Prune(cl, orphans)
+		if err != nil {
+			log.WithError(err).Error("pruning incomplete")
+		}
+		changes.pruned(orphans, pruned)
+	}
+	return nil
+}
+
+// reconcileNamespace applies the Roles and RoleBindings of the project for namespace ns,
+// e.g. because the namespace has just been created. Nothing is pruned.
+func reconcileNamespace(cl kubernetes.Interface, pc *types.PermbotConfig, ns string, opts options) error {
+	pc, err := k8s.ResolveClusterSelectors(cl, pc)
+	if err != nil {
+		return errors.Wrap(err, "unable to resolve namespace selectors")
+	}
+	if err := checkPolicies(pc, opts); err != nil {
+		return err
+	}
+	rl, rb, err := k8s.CreateResourcesForNamespace(pc, ns, opts.rulesRef, opts.owner)
+	if err != nil {
+		return errors.Wrap(err, "unable to define resources")
+	}
+	desired := &k8s.DesiredState{Roles: rl, RoleBindings: rb}
+	changes := newChangeTracker(cl, desired, false, opts)
+	defer changes.announce()
+	rec := k8s.NewReconciler(cl)
+	rec.Observer = changes.observe
+	applyDesired(rec, desired)
+	log.WithFields(log.Fields{
+		"namespace": ns,
+		"created":   rec.Stats.Created,
+		"updated":   rec.Stats.Updated,
+		"unchanged": rec.Stats.Unchanged,
+		"failed":    rec.Stats.Failed,
+	}).Info("namespace reconcile complete")
+	return nil
+}
+
+// applyDesired creates or updates every object in the desired state, logging the result
+func applyDesired(rec *k8s.Reconciler, desired *k8s.DesiredState) {
+	// Namespaces come first, so the Roles and RoleBindings can be created in them
+	for i := range desired.Namespaces {
+		ns := &desired.Namespaces[i]
+		act, err := rec.ApplyNamespace(ns)
+		if err != nil {
+			log.WithError(err).WithField("namespace", ns.Name).Error("unable to apply namespace")
+		} else {
+			log.WithFields(log.Fields{
+				"namespace": ns.Name,
+				"action":    act,
+			}).Info("applied namespace")
+		}
+	}
+	for i := range desired.Roles {
+		rl := &desired.Roles[i]
+		act, err := rec.ApplyRole(rl)
+		if err != nil {
+			log.WithError(err).WithField("role", rl.Name).Error("unable to apply role")
+		} else {
+			log.WithFields(log.Fields{
+				"role":      rl.Name,
+				"namespace": rl.Namespace,
+				"action":    act,
+			}).Info("applied role")
+		}
+	}
+	for i := range desired.RoleBindings {
+		rb := &desired.RoleBindings[i]
+		act, err := rec.ApplyRoleBinding(rb)
+		if err != nil {
+			log.WithError(err).WithField("rolebinding", rb.Name).Error("unable to apply rolebinding")
+		} else {
+			log.WithFields(log.Fields{
+				"rolebinding": rb.Name,
+				"namespace":   rb.Namespace,
+				"action":      act,
+			}).Info("applied rolebinding")
+		}
+	}
+	// Done with the namespace-scoped resources, next up is the Global ones (these are only
+	// in the desired state if -global is set)
+	for i := range desired.ClusterRoles {
+		cr := &desired.ClusterRoles[i]
+		act, err := rec.ApplyClusterRole(cr)
+		if err != nil {
+			log.WithError(err).WithField("clusterrole", cr.Name).Error("unable to apply clusterrole")
+		} else {
+			log.WithFields(log.Fields{
+				"clusterrole": cr.Name,
+				"action":      act,
+			}).Info("applied clusterrole")
+		}
+	}
+	for i := range desired.ClusterRoleBindings {
+		crb := &desired.ClusterRoleBindings[i]
+		act, err := rec.ApplyClusterRoleBinding(crb)
+		if err != nil {
+			log.WithError(err).WithField("clusterrolebinding", crb.Name).Error("unable to apply clusterrolebinding")
+		} else {
+			log.WithFields(log.Fields{
+				"clusterrolebinding": crb.Name,
+				"action":             act,
+			}).Info("applied clusterrolebinding")
+		}
+	}
+}
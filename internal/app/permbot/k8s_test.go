@@ -0,0 +1,90 @@
+package permbot
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/k8s"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/metrics"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/policy"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+func testNamespace(name string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+}
+
+func TestReconcileExpiresBreakGlassOnPolicyViolation(t *testing.T) {
+	pc := &types.PermbotConfig{
+		Projects: []types.Project{{Namespace: "prod", Roles: []types.RoleUsers{{Role: "edit", Users: []string{"alice"}}}}},
+		Roles:    []types.Role{{Name: "edit", ClusterRole: "edit"}},
+	}
+	g, err := k8s.CreateBreakGlass(pc, "edit", "bob", "prod", "INC-1", "permbot", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := fake.NewSimpleClientset()
+	if err := k8s.ApplyBreakGlass(cl, g); err != nil {
+		t.Fatal(err)
+	}
+	opts := options{owner: "permbot", policies: []policy.Policy{{Name: "no-edit", DeniedRoles: []string{"edit"}}}}
+	if err := reconcile(cl, pc, opts); err == nil {
+		t.Fatal("reconcile() of config violating policy succeeded")
+	}
+	if _, err := cl.RbacV1().RoleBindings("prod").Get(g.Binding.Name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expired break-glass grant still present after failed reconcile, error = %v", err)
+	}
+}
+
+func TestCheckPoliciesIncludesGlobal(t *testing.T) {
+	pc := &types.PermbotConfig{
+		Roles: []types.Role{{Name: "view", ClusterRole: "view", GlobalUsers: []string{"alice"}}},
+	}
+	// Global bindings are checked even when -global=false, as they may already exist
+	opts := options{owner: "permbot", global: false, policies: []policy.Policy{{Name: "no-global", DenyGlobal: true}}}
+	if err := checkPolicies(pc, opts); err == nil {
+		t.Error("checkPolicies() of global grant with denyGlobal succeeded")
+	}
+}
+
+func TestReconcileDriftMetric(t *testing.T) {
+	pc := &types.PermbotConfig{
+		Projects: []types.Project{{Namespace: "prod", Roles: []types.RoleUsers{{Role: "view", Users: []string{"alice"}}}}},
+		Roles:    []types.Role{{Name: "view", Rules: []types.Rule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}}}}},
+	}
+	cl := fake.NewSimpleClientset(testNamespace("prod"))
+	opts := options{owner: "permbot", rulesRef: "v1", metrics: metrics.New()}
+	drift := func() string {
+		var buf bytes.Buffer
+		opts.metrics.WriteText(&buf)
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if strings.HasPrefix(line, "permbot_drift_objects ") {
+				return line
+			}
+		}
+		return ""
+	}
+	for _, tt := range []struct {
+		what, ref, want string
+	}{
+		{"first reconcile", "v1", "permbot_drift_objects 2"},
+		{"unchanged", "v1", "permbot_drift_objects 0"},
+		// Only the -ref annotation changes, which check mode doesn't count as drift either
+		{"new ref", "v2", "permbot_drift_objects 0"},
+	} {
+		opts.rulesRef = tt.ref
+		if err := reconcile(cl, pc, opts); err != nil {
+			t.Fatal(err)
+		}
+		if got := drift(); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.what, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package permbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/app"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/lint"
+)
+
+// runLint checks the roles in the config files for dangerous permissions, printing every
+// finding and exiting non-zero if any error-level findings aren't suppressed with lintIgnore
+func runLint(files []string, opts options) {
+	findings, err := lint.Files(files)
+	if err != nil {
+		log.WithError(err).Fatal("unable to lint")
+	}
+	errs, warnings, suppressed := 0, 0, 0
+	for _, f := range findings {
+		switch {
+		case f.Suppressed:
+			suppressed++
+		case f.Severity == lint.SeverityError:
+			errs++
+		default:
+			warnings++
+		}
+	}
+	switch opts.output {
+	case "sarif":
+		if err := lint.WriteSARIF(os.Stdout, findings, app.Version()); err != nil {
+			log.WithError(err).Fatal("unable to write findings")
+		}
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if findings == nil {
+			findings = []lint.Finding{}
+		}
+		if err := enc.Encode(findings); err != nil {
+			log.WithError(err).Fatal("unable to write findings")
+		}
+	case "text":
+		for _, f := range findings {
+			if !f.Suppressed {
+				fmt.Println(f)
+			}
+		}
+	default:
+		log.WithField("output", opts.output).Fatal("Unknown output format - use text, json or sarif")
+	}
+	fields := log.Fields{"errors": errs, "warnings": warnings, "suppressed": suppressed}
+	if errs > 0 {
+		log.WithFields(fields).Fatal("config grants dangerous permissions")
+	}
+	log.WithFields(fields).Info("lint passed")
+}
@@ -0,0 +1,132 @@
+package permbot
+
+import (
+	"io/ioutil"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/app"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/audit"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/k8s"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/notify"
+)
+
+// buildNotifiers creates a notifier for every webhook URL given on the command-line, all
+// using the message template in templateFile (or the default if it's empty)
+func buildNotifiers(slack, teams, webhooks []string, templateFile string) ([]notify.Notifier, error) {
+	var tmpl *template.Template
+	if templateFile != "" {
+		text, err := ioutil.ReadFile(templateFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read notification template")
+		}
+		if tmpl, err = notify.NewTemplate(string(text)); err != nil {
+			return nil, err
+		}
+	}
+	var notifiers []notify.Notifier
+	for _, u := range slack {
+		notifiers = append(notifiers, notify.NewSlack(u, tmpl))
+	}
+	for _, u := range teams {
+		notifiers = append(notifiers, notify.NewTeams(u, tmpl))
+	}
+	for _, u := range webhooks {
+		notifiers = append(notifiers, notify.NewWebhook(u, tmpl))
+	}
+	return notifiers, nil
+}
+
+// changeTracker works out what a reconcile actually changed, by planning before applying
+// and then dropping the changes which failed, so that they can be announced and audited
+type changeTracker struct {
+	cl      kubernetes.Interface
+	opts    options
+	desired *k8s.DesiredState
+	plan    *k8s.Plan
+	failed  map[k8s.ObjectRef]bool
+	// pruneDone is set once pruning has happened, until then planned deletions are left out
+	pruneDone bool
+}
+
+// newChangeTracker plans the changes needed to apply desired, but only if there is
+// anything to announce them to, an audit log to write or metrics to record drift in
+func newChangeTracker(cl kubernetes.Interface, desired *k8s.DesiredState, prune bool, opts options) *changeTracker {
+	t := &changeTracker{cl: cl, opts: opts, desired: desired, failed: make(map[k8s.ObjectRef]bool)}
+	if len(opts.notifiers) == 0 && opts.audit == nil && opts.metrics == nil {
+		return t
+	}
+	plan, err := k8s.BuildPlan(cl, desired, prune, opts.pruneOptions())
+	if err != nil {
+		log.WithError(err).Warn("unable to work out changes - they won't be announced")
+		return t
+	}
+	t.plan = plan
+	// drift is counted as in check mode, before anything is applied
+	opts.metrics.SetDrift(len(plan.Drift().Changes))
+	return t
+}
+
+// observe is a k8s.Reconciler Observer, which also records metrics
+func (t *changeTracker) observe(ref k8s.ObjectRef, a k8s.Action, err error) {
+	t.opts.metrics.ObjectApplied(ref, a, err)
+	if err != nil {
+		t.failed[ref] = true
+	}
+}
+
+// pruned records the result of pruning orphans, of which only pruned were deleted
+func (t *changeTracker) pruned(orphans, pruned []k8s.ObjectRef) {
+	t.opts.metrics.ObjectsPruned(orphans, pruned)
+	t.pruneDone = true
+	done := make(map[k8s.ObjectRef]bool, len(pruned))
+	for _, o := range pruned {
+		done[o] = true
+	}
+	for _, o := range orphans {
+		if !done[o] {
+			t.failed[o] = true
+		}
+	}
+}
+
+// announce sends the changes which were applied to every notifier, and writes them to the
+// audit log. Only drift is announced, so updates to just the permbot version or rules-ref
+// annotations (e.g. every object when -ref changes) don't cause notifications.
+func (t *changeTracker) announce() {
+	if t.plan == nil {
+		return
+	}
+	if !t.pruneDone {
+		for _, c := range t.plan.Changes {
+			if c.Action == k8s.ActionDelete {
+				t.failed[c.Object] = true
+			}
+		}
+	}
+	applied := t.plan.Applied(t.failed)
+	if !applied.HasChanges() {
+		return
+	}
+	if t.opts.audit != nil {
+		if err := t.opts.audit.Write(audit.Events(applied, t.desired, clusterRules(t.cl))); err != nil {
+			log.WithError(err).Error("unable to write audit log")
+		}
+	}
+	drift := applied.Drift()
+	if !drift.HasChanges() {
+		return
+	}
+	notify.All(t.opts.notifiers, &notify.ChangeSet{
+		Version:  app.Version(),
+		Owner:    t.opts.owner,
+		RulesRef: t.opts.rulesRef,
+		Time:     time.Now().UTC(),
+		Changes:  drift.Changes,
+		Summary:  drift.Summary,
+	})
+}
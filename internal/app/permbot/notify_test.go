@@ -0,0 +1,44 @@
+package permbot
+
+import (
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/notify"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+// recorder is a notify.Notifier which keeps every change set
+type recorder struct {
+	sets []*notify.ChangeSet
+}
+
+func (r *recorder) Notify(cs *notify.ChangeSet) error {
+	r.sets = append(r.sets, cs)
+	return nil
+}
+
+func TestReconcileOnlyAnnouncesDrift(t *testing.T) {
+	pc := &types.PermbotConfig{
+		Projects: []types.Project{{Namespace: "prod", Roles: []types.RoleUsers{{Role: "view", Users: []string{"alice"}}}}},
+		Roles:    []types.Role{{Name: "view", Rules: []types.Rule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}}}}},
+	}
+	cl := fake.NewSimpleClientset(testNamespace("prod"))
+	rec := &recorder{}
+	opts := options{owner: "permbot", rulesRef: "v1", notifiers: []notify.Notifier{rec}}
+	if err := reconcile(cl, pc, opts); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.sets) != 1 || rec.sets[0].Summary.Create != 2 {
+		t.Fatalf("first reconcile announced %+v, want the Role and RoleBinding created", rec.sets)
+	}
+	// A new -ref only changes annotations, which isn't worth announcing
+	opts.rulesRef = "v2"
+	if err := reconcile(cl, pc, opts); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.sets) != 1 {
+		t.Errorf("reconcile with new -ref announced %+v, want nothing", rec.sets[1:])
+	}
+}
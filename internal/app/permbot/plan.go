@@ -0,0 +1,46 @@
+package permbot
+
+import (
+	"encoding/json"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/k8s"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+// buildPlan compares the config with the live cluster, without changing anything
+func buildPlan(cl kubernetes.Interface, pc *types.PermbotConfig, opts options) *k8s.Plan {
+	plan, err := k8s.BuildPlan(cl, desiredState(cl, pc, opts), opts.prune, opts.pruneOptions())
+	if err != nil {
+		log.WithError(err).Fatal("unable to build plan")
+	}
+	return plan
+}
+
+// writePlan writes the plan to stdout in the format selected by -output
+func writePlan(plan *k8s.Plan, output string) {
+	switch output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(plan); err != nil {
+			log.WithError(err).Fatal("unable to write plan")
+		}
+	case "text":
+		plan.WriteText(os.Stdout)
+	default:
+		log.WithField("output", output).Fatal("Unknown output format - use text or json")
+	}
+}
+
+// runPlan prints the changes that k8s mode would make to the cluster, exiting non-zero if
+// k8s mode would refuse to make them because the config violates a -policy
+func runPlan(cl kubernetes.Interface, pc *types.PermbotConfig, opts options) {
+	writePlan(buildPlan(cl, pc, opts), opts.output)
+	if err := checkPolicies(pc, opts); err != nil {
+		log.WithError(err).Fatal("k8s mode would not apply this plan")
+	}
+}
@@ -0,0 +1,49 @@
+package permbot
+
+import (
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/config"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/k8s"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/policy"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/query"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+// loadPolicies loads the policy files, directories or globs given with -policy
+func loadPolicies(paths []string) ([]policy.Policy, error) {
+	files, err := config.Files(paths)
+	if err != nil {
+		return nil, err
+	}
+	return policy.Load(files)
+}
+
+// checkPolicies evaluates the policies against every binding the config produces, for
+// every project whether or not its namespace exists and including global bindings even
+// without -global, logging each violation. An error is returned if there were any, in
+// which case nothing should be applied.
+func checkPolicies(pc *types.PermbotConfig, opts options) error {
+	if len(opts.policies) == 0 {
+		return nil
+	}
+	ds, err := k8s.CreateDesiredState(pc, opts.rulesRef, opts.owner, true, nil)
+	if err != nil {
+		return errors.Wrap(err, "unable to define resources")
+	}
+	violations := policy.Evaluate(opts.policies, query.Grants(ds))
+	for _, v := range violations {
+		log.WithFields(log.Fields{
+			"policy":    v.Policy,
+			"subject":   v.Subject,
+			"namespace": v.Namespace,
+			"role":      v.Role,
+		}).Error(v.Message)
+	}
+	if len(violations) > 0 {
+		return errors.Errorf("config violates policy %d times", len(violations))
+	}
+	log.WithField("policies", len(opts.policies)).Debug("config satisfies policies")
+	return nil
+}
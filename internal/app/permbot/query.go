@@ -0,0 +1,97 @@
+package permbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/k8s"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/query"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+// warnUnresolved warns about each project whose namespaceSelector hasn't been resolved,
+// as modes which don't use the cluster leave them out unless -namespaces-file is given
+func warnUnresolved(pc *types.PermbotConfig) {
+	for i := range pc.Projects {
+		if sel := pc.Projects[i].NamespaceSelector; sel != nil {
+			log.WithFields(log.Fields{
+				"project":  i,
+				"selector": sel.String(),
+			}).Warn("project with namespaceSelector left out - use -namespaces-file to list the namespaces it applies to")
+		}
+	}
+}
+
+// configGrants lists every grant the config makes, for every project regardless of whether
+// its namespace exists, without needing a cluster. Projects with unresolved namespace
+// selectors are left out, with a warning.
+func configGrants(pc *types.PermbotConfig, opts options) []query.Grant {
+	warnUnresolved(pc)
+	ds, err := k8s.CreateDesiredState(pc, opts.rulesRef, opts.owner, true, nil)
+	if err != nil {
+		log.WithError(err).Fatal("unable to define resources")
+	}
+	return query.Grants(ds)
+}
+
+// runWhoCan prints the subjects allowed verb on resource in -namespace (or any namespace
+// if it isn't set), including through cluster-wide bindings. If name is set, rules with
+// resourceNames must include it.
+func runWhoCan(pc *types.PermbotConfig, opts options, verb, resource, name string) {
+	if verb == "" || resource == "" {
+		log.Fatal("who-can mode needs -verb and -resource")
+	}
+	res := query.ParseResource(resource)
+	res.Name = name
+	grants := query.WhoCan(configGrants(pc, opts), verb, res, opts.namespace)
+	writeGrants(os.Stdout, grants, opts.output)
+}
+
+// runWhatCan prints everything user is allowed to do
+func runWhatCan(pc *types.PermbotConfig, opts options, user string) {
+	if user == "" {
+		log.Fatal("what-can mode needs -user")
+	}
+	grants := query.WhatCan(configGrants(pc, opts), "User", user)
+	writeGrants(os.Stdout, grants, opts.output)
+}
+
+// writeGrants writes the grants as a table or JSON, as selected by -output
+func writeGrants(w io.Writer, grants []query.Grant, output string) {
+	switch output {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if grants == nil {
+			grants = []query.Grant{}
+		}
+		if err := enc.Encode(grants); err != nil {
+			log.WithError(err).Fatal("unable to write grants")
+		}
+	case "text":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "SUBJECT\tNAMESPACE\tROLE\tRULE")
+		for _, g := range grants {
+			ns := g.Namespace
+			if ns == "" {
+				ns = "*"
+			}
+			rule := "(rules of existing ClusterRole not in config)"
+			if !g.Unknown() {
+				rule = k8s.FormatRule(*g.Rule)
+			}
+			if g.NameRestricted {
+				rule += " (named objects only)"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s/%s\t%s\n", k8s.FormatSubject(g.Subject), ns, g.Role.Kind, g.Role.Name, rule)
+		}
+		tw.Flush()
+	default:
+		log.WithField("output", output).Fatal("Unknown output format - use text or json")
+	}
+}
@@ -0,0 +1,39 @@
+package permbot
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/report"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+// runReport prints the access matrix for the config in the format selected by -output,
+// where text is Markdown
+func runReport(pc *types.PermbotConfig, opts options) {
+	warnUnresolved(pc)
+	rep, err := report.Build(pc, time.Now())
+	if err != nil {
+		log.WithError(err).Fatal("unable to build report")
+	}
+	switch opts.output {
+	case "csv":
+		err = rep.WriteCSV(os.Stdout)
+	case "text", "markdown":
+		err = rep.WriteMarkdown(os.Stdout)
+	case "html":
+		err = rep.WriteHTML(os.Stdout)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(rep)
+	default:
+		log.WithField("output", opts.output).Fatal("Unknown output format - use markdown, csv, html or json")
+	}
+	if err != nil {
+		log.WithError(err).Fatal("unable to write report")
+	}
+}
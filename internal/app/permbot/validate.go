@@ -0,0 +1,58 @@
+package permbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/validate"
+)
+
+// runValidate checks the config files for unknown keys and broken references, printing
+// every problem found and exiting non-zero if there were any. With -validate-cluster,
+// referenced ClusterRoles are also checked against the cluster.
+func runValidate(files []string, opts options) {
+	var cl kubernetes.Interface
+	if opts.validateCluster {
+		kc, err := getK8SClient()
+		if err != nil {
+			log.WithError(err).Fatal("unable to create k8s client")
+		}
+		cl = kc
+	}
+	problems, err := validate.Files(files, cl)
+	if err != nil {
+		log.WithError(err).Fatal("unable to validate")
+	}
+	switch opts.output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if problems == nil {
+			problems = []validate.Problem{}
+		}
+		if err := enc.Encode(problems); err != nil {
+			log.WithError(err).Fatal("unable to write problems")
+		}
+	case "", "text":
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+	default:
+		log.WithField("output", opts.output).Fatal("Unknown output format - use text or json")
+	}
+	// Warnings, such as grants about to expire, are printed but don't make the config invalid
+	errs := 0
+	for _, p := range problems {
+		if !p.Warning {
+			errs++
+		}
+	}
+	if errs > 0 {
+		log.WithFields(log.Fields{"problems": errs, "warnings": len(problems) - errs}).Fatal("config is invalid")
+	}
+	log.WithField("warnings", len(problems)).Info("config is valid")
+}
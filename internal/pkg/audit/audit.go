@@ -0,0 +1,318 @@
+// Package audit turns the changes made by a reconcile into an append-only JSON-lines record
+// of which subjects gained or lost which permissions, and where.
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	rbacv1 "k8s.io/api/rbac/v1"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/k8s"
+)
+
+const (
+	// ActionGrant means the subject gained the rules
+	ActionGrant = "grant"
+	// ActionRevoke means the subject lost the rules
+	ActionRevoke = "revoke"
+)
+
+// Event records a single subject gaining or losing the rules of a role in a namespace
+type Event struct {
+	Time     time.Time      `json:"time"`
+	Version  string         `json:"version"`
+	Owner    string         `json:"owner"`
+	RulesRef string         `json:"rulesRef,omitempty"`
+	Action   string         `json:"action"`
+	Subject  rbacv1.Subject `json:"subject"`
+	// Role is the Role or ClusterRole whose rules were granted or revoked
+	Role rbacv1.RoleRef `json:"role"`
+	// Namespace is where the rules apply, empty for cluster-wide bindings
+	Namespace string `json:"namespace,omitempty"`
+	// Object is the binding or role whose change caused the event
+	Object k8s.ObjectRef       `json:"object"`
+	Verbs  []string            `json:"verbs"`
+	Rules  []rbacv1.PolicyRule `json:"rules"`
+	// BreakGlass, Expires and Reason are set for temporary grants made outside the config
+	BreakGlass bool       `json:"breakGlass,omitempty"`
+	Expires    *time.Time `json:"expires,omitempty"`
+	Reason     string     `json:"reason,omitempty"`
+}
+
+// RulesFunc returns the rules of a role which permbot doesn't manage (such as the built-in
+// "edit" ClusterRole), as referenced by a binding in namespace
+type RulesFunc func(ref rbacv1.RoleRef, namespace string) []rbacv1.PolicyRule
+
+// roleKey identifies a Role (by namespace and name) or ClusterRole (by name)
+type roleKey struct {
+	kind, namespace, name string
+}
+
+func keyFor(ref rbacv1.RoleRef, namespace string) roleKey {
+	if ref.Kind == "ClusterRole" {
+		return roleKey{kind: ref.Kind, name: ref.Name}
+	}
+	return roleKey{kind: ref.Kind, namespace: namespace, name: ref.Name}
+}
+
+// diff works out the audit events for a plan
+type diff struct {
+	plan    *k8s.Plan
+	desired *k8s.DesiredState
+	lookup  RulesFunc
+	// desiredRules and liveRules hold the rules of every role managed by permbot, after and
+	// before the plan is applied
+	desiredRules map[roleKey][]rbacv1.PolicyRule
+	liveRules    map[roleKey][]rbacv1.PolicyRule
+	events       []Event
+}
+
+// rules returns the rules of a role before (live) or after the plan is applied
+func (d *diff) rules(ref rbacv1.RoleRef, namespace string, live bool) []rbacv1.PolicyRule {
+	k := keyFor(ref, namespace)
+	m := d.desiredRules
+	if live {
+		m = d.liveRules
+	}
+	if r, ok := m[k]; ok {
+		return r
+	}
+	if d.lookup != nil {
+		return d.lookup(ref, namespace)
+	}
+	return nil
+}
+
+func (d *diff) add(action string, s rbacv1.Subject, ref rbacv1.RoleRef, namespace string, object k8s.ObjectRef, rules []rbacv1.PolicyRule) {
+	d.events = append(d.events, Event{
+		Action:    action,
+		Subject:   s,
+		Role:      ref,
+		Namespace: namespace,
+		Object:    object,
+		Verbs:     verbs(rules),
+		Rules:     rules,
+	})
+}
+
+// verbs returns the sorted set of verbs in rules
+func verbs(rules []rbacv1.PolicyRule) []string {
+	seen := make(map[string]bool)
+	out := []string{}
+	for _, r := range rules {
+		for _, v := range r.Verbs {
+			if !seen[v] {
+				seen[v] = true
+				out = append(out, v)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// removeRules returns rules without any of remove
+func removeRules(rules, remove []rbacv1.PolicyRule) []rbacv1.PolicyRule {
+	kept, _ := k8s.DiffRules(rules, remove)
+	return kept
+}
+
+// removeSubjects returns subjects without any of remove
+func removeSubjects(subjects, remove []rbacv1.Subject) []rbacv1.Subject {
+	kept, _ := k8s.DiffSubjects(subjects, remove)
+	return kept
+}
+
+// Events works out every subject/role/namespace delta made by applying plan, which must
+// have been built from desired. Changing the subjects of a binding grants or revokes the
+// whole role for those subjects, while changing the rules of a role grants or revokes just
+// those rules for every subject already bound to it.
+func Events(plan *k8s.Plan, desired *k8s.DesiredState, lookup RulesFunc) []Event {
+	d := &diff{
+		plan:         plan,
+		desired:      desired,
+		lookup:       lookup,
+		desiredRules: make(map[roleKey][]rbacv1.PolicyRule),
+		liveRules:    make(map[roleKey][]rbacv1.PolicyRule),
+	}
+	for i := range desired.Roles {
+		r := &desired.Roles[i]
+		d.desiredRules[roleKey{kind: "Role", namespace: r.Namespace, name: r.Name}] = r.Rules
+	}
+	for i := range desired.ClusterRoles {
+		r := &desired.ClusterRoles[i]
+		d.desiredRules[roleKey{kind: "ClusterRole", name: r.Name}] = r.Rules
+	}
+	// The live rules are the desired ones with the plan's rule changes undone
+	changed := make(map[k8s.ObjectRef]*k8s.Change)
+	for i := range plan.Changes {
+		c := &plan.Changes[i]
+		changed[c.Object] = c
+		k := roleKey{kind: c.Object.Kind, namespace: c.Object.Namespace, name: c.Object.Name}
+		switch {
+		case c.Object.Kind != "Role" && c.Object.Kind != "ClusterRole":
+		case c.Action == k8s.ActionCreate:
+			d.liveRules[k] = nil
+		case c.Action == k8s.ActionDelete:
+			d.liveRules[k] = c.RulesRemoved
+		default:
+			d.liveRules[k] = append(removeRules(d.desiredRules[k], c.RulesAdded), c.RulesRemoved...)
+		}
+	}
+	for k, r := range d.desiredRules {
+		if _, ok := d.liveRules[k]; !ok {
+			d.liveRules[k] = r
+		}
+	}
+
+	for i := range plan.Changes {
+		c := &plan.Changes[i]
+		switch c.Object.Kind {
+		case "RoleBinding", "ClusterRoleBinding":
+			d.bindingEvents(c)
+		case "Role", "ClusterRole":
+			d.roleEvents(c, changed)
+		}
+	}
+	return d.events
+}
+
+// bindingEvents adds events for subjects added to or removed from a binding
+func (d *diff) bindingEvents(c *k8s.Change) {
+	if c.RoleRef == nil {
+		return
+	}
+	ns := c.Object.Namespace
+	if c.RoleRefFrom != nil {
+		// The binding is recreated for a different role, so everyone bound before loses the
+		// old role, and everyone bound after gains the new one
+		var after []rbacv1.Subject
+		for _, b := range d.desired.RoleBindings {
+			if b.Namespace == ns && b.Name == c.Object.Name && c.Object.Kind == "RoleBinding" {
+				after = b.Subjects
+			}
+		}
+		for _, b := range d.desired.ClusterRoleBindings {
+			if b.Name == c.Object.Name && c.Object.Kind == "ClusterRoleBinding" {
+				after = b.Subjects
+			}
+		}
+		before := append(removeSubjects(after, c.SubjectsAdded), c.SubjectsRemoved...)
+		for _, s := range before {
+			d.add(ActionRevoke, s, *c.RoleRefFrom, ns, c.Object, d.rules(*c.RoleRefFrom, ns, true))
+		}
+		for _, s := range after {
+			d.add(ActionGrant, s, *c.RoleRefTo, ns, c.Object, d.rules(*c.RoleRefTo, ns, false))
+		}
+		return
+	}
+	for _, s := range c.SubjectsAdded {
+		d.add(ActionGrant, s, *c.RoleRef, ns, c.Object, d.rules(*c.RoleRef, ns, false))
+	}
+	for _, s := range c.SubjectsRemoved {
+		d.add(ActionRevoke, s, *c.RoleRef, ns, c.Object, d.rules(*c.RoleRef, ns, true))
+	}
+}
+
+// roleEvents adds events for rules added to or removed from a role, for every subject
+// which stays bound to it. Subjects being added or removed are covered by bindingEvents.
+func (d *diff) roleEvents(c *k8s.Change, changed map[k8s.ObjectRef]*k8s.Change) {
+	if c.Action == k8s.ActionDelete || len(c.RulesAdded)+len(c.RulesRemoved) == 0 {
+		return
+	}
+	ref := rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: c.Object.Kind, Name: c.Object.Name}
+	target := keyFor(ref, c.Object.Namespace)
+	kept := func(meta k8s.ObjectRef, subjects []rbacv1.Subject, roleRef rbacv1.RoleRef) {
+		if keyFor(roleRef, meta.Namespace) != target {
+			return
+		}
+		bc := changed[meta]
+		if bc != nil && (bc.Action == k8s.ActionCreate || bc.RoleRefFrom != nil) {
+			// every subject of the binding is new, and bindingEvents covers them
+			return
+		}
+		if bc != nil {
+			subjects = removeSubjects(subjects, bc.SubjectsAdded)
+		}
+		for _, s := range subjects {
+			if len(c.RulesAdded) > 0 {
+				d.add(ActionGrant, s, ref, meta.Namespace, c.Object, c.RulesAdded)
+			}
+			if len(c.RulesRemoved) > 0 {
+				d.add(ActionRevoke, s, ref, meta.Namespace, c.Object, c.RulesRemoved)
+			}
+		}
+	}
+	for _, b := range d.desired.RoleBindings {
+		kept(k8s.ObjectRef{Kind: "RoleBinding", Namespace: b.Namespace, Name: b.Name}, b.Subjects, b.RoleRef)
+	}
+	for _, b := range d.desired.ClusterRoleBindings {
+		kept(k8s.ObjectRef{Kind: "ClusterRoleBinding", Name: b.Name}, b.Subjects, b.RoleRef)
+	}
+}
+
+// BreakGlassEvents returns the events for a break-glass grant being made (ActionGrant) or
+// removed once it expires (ActionRevoke)
+func BreakGlassEvents(g *k8s.BreakGlassGrant, action string, lookup RulesFunc) []Event {
+	b := &g.Binding
+	var rules []rbacv1.PolicyRule
+	if g.Role != nil {
+		rules = g.Role.Rules
+	} else if lookup != nil {
+		rules = lookup(b.RoleRef, b.Namespace)
+	}
+	expires := g.Expires.UTC()
+	events := make([]Event, 0, len(b.Subjects))
+	for _, s := range b.Subjects {
+		events = append(events, Event{
+			Action:     action,
+			Subject:    s,
+			Role:       b.RoleRef,
+			Namespace:  b.Namespace,
+			Object:     k8s.ObjectRef{Kind: "RoleBinding", Namespace: b.Namespace, Name: b.Name},
+			Verbs:      verbs(rules),
+			Rules:      rules,
+			BreakGlass: true,
+			Expires:    &expires,
+			Reason:     g.Reason,
+		})
+	}
+	return events
+}
+
+// Log writes audit events as JSON lines
+type Log struct {
+	enc      *json.Encoder
+	version  string
+	owner    string
+	rulesRef string
+	now      func() time.Time
+}
+
+// NewLog creates a Log writing to w, stamping every event with the permbot version, owner
+// and rules ref
+func NewLog(w io.Writer, version, owner, rulesRef string) *Log {
+	return &Log{
+		enc:      json.NewEncoder(w),
+		version:  version,
+		owner:    owner,
+		rulesRef: rulesRef,
+		now:      time.Now,
+	}
+}
+
+// Write writes one line for each event
+func (l *Log) Write(events []Event) error {
+	now := l.now().UTC()
+	for _, e := range events {
+		e.Time, e.Version, e.Owner, e.RulesRef = now, l.version, l.owner, l.rulesRef
+		if err := l.enc.Encode(e); err != nil {
+			return errors.Wrap(err, "unable to write audit event")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/k8s"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+func TestEvents(t *testing.T) {
+	pc := &types.PermbotConfig{
+		Projects: []types.Project{
+			{Namespace: "a", Roles: []types.RoleUsers{{Role: "execute", Users: []string{"alice", "bob"}}}},
+			{Namespace: "b", Roles: []types.RoleUsers{{Role: "execute", Users: []string{"carol"}}}},
+		},
+		Roles: []types.Role{
+			{
+				Name: "execute",
+				Rules: []types.Rule{
+					{APIGroups: []string{""}, Resources: []string{"pods/exec"}, Verbs: []string{"create"}},
+					{APIGroups: []string{""}, Resources: []string{"pods/log"}, Verbs: []string{"get"}},
+				},
+			},
+		},
+	}
+	desired, err := k8s.CreateDesiredState(pc, "", "permbot", true, nil)
+	if err != nil {
+		t.Fatalf("CreateDesiredState() error = %v", err)
+	}
+	// In namespace "a" the role can't read logs yet, alice keeps access, bob is missing and
+	// mallory was added by hand
+	liveRole := desired.Roles[0].DeepCopy()
+	liveRole.Rules = liveRole.Rules[:1]
+	liveBinding := desired.RoleBindings[0].DeepCopy()
+	liveBinding.Subjects = []rbacv1.Subject{
+		{APIGroup: rbacv1.GroupName, Kind: "User", Name: "alice"},
+		{APIGroup: rbacv1.GroupName, Kind: "User", Name: "mallory"},
+	}
+	// A binding to a ClusterRole permbot doesn't manage, left over from a removed project
+	orphan := liveBinding.DeepCopy()
+	orphan.Namespace = "gone"
+	orphan.Subjects = orphan.Subjects[:1]
+	orphan.RoleRef = rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "view"}
+	cl := fake.NewSimpleClientset(liveRole, liveBinding, orphan)
+
+	plan, err := k8s.BuildPlan(cl, desired, true, k8s.PruneOptions{Owner: "permbot", Global: true})
+	if err != nil {
+		t.Fatalf("BuildPlan() error = %v", err)
+	}
+	lookup := func(ref rbacv1.RoleRef, ns string) []rbacv1.PolicyRule {
+		if ref.Kind == "ClusterRole" && ref.Name == "view" {
+			return []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"list", "get"}}}
+		}
+		return nil
+	}
+	var got []string
+	for _, e := range Events(plan, desired, lookup) {
+		got = append(got, fmt.Sprintf("%s %s %s/%s %s %s", e.Action, e.Subject.Name, e.Namespace, e.Role.Name, e.Object.Kind, strings.Join(e.Verbs, ",")))
+	}
+	sort.Strings(got)
+	want := []string{
+		"grant alice a/permbot-auto-role-execute Role get",
+		"grant bob a/permbot-auto-role-execute RoleBinding create,get",
+		"grant carol b/permbot-auto-role-execute RoleBinding create,get",
+		"revoke alice gone/view RoleBinding get,list",
+		"revoke mallory a/permbot-auto-role-execute RoleBinding create",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Events() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestEventsRoleRefChange(t *testing.T) {
+	subjects := []rbacv1.Subject{{APIGroup: rbacv1.GroupName, Kind: "Group", Name: "devs"}}
+	from := rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "view"}
+	to := rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "edit"}
+	desired := &k8s.DesiredState{ClusterRoleBindings: []rbacv1.ClusterRoleBinding{{Subjects: subjects, RoleRef: to}}}
+	desired.ClusterRoleBindings[0].Name = "devs"
+	plan := &k8s.Plan{Changes: []k8s.Change{{
+		Action:      k8s.ActionUpdate,
+		Object:      k8s.ObjectRef{Kind: "ClusterRoleBinding", Name: "devs"},
+		RoleRef:     &to,
+		RoleRefFrom: &from,
+		RoleRefTo:   &to,
+	}}}
+	events := Events(plan, desired, nil)
+	if len(events) != 2 {
+		t.Fatalf("Events() = %+v, want 2 events", events)
+	}
+	if events[0].Action != ActionRevoke || events[0].Role != from || events[1].Action != ActionGrant || events[1].Role != to {
+		t.Errorf("Events() = %+v, want revoke of view then grant of edit", events)
+	}
+}
+
+func TestLog(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLog(&buf, "v1.2.3", "permbot", "abc123")
+	l.now = func() time.Time { return time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC) }
+	events := []Event{
+		{Action: ActionGrant, Subject: rbacv1.Subject{Kind: "User", Name: "alice"}, Namespace: "a", Verbs: []string{"get"}},
+		{Action: ActionRevoke, Subject: rbacv1.Subject{Kind: "User", Name: "bob"}, Verbs: []string{}},
+	}
+	if err := l.Write(events); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	s := bufio.NewScanner(&buf)
+	var lines int
+	for s.Scan() {
+		var e Event
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatalf("line %d is not an event: %v", lines+1, err)
+		}
+		if e.Version != "v1.2.3" || e.Owner != "permbot" || e.RulesRef != "abc123" || !e.Time.Equal(l.now()) {
+			t.Errorf("line %d = %+v, missing version, owner, ref or time", lines+1, e)
+		}
+		if e.Action != events[lines].Action || e.Subject != events[lines].Subject {
+			t.Errorf("line %d = %+v, want %+v", lines+1, e, events[lines])
+		}
+		lines++
+	}
+	if lines != len(events) {
+		t.Errorf("wrote %d lines, want %d", lines, len(events))
+	}
+}
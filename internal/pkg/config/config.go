@@ -0,0 +1,141 @@
+// Package config loads permbot configuration, which may be split over several TOML files
+// (e.g. one per team) that are combined into a single PermbotConfig.
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+// Files expands a list of paths into the config files they refer to. Each path can be a
+// single file, a directory (in which case every *.toml file directly inside it is used) or
+// a glob pattern. The result is sorted within each path, and files are only listed once.
+func Files(paths []string) ([]string, error) {
+	var files []string
+	seen := make(map[string]bool)
+	add := func(fn string) {
+		if !seen[fn] {
+			seen[fn] = true
+			files = append(files, fn)
+		}
+	}
+	for _, p := range paths {
+		st, err := os.Stat(p)
+		if err == nil && st.IsDir() {
+			matches, err := filepath.Glob(filepath.Join(p, "*.toml"))
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to list config directory %s", p)
+			}
+			if len(matches) == 0 {
+				return nil, errors.Errorf("no *.toml files in config directory %s", p)
+			}
+			sort.Strings(matches)
+			for _, m := range matches {
+				add(m)
+			}
+			continue
+		} else if err == nil {
+			add(p)
+			continue
+		}
+		if !strings.ContainsAny(p, "*?[") {
+			return nil, errors.Wrap(err, "unable to open config")
+		}
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad config pattern %s", p)
+		}
+		if len(matches) == 0 {
+			return nil, errors.Errorf("no config files match %s", p)
+		}
+		sort.Strings(matches)
+		for _, m := range matches {
+			add(m)
+		}
+	}
+	return files, nil
+}
+
+// DecodeFile decodes a single file from `fn` into the PermbotConfig pointer `into`
+func DecodeFile(fn string, into *types.PermbotConfig) (toml.MetaData, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return toml.MetaData{}, errors.Wrap(err, "unable to open config")
+	}
+	defer f.Close()
+	md, err := toml.DecodeReader(f, into)
+	if err != nil {
+		return md, errors.Wrapf(err, "unable to decode config %s", fn)
+	}
+	return md, nil
+}
+
+// Load decodes every config file referred to by paths (see Files) and combines them
+func Load(paths []string) (*types.PermbotConfig, error) {
+	files, err := Files(paths)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no config files specified")
+	}
+	configs := make([]*types.PermbotConfig, len(files))
+	for i, fn := range files {
+		configs[i] = &types.PermbotConfig{}
+		if _, err := DecodeFile(fn, configs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return Combine(files, configs)
+}
+
+// Combine appends the roles and projects of several configs, which were decoded from the
+// corresponding files. Unless duplicates are merged, a role name or project namespace
+// defined more than once is an error naming the files it came from (projects with a
+// namespaceSelector are never duplicates). All files which set
+// duplicates must agree on its value.
+func Combine(files []string, configs []*types.PermbotConfig) (*types.PermbotConfig, error) {
+	out := &types.PermbotConfig{}
+	dupFrom := ""
+	for i, c := range configs {
+		if c.Duplicates == "" {
+			continue
+		}
+		if out.Duplicates != "" && out.Duplicates != c.Duplicates {
+			return nil, errors.Errorf("conflicting duplicates settings %q in %s and %q in %s", out.Duplicates, dupFrom, c.Duplicates, files[i])
+		}
+		out.Duplicates, dupFrom = c.Duplicates, files[i]
+	}
+	merge := out.Duplicates == types.DuplicatesMerge
+	roleFrom := make(map[string]string)
+	nsFrom := make(map[string]string)
+	for i, c := range configs {
+		for _, r := range c.Roles {
+			if prev, dup := roleFrom[r.Name]; dup && !merge {
+				return nil, errors.Errorf("role %q is defined in both %s and %s", r.Name, prev, files[i])
+			}
+			roleFrom[r.Name] = files[i]
+			out.Roles = append(out.Roles, r)
+		}
+		for _, p := range c.Projects {
+			if p.NamespaceSelector != nil {
+				// selector projects have no namespace until resolved, so are never duplicates
+				out.Projects = append(out.Projects, p)
+				continue
+			}
+			if prev, dup := nsFrom[p.Namespace]; dup && !merge {
+				return nil, errors.Errorf("namespace %q is defined in both %s and %s", p.Namespace, prev, files[i])
+			}
+			nsFrom[p.Namespace] = files[i]
+			out.Projects = append(out.Projects, p)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,297 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const teamA = `
+[[role]]
+name = "execute"
+
+[[role.rules]]
+apiGroups = [""]
+resources = ["pods/exec"]
+verbs = ["create"]
+
+[[project]]
+namespace = "team-a"
+
+[[project.roles]]
+role = "execute"
+users = ["alice"]
+`
+
+const teamB = `
+[[project]]
+namespace = "team-b"
+
+[[project.roles]]
+role = "execute"
+users = ["bob"]
+`
+
+const teamBAgain = `
+[[project]]
+namespace = "team-b"
+
+[[project.roles]]
+role = "execute"
+users = ["carol"]
+`
+
+const reviewApps = `
+[[project]]
+namespaceSelector = { glob = "review-*" }
+
+[[project.roles]]
+role = "execute"
+users = ["dave"]
+
+[[project]]
+namespaceSelector = { labels = "env=review" }
+
+[[project.roles]]
+role = "execute"
+users = ["erin"]
+`
+
+const executeIgnore = `
+[[role]]
+name = "execute"
+lintIgnore = ["PB004"]
+
+[[role.rules]]
+apiGroups = [""]
+resources = ["pods/exec"]
+verbs = ["create"]
+`
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "permbot-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		fn := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestFiles(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"b.toml":        teamB,
+		"a.toml":        teamA,
+		"notes.txt":     "not config",
+		"extra/c.toml":  teamBAgain,
+		"extra/d.toml":  teamBAgain,
+		"extra/e.other": "",
+	})
+	defer os.RemoveAll(dir)
+	j := func(names ...string) []string {
+		for i := range names {
+			names[i] = filepath.Join(dir, names[i])
+		}
+		return names
+	}
+	tests := []struct {
+		name    string
+		paths   []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "file", paths: j("b.toml"), want: j("b.toml")},
+		{name: "directory", paths: j(""), want: j("a.toml", "b.toml")},
+		{name: "glob", paths: j("extra/*.toml"), want: j("extra/c.toml", "extra/d.toml")},
+		{name: "listed-once", paths: j("a.toml", "", "extra/c.toml"), want: j("a.toml", "b.toml", "extra/c.toml")},
+		{name: "missing-file", paths: j("missing.toml"), wantErr: true},
+		{name: "glob-no-matches", paths: j("*.yaml"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Files(tt.paths)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Files() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Files() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"ok/a.toml":       teamA,
+		"ok/b.toml":       teamB,
+		"clash/a.toml":    teamA,
+		"clash/b.toml":    teamB,
+		"clash/c.toml":    teamBAgain,
+		"merge/a.toml":    "duplicates = \"merge\"\n" + teamA,
+		"merge/b.toml":    teamB,
+		"merge/c.toml":    teamBAgain,
+		"merge/d.toml":    executeIgnore,
+		"setting/a.toml":  "duplicates = \"merge\"\n" + teamA,
+		"setting/b.toml":  "duplicates = \"error\"\n" + teamB,
+		"selector/a.toml": teamA + reviewApps,
+		"selector/b.toml": reviewApps,
+	})
+	defer os.RemoveAll(dir)
+
+	pc, err := Load([]string{filepath.Join(dir, "ok")})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(pc.Roles) != 1 || len(pc.Projects) != 2 {
+		t.Errorf("Load() = %d roles and %d projects, want 1 and 2", len(pc.Roles), len(pc.Projects))
+	}
+
+	_, err = Load([]string{filepath.Join(dir, "clash")})
+	if err == nil {
+		t.Fatal("Load() of conflicting files succeeded")
+	}
+	for _, want := range []string{`namespace "team-b"`, filepath.Join("clash", "b.toml"), filepath.Join("clash", "c.toml")} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Load() error %q doesn't mention %q", err, want)
+		}
+	}
+
+	pc, err = Load([]string{filepath.Join(dir, "merge")})
+	if err != nil {
+		t.Fatalf("Load() with merge error = %v", err)
+	}
+	merged, err := pc.Merged()
+	if err != nil {
+		t.Fatalf("Merged() error = %v", err)
+	}
+	if len(merged.Projects) != 2 || len(merged.Projects[1].Roles[0].Users) != 2 {
+		t.Errorf("Merged() projects = %+v, want team-b with bob and carol", merged.Projects)
+	}
+	if len(merged.Roles) != 1 || !reflect.DeepEqual(merged.Roles[0].LintIgnore, []string{"PB004"}) {
+		t.Errorf("Merged() roles = %+v, want one execute role ignoring PB004", merged.Roles)
+	}
+
+	if _, err = Load([]string{filepath.Join(dir, "setting")}); err == nil {
+		t.Error("Load() with conflicting duplicates settings succeeded")
+	}
+
+	// Projects with a namespaceSelector have no namespace, so are never duplicates, whether
+	// in the same file or in different ones
+	for _, tt := range []struct {
+		files []string
+		want  int
+	}{
+		{[]string{"a.toml"}, 3},
+		{[]string{"a.toml", "b.toml"}, 5},
+	} {
+		var paths []string
+		for _, fn := range tt.files {
+			paths = append(paths, filepath.Join(dir, "selector", fn))
+		}
+		pc, err := Load(paths)
+		if err != nil {
+			t.Fatalf("Load(%v) of selector projects error = %v", tt.files, err)
+		}
+		if merged, err := pc.Merged(); err != nil || len(merged.Projects) != tt.want {
+			t.Errorf("Load(%v) of selector projects = %+v, %v, want %d projects", tt.files, merged, err, tt.want)
+		}
+	}
+}
+
+func TestMergedExpires(t *testing.T) {
+	project := func(subjects string) string {
+		return `
+[[project]]
+namespace = "team-b"
+
+[[project.roles]]
+role = "execute"
+` + subjects + "\n"
+	}
+	tests := []struct {
+		name    string
+		files   []string
+		want    map[string]time.Time
+		wantErr bool
+	}{
+		{
+			name: "permanent then expiring",
+			files: []string{
+				project(`users = ["bob"]`),
+				project(`users = ["bob", "carol"]
+expires = { bob = 2030-01-01, carol = 2030-01-01 }`),
+			},
+			want: map[string]time.Time{"carol": time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			name: "expiring then permanent",
+			files: []string{
+				project(`users = ["bob"]
+expires = { bob = 2030-01-01 }`),
+				project(`users = ["bob"]`),
+			},
+		},
+		{
+			name: "same expiry",
+			files: []string{
+				project(`users = ["bob"]
+expires = { bob = 2030-01-01 }`),
+				project(`users = ["bob"]
+expires = { bob = 2030-01-01 }`),
+			},
+			want: map[string]time.Time{"bob": time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			name: "conflicting expiry",
+			files: []string{
+				project(`users = ["bob"]
+expires = { bob = 2030-01-01 }`),
+				project(`users = ["bob"]
+expires = { bob = 2030-02-01 }`),
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]string{"a.toml": "duplicates = \"merge\"\n" + teamA}
+			for i, content := range tt.files {
+				files[fmt.Sprintf("b%d.toml", i)] = content
+			}
+			dir := writeFiles(t, files)
+			defer os.RemoveAll(dir)
+			pc, err := Load([]string{dir})
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			merged, err := pc.Merged()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Merged() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got := merged.Projects[1].Roles[0].Expires
+			if len(got) != len(tt.want) {
+				t.Fatalf("Merged() expires = %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if !got[k].Equal(v) {
+					t.Errorf("Merged() expires = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
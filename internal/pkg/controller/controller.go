@@ -0,0 +1,386 @@
+// Package controller runs permbot as a long-lived process, reconciling the cluster on an
+// interval, whenever the config changes on disk, whenever an object owned by permbot is
+// changed by someone else (including break-glass grants being made), whenever a project's
+// namespace is created and whenever a grant expires.
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/config"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/k8s"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+// ReconcileFunc applies a (merged) config to the cluster
+type ReconcileFunc func(pc *types.PermbotConfig) error
+
+// NamespaceFunc applies the parts of a (merged) config for a single namespace
+type NamespaceFunc func(pc *types.PermbotConfig, ns string) error
+
+// Controller reconciles the cluster against the config files in Paths
+type Controller struct {
+	client kubernetes.Interface
+	// Paths are the config files, directories or globs to load, as for config.Load
+	Paths []string
+	// Owner is the owner label value of the objects to watch for manual edits
+	Owner string
+	// Interval is how often to reconcile regardless of any changes
+	Interval time.Duration
+	// ConfigPoll is how often to check the config files for changes
+	ConfigPoll time.Duration
+	// Reconcile is called with the current config for every reconcile
+	Reconcile ReconcileFunc
+	// ReconcileNamespace is called when a namespace belonging to a project is created. If
+	// it is nil, a full reconcile is done instead.
+	ReconcileNamespace NamespaceFunc
+
+	trigger    chan string
+	namespaces chan string
+	// existing holds the UIDs of the namespaces there were when the informer synced, which
+	// the startup reconcile handles. It is nil until then.
+	existing   map[string]k8stypes.UID
+	existingMu sync.Mutex
+	configHash string
+	current    *types.PermbotConfig
+	// expiry fires when the next grant in the current config expires
+	expiry *time.Timer
+}
+
+// New creates a Controller with default intervals
+func New(cl kubernetes.Interface, paths []string, owner string, reconcile ReconcileFunc) *Controller {
+	return &Controller{
+		client:     cl,
+		Paths:      paths,
+		Owner:      owner,
+		Interval:   5 * time.Minute,
+		ConfigPoll: 10 * time.Second,
+		Reconcile:  reconcile,
+		trigger:    make(chan string, 1),
+		namespaces: make(chan string, 100),
+	}
+}
+
+// queue requests a reconcile. Requests made while one is already pending are coalesced,
+// so a burst of events only causes a single reconcile.
+func (c *Controller) queue(reason string) {
+	select {
+	case c.trigger <- reason:
+	default:
+		log.WithField("reason", reason).Debug("reconcile already queued")
+	}
+}
+
+// hashConfig returns a hash of the contents of every config file. Contents are used rather
+// than modification times because a mounted ConfigMap is updated by swapping symlinks.
+func hashConfig(paths []string) (string, error) {
+	files, err := config.Files(paths)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, fn := range files {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return "", errors.Wrap(err, "unable to read config")
+		}
+		h.Write([]byte(fn))
+		h.Write([]byte{0})
+		h.Write(data)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// load reads the config if it has changed since it was last loaded. If it can't be loaded,
+// the last good config is kept so a bad edit doesn't revoke everyone's access.
+func (c *Controller) load() {
+	hash, err := hashConfig(c.Paths)
+	if err != nil {
+		log.WithError(err).Error("unable to read config - keeping previous config")
+		return
+	}
+	if c.current != nil && hash == c.configHash {
+		return
+	}
+	pc, err := config.Load(c.Paths)
+	if err == nil {
+		pc, err = pc.Merged()
+	}
+	if err != nil {
+		log.WithError(err).Error("invalid config - keeping previous config")
+		c.configHash = hash
+		return
+	}
+	log.WithField("hash", hash[:12]).Info("loaded config")
+	c.configHash = hash
+	c.current = pc
+}
+
+// configChanged reports whether the config files differ from the last load attempt
+func (c *Controller) configChanged() bool {
+	hash, err := hashConfig(c.Paths)
+	if err != nil {
+		log.WithError(err).Debug("unable to hash config")
+		return false
+	}
+	return hash != c.configHash
+}
+
+// scheduleExpiry sets the expiry timer for the next grant in the current config or
+// break-glass grant to expire, so that it is revoked on time rather than at the next interval
+func (c *Controller) scheduleExpiry() {
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+	now := time.Now()
+	var at time.Time
+	ok := false
+	if c.current != nil {
+		at, ok = c.current.NextExpiry(now)
+	}
+	grants, err := k8s.ListBreakGlass(c.client, c.Owner)
+	if err != nil {
+		log.WithError(err).Error("unable to find break-glass grants")
+	} else if bg, found := k8s.NextBreakGlassExpiry(grants, now); found && (!ok || bg.Before(at)) {
+		at, ok = bg, true
+	}
+	if !ok {
+		return
+	}
+	log.WithField("at", at).Debug("waiting for next grant to expire")
+	c.expiry = time.NewTimer(time.Until(at))
+}
+
+// expired returns the channel of the expiry timer, which is nil (and so never fires) when
+// nothing is due to expire
+func (c *Controller) expired() <-chan time.Time {
+	if c.expiry == nil {
+		return nil
+	}
+	return c.expiry.C
+}
+
+// reconcile runs a single reconcile with the current config
+func (c *Controller) reconcile(reason string) {
+	c.load()
+	defer c.scheduleExpiry()
+	if c.current == nil {
+		log.WithField("reason", reason).Error("no valid config loaded - not reconciling")
+		return
+	}
+	start := time.Now()
+	logger := log.WithField("reason", reason)
+	logger.Info("reconciling")
+	if err := c.Reconcile(c.current); err != nil {
+		logger.WithError(err).Error("reconcile failed")
+		return
+	}
+	logger.WithField("duration", time.Since(start)).Info("reconciled")
+}
+
+// watchOwned queues a reconcile whenever an object labelled with the owner is added,
+// changed or deleted. Removing the owner label makes the object disappear from the
+// informer, which is seen as a delete.
+func (c *Controller) watchOwned(factory informers.SharedInformerFactory) {
+	handler := func(kind string) cache.ResourceEventHandler {
+		changed := func(event string, obj interface{}) {
+			if tomb, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tomb.Obj
+			}
+			fields := log.Fields{"kind": kind, "event": event}
+			if m, err := metaAccessor(obj); err == nil {
+				if !k8s.IsOwnedBy(m, c.Owner) {
+					// the informers are filtered by the server, but check anyway
+					return
+				}
+				fields["namespace"], fields["name"] = m.GetNamespace(), m.GetName()
+			}
+			log.WithFields(fields).Debug("owned object changed")
+			c.queue(kind + " " + event)
+		}
+		return cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) { changed("added", obj) },
+			UpdateFunc: func(old, obj interface{}) {
+				if o, err := metaAccessor(old); err == nil {
+					if n, err := metaAccessor(obj); err == nil && o.GetResourceVersion() == n.GetResourceVersion() {
+						return
+					}
+				}
+				changed("updated", obj)
+			},
+			DeleteFunc: func(obj interface{}) { changed("deleted", obj) },
+		}
+	}
+	rbac := factory.Rbac().V1()
+	rbac.Roles().Informer().AddEventHandler(handler("Role"))
+	rbac.RoleBindings().Informer().AddEventHandler(handler("RoleBinding"))
+	rbac.ClusterRoles().Informer().AddEventHandler(handler("ClusterRole"))
+	rbac.ClusterRoleBindings().Informer().AddEventHandler(handler("ClusterRoleBinding"))
+}
+
+// watchNamespaces passes the name of every namespace created after the initial sync to the
+// main loop, so the RBAC for its project (if any) can be applied straight away. This covers
+// namespaces created after the config was merged, and namespaces deleted and recreated.
+func (c *Controller) watchNamespaces(factory informers.SharedInformerFactory) {
+	factory.Core().V1().Namespaces().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.namespaceAdded,
+	})
+}
+
+// setExisting records the namespaces there were when the informer synced. Notifications
+// for them can still arrive afterwards, as handlers are called asynchronously.
+func (c *Controller) setExisting(namespaces []*corev1.Namespace) {
+	existing := make(map[string]k8stypes.UID, len(namespaces))
+	for _, ns := range namespaces {
+		existing[ns.Name] = ns.UID
+	}
+	c.existingMu.Lock()
+	c.existing = existing
+	c.existingMu.Unlock()
+}
+
+// namespaceAdded is called by the informer for every namespace added. It must not block,
+// so if the main loop is behind, a full reconcile is queued instead.
+func (c *Controller) namespaceAdded(obj interface{}) {
+	ns, ok := obj.(*corev1.Namespace)
+	if !ok || ns.Status.Phase == corev1.NamespaceTerminating {
+		return
+	}
+	c.existingMu.Lock()
+	existing := c.existing
+	c.existingMu.Unlock()
+	if uid, ok := existing[ns.Name]; existing == nil || ok && uid == ns.UID {
+		// existing namespaces are handled by the startup reconcile, which also covers any
+		// added before the informer synced
+		return
+	}
+	select {
+	case c.namespaces <- ns.Name:
+	default:
+		c.queue("namespace " + ns.Name + " created")
+	}
+}
+
+// reconcileNamespace applies the RBAC for a newly created namespace, if it belongs to a
+// project in the current config, either by name or by a namespaceSelector
+func (c *Controller) reconcileNamespace(ns string) {
+	c.load()
+	if c.current == nil {
+		return
+	}
+	logger := log.WithField("namespace", ns)
+	pc := c.current
+	found := hasProject(pc, ns)
+	if !found && k8s.HasSelectors(pc) {
+		resolved, err := k8s.ResolveClusterSelectors(c.client, pc)
+		if err != nil {
+			logger.WithError(err).Error("unable to resolve namespace selectors")
+			return
+		}
+		pc, found = resolved, hasProject(resolved, ns)
+	}
+	if !found {
+		logger.Debug("namespace created, but not in config")
+		return
+	}
+	if c.ReconcileNamespace == nil {
+		c.queue("namespace " + ns + " created")
+		return
+	}
+	logger.Info("namespace created - applying project")
+	if err := c.ReconcileNamespace(pc, ns); err != nil {
+		logger.WithError(err).Error("unable to apply project to new namespace")
+	}
+}
+
+// hasProject reports whether the config has a project for namespace ns
+func hasProject(pc *types.PermbotConfig, ns string) bool {
+	for i := range pc.Projects {
+		if pc.Projects[i].Namespace == ns && pc.Projects[i].NamespaceSelector == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func metaAccessor(obj interface{}) (metav1.Object, error) {
+	m, ok := obj.(metav1.Object)
+	if !ok {
+		return nil, errors.Errorf("unexpected object %T", obj)
+	}
+	return m, nil
+}
+
+// Run reconciles once at startup, and then whenever the interval elapses, the config
+// changes, an owned object changes or a grant expires, until stop is closed. Projects are
+// also applied as soon as their namespace is created.
+func (c *Controller) Run(stop <-chan struct{}) error {
+	owned := informers.NewSharedInformerFactoryWithOptions(c.client, 0,
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.LabelSelector = k8s.OwnerSelector(c.Owner)
+		}))
+	c.watchOwned(owned)
+	all := informers.NewSharedInformerFactory(c.client, 0)
+	c.watchNamespaces(all)
+	for _, f := range []informers.SharedInformerFactory{owned, all} {
+		f.Start(stop)
+		for typ, ok := range f.WaitForCacheSync(stop) {
+			if !ok {
+				return errors.Errorf("unable to sync informer for %v", typ)
+			}
+		}
+	}
+	namespaces, err := all.Core().V1().Namespaces().Lister().List(labels.Everything())
+	if err != nil {
+		return errors.Wrap(err, "unable to list namespaces")
+	}
+	c.setExisting(namespaces)
+	// The initial list of owned objects queues a reconcile anyway, but make sure of it
+	c.queue("startup")
+
+	interval := time.NewTicker(c.Interval)
+	defer interval.Stop()
+	poll := time.NewTicker(c.ConfigPoll)
+	defer poll.Stop()
+	defer func() {
+		if c.expiry != nil {
+			c.expiry.Stop()
+		}
+	}()
+	for {
+		select {
+		case <-stop:
+			log.Info("controller stopping")
+			return nil
+		case <-interval.C:
+			c.queue("interval")
+		case <-poll.C:
+			if c.configChanged() {
+				c.queue("config changed")
+			}
+		case <-c.expired():
+			c.expiry = nil
+			c.queue("grant expired")
+		case reason := <-c.trigger:
+			c.reconcile(reason)
+		case ns := <-c.namespaces:
+			c.reconcileNamespace(ns)
+		}
+	}
+}
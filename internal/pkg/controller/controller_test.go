@@ -0,0 +1,284 @@
+package controller
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+func namespaceConfig(ns string) string {
+	return `
+[[role]]
+name = "view"
+clusterRole = "view"
+
+[[project]]
+namespace = "` + ns + `"
+
+[[project.roles]]
+role = "view"
+users = ["alice"]
+`
+}
+
+// selectorConfig is a project applied to every namespace named review-*
+const selectorConfig = `
+[[project]]
+namespaceSelector = { glob = "review-*" }
+
+[[project.roles]]
+role = "view"
+users = ["bob"]
+`
+
+// waitFor waits for a reconcile whose config passes check
+func waitFor(t *testing.T, calls <-chan *types.PermbotConfig, what string, check func(pc *types.PermbotConfig) bool) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case pc := <-calls:
+			if check(pc) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for reconcile: %s", what)
+		}
+	}
+}
+
+func TestController(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permbot-controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "perms.toml")
+	if err := ioutil.WriteFile(fn, []byte(namespaceConfig("a")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cl := fake.NewSimpleClientset()
+	calls := make(chan *types.PermbotConfig, 100)
+	ctrl := New(cl, []string{dir}, "permbot", func(pc *types.PermbotConfig) error {
+		calls <- pc
+		return nil
+	})
+	ctrl.Interval = time.Hour
+	ctrl.ConfigPoll = 10 * time.Millisecond
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- ctrl.Run(stop) }()
+	defer func() {
+		close(stop)
+		if err := <-done; err != nil {
+			t.Errorf("Run() error = %v", err)
+		}
+	}()
+	inNamespace := func(ns string) func(pc *types.PermbotConfig) bool {
+		return func(pc *types.PermbotConfig) bool {
+			return len(pc.Projects) == 1 && pc.Projects[0].Namespace == ns
+		}
+	}
+	waitFor(t, calls, "startup", inNamespace("a"))
+
+	// The config changing on disk reconciles with the new config
+	if err := ioutil.WriteFile(fn, []byte(namespaceConfig("b")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, calls, "config change", inNamespace("b"))
+
+	// A broken config keeps the last good config rather than revoking everything
+	if err := ioutil.WriteFile(fn, []byte("[[project]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, calls, "broken config", inNamespace("b"))
+	time.Sleep(50 * time.Millisecond)
+	for len(calls) > 0 {
+		<-calls
+	}
+
+	// Hand edits to owned objects reconcile immediately
+	role := &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{
+		Name:      "permbot-auto-role-view",
+		Namespace: "b",
+		Labels:    map[string]string{"dafni.ac.uk/permbot-owner": "permbot"},
+	}}
+	if _, err := cl.RbacV1().Roles("b").Create(role); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, calls, "owned object added", inNamespace("b"))
+
+	// Objects belonging to another owner are ignored
+	time.Sleep(50 * time.Millisecond)
+	for len(calls) > 0 {
+		<-calls
+	}
+	other := role.DeepCopy()
+	other.Name = "someone-elses"
+	other.Labels["dafni.ac.uk/permbot-owner"] = "other"
+	if _, err := cl.RbacV1().Roles("b").Create(other); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(calls) > 0 {
+		t.Errorf("reconciled after change to object with another owner")
+	}
+}
+
+func TestControllerNamespaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permbot-controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "perms.toml"), []byte(namespaceConfig("late")+selectorConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cl := fake.NewSimpleClientset()
+	applied := make(chan string, 100)
+	started := make(chan *types.PermbotConfig, 100)
+	ctrl := New(cl, []string{dir}, "permbot", func(pc *types.PermbotConfig) error {
+		started <- pc
+		return nil
+	})
+	ctrl.ReconcileNamespace = func(pc *types.PermbotConfig, ns string) error {
+		applied <- ns
+		return nil
+	}
+	ctrl.Interval = time.Hour
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- ctrl.Run(stop) }()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	expect := func(what, want string) {
+		t.Helper()
+		select {
+		case ns := <-applied:
+			if ns != want {
+				t.Errorf("%s: applied namespace %q, want %q", what, ns, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timed out waiting for namespace %q", what, want)
+		}
+	}
+	waitFor(t, started, "startup", func(*types.PermbotConfig) bool { return true })
+
+	// Namespaces not in the config are ignored, the project's namespace is applied as soon
+	// as it's created
+	for _, name := range []string{"unrelated", "late"} {
+		if _, err := cl.CoreV1().Namespaces().Create(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect("created", "late")
+
+	// Namespaces matching a namespaceSelector are applied too
+	if _, err := cl.CoreV1().Namespaces().Create(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "review-1"}}); err != nil {
+		t.Fatal(err)
+	}
+	expect("matched by selector", "review-1")
+
+	// Deleting and recreating the namespace applies it again
+	if err := cl.CoreV1().Namespaces().Delete("late", &metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.CoreV1().Namespaces().Create(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "late"}}); err != nil {
+		t.Fatal(err)
+	}
+	expect("recreated", "late")
+}
+
+func TestControllerExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permbot-controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	expires := time.Now().Add(500 * time.Millisecond).UTC().Format(time.RFC3339Nano)
+	cfg := namespaceConfig("a") + "expires = { alice = " + expires + " }\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "perms.toml"), []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cl := fake.NewSimpleClientset()
+	calls := make(chan *types.PermbotConfig, 100)
+	ctrl := New(cl, []string{dir}, "permbot", func(pc *types.PermbotConfig) error {
+		calls <- pc
+		return nil
+	})
+	ctrl.Interval = time.Hour
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- ctrl.Run(stop) }()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	hasExpiry := func(pc *types.PermbotConfig) bool {
+		return len(pc.Projects) == 1 && len(pc.Projects[0].Roles) == 1 && len(pc.Projects[0].Roles[0].Expires) == 1
+	}
+	waitFor(t, calls, "startup", hasExpiry)
+
+	// The grant expiring reconciles again, without any change to the config
+	waitFor(t, calls, "grant expired", hasExpiry)
+}
+
+func TestNamespaceAdded(t *testing.T) {
+	ctrl := New(fake.NewSimpleClientset(), nil, "permbot", nil)
+	namespace := func(name, uid string) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, UID: k8stypes.UID(uid)}}
+	}
+
+	// Namespaces listed before the informer synced are left to the startup reconcile
+	ctrl.namespaceAdded(namespace("early", "1"))
+	ctrl.setExisting([]*corev1.Namespace{namespace("existing", "2")})
+	ctrl.namespaceAdded(namespace("existing", "2"))
+	if len(ctrl.namespaces) != 0 {
+		t.Fatalf("namespaceAdded() of existing namespaces queued %d", len(ctrl.namespaces))
+	}
+	// but are applied if they're recreated
+	ctrl.namespaceAdded(namespace("existing", "3"))
+	if len(ctrl.namespaces) != 1 {
+		t.Fatalf("namespaceAdded() of recreated namespace queued %d, want 1", len(ctrl.namespaces))
+	}
+
+	// A burst of namespaces which overflows the channel doesn't block the informer, and
+	// falls back to a full reconcile
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < cap(ctrl.namespaces); i++ {
+			ctrl.namespaceAdded(namespace(fmt.Sprintf("burst-%d", i), ""))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("namespaceAdded() blocked with the channel full")
+	}
+	select {
+	case reason := <-ctrl.trigger:
+		if want := "namespace burst-99 created"; reason != want {
+			t.Errorf("namespaceAdded() queued reconcile for %q, want %q", reason, want)
+		}
+	default:
+		t.Error("namespaceAdded() with the channel full didn't queue a reconcile")
+	}
+}
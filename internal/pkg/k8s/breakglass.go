@@ -0,0 +1,171 @@
+package k8s
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+const (
+	breakGlassName = "permbot-breakglass"
+	// breakGlassLabel marks the temporary Roles and RoleBindings created by grant mode. They
+	// also carry the owner label, but are never pruned, only removed once they expire.
+	breakGlassLabel = "dafni.ac.uk/permbot-breakglass"
+	// BreakGlassExpiresAnnotation holds the RFC3339 time at which a break-glass grant expires
+	BreakGlassExpiresAnnotation = "dafni.ac.uk/permbot-breakglass-expires"
+	// BreakGlassReasonAnnotation holds the reason given for a break-glass grant
+	BreakGlassReasonAnnotation = "dafni.ac.uk/permbot-breakglass-reason"
+)
+
+// isBreakGlass reports whether obj was created by grant mode
+func isBreakGlass(obj metav1.Object) bool {
+	return obj.GetLabels()[breakGlassLabel] == "true"
+}
+
+// BreakGlassGrant is a temporary grant of a role to a single user in a namespace, outside
+// of the config
+type BreakGlassGrant struct {
+	// Role is only set for roles which define their own rules, roles referring to an
+	// existing ClusterRole are bound to it directly
+	Role    *rbacv1.Role
+	Binding rbacv1.RoleBinding
+	Expires time.Time
+	Reason  string
+}
+
+// Refs returns the objects making up the grant, in the order they should be deleted
+func (g *BreakGlassGrant) Refs() []ObjectRef {
+	refs := []ObjectRef{{Kind: "RoleBinding", Namespace: g.Binding.Namespace, Name: g.Binding.Name}}
+	if g.Role != nil {
+		refs = append(refs, ObjectRef{Kind: "Role", Namespace: g.Role.Namespace, Name: g.Role.Name})
+	}
+	return refs
+}
+
+// Expired reports whether the grant has expired by now. A grant without a valid expiry
+// is treated as expired.
+func (g *BreakGlassGrant) Expired(now time.Time) bool {
+	return g.Expires.IsZero() || !now.Before(g.Expires)
+}
+
+// CreateBreakGlass defines a grant of the config role named role to user in namespace,
+// which expires at expires. The role must be defined in the config, but doesn't need to
+// be used by the namespace's project.
+func CreateBreakGlass(pc *types.PermbotConfig, role, user, namespace, reason, owner string, expires time.Time) (*BreakGlassGrant, error) {
+	var rl *types.Role
+	for i := range pc.Roles {
+		if pc.Roles[i].Name == role {
+			rl = &pc.Roles[i]
+		}
+	}
+	if rl == nil {
+		return nil, errors.Errorf("role %q isn't defined in the config", role)
+	}
+	// Names have to be valid DNS subdomains, which user names often aren't, so identify the
+	// grant by a hash instead
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d", user, namespace, expires.UnixNano())))
+	name := fmt.Sprintf("%s-%s-%s", breakGlassName, role, hex.EncodeToString(h[:])[:8])
+	meta := func() metav1.ObjectMeta {
+		labels := objectLabels(owner)
+		labels[breakGlassLabel] = "true"
+		annotations := objectAnnotations("")
+		annotations[BreakGlassExpiresAnnotation] = expires.UTC().Format(time.RFC3339)
+		if reason != "" {
+			annotations[BreakGlassReasonAnnotation] = reason
+		}
+		return metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: labels, Annotations: annotations}
+	}
+	g := &BreakGlassGrant{Expires: expires, Reason: reason}
+	roleRef := rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: rl.ClusterRole}
+	if rl.ClusterRole == "" {
+		// Template variables are expanded for the namespace's project, if it has one
+		project := &types.Project{Namespace: namespace}
+		for i := range pc.Projects {
+			if pc.Projects[i].Namespace == namespace {
+				project = &pc.Projects[i]
+			}
+		}
+		expanded := *rl
+		var err error
+		if expanded.Rules, err = project.ExpandRules(rl.Rules); err != nil {
+			return nil, errors.Wrapf(err, "role %q", role)
+		}
+		g.Role = &rbacv1.Role{
+			TypeMeta:   metav1.TypeMeta{Kind: "Role", APIVersion: "rbac.authorization.k8s.io"},
+			ObjectMeta: meta(),
+			Rules:      policyRules(&expanded, true),
+		}
+		roleRef.Kind, roleRef.Name = "Role", name
+	}
+	g.Binding = rbacv1.RoleBinding{
+		TypeMeta:   metav1.TypeMeta{Kind: "RoleBinding", APIVersion: "rbac.authorization.k8s.io"},
+		ObjectMeta: meta(),
+		RoleRef:    roleRef,
+		Subjects:   []rbacv1.Subject{{APIGroup: rbacv1.GroupName, Kind: "User", Name: user}},
+	}
+	return g, nil
+}
+
+// ApplyBreakGlass creates the objects making up a break-glass grant
+func ApplyBreakGlass(cl kubernetes.Interface, g *BreakGlassGrant) error {
+	rbc := cl.RbacV1()
+	if g.Role != nil {
+		if _, err := rbc.Roles(g.Role.Namespace).Create(g.Role); err != nil {
+			return errors.Wrap(err, "unable to create break-glass role")
+		}
+	}
+	if _, err := rbc.RoleBindings(g.Binding.Namespace).Create(&g.Binding); err != nil {
+		return errors.Wrap(err, "unable to create break-glass rolebinding")
+	}
+	return nil
+}
+
+// ListBreakGlass finds every break-glass grant made for owner, sorted by expiry
+func ListBreakGlass(cl kubernetes.Interface, owner string) ([]BreakGlassGrant, error) {
+	lo := metav1.ListOptions{LabelSelector: fmt.Sprintf("%s,%s=true", OwnerSelector(owner), breakGlassLabel)}
+	rbc := cl.RbacV1()
+	rbl, err := rbc.RoleBindings(metav1.NamespaceAll).List(lo)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list break-glass rolebindings")
+	}
+	rl, err := rbc.Roles(metav1.NamespaceAll).List(lo)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list break-glass roles")
+	}
+	roles := make(map[ObjectRef]*rbacv1.Role, len(rl.Items))
+	for i := range rl.Items {
+		roles[ObjectRef{Kind: "Role", Namespace: rl.Items[i].Namespace, Name: rl.Items[i].Name}] = &rl.Items[i]
+	}
+	grants := make([]BreakGlassGrant, 0, len(rbl.Items))
+	for _, b := range rbl.Items {
+		g := BreakGlassGrant{Binding: b, Reason: b.Annotations[BreakGlassReasonAnnotation]}
+		// An unparseable expiry leaves Expires zero, so the grant is removed
+		g.Expires, _ = time.Parse(time.RFC3339, b.Annotations[BreakGlassExpiresAnnotation])
+		if b.RoleRef.Kind == "Role" {
+			g.Role = roles[ObjectRef{Kind: "Role", Namespace: b.Namespace, Name: b.RoleRef.Name}]
+		}
+		grants = append(grants, g)
+	}
+	sort.SliceStable(grants, func(i, j int) bool { return grants[i].Expires.Before(grants[j].Expires) })
+	return grants, nil
+}
+
+// NextBreakGlassExpiry returns the earliest time after now at which a break-glass grant
+// expires, and false if there are none
+func NextBreakGlassExpiry(grants []BreakGlassGrant, now time.Time) (time.Time, bool) {
+	for _, g := range grants {
+		if !g.Expired(now) {
+			return g.Expires, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,69 @@
+package k8s
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+func TestBreakGlass(t *testing.T) {
+	pc := &types.PermbotConfig{
+		Roles: []types.Role{
+			{Name: "execute", Rules: []types.Rule{{APIGroups: []string{""}, Resources: []string{"pods/exec"}, Verbs: []string{"create"}}}},
+			{Name: "edit", ClusterRole: "edit"},
+		},
+	}
+	now := time.Now()
+	if _, err := CreateBreakGlass(pc, "missing", "alice", "prod", "INC-1", "permbot", now.Add(time.Hour)); err == nil {
+		t.Errorf("CreateBreakGlass() with undefined role, want error")
+	}
+	exec, err := CreateBreakGlass(pc, "execute", "DC=blah,CN=alice", "prod", "INC-1", "permbot", now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("CreateBreakGlass() error = %v", err)
+	}
+	if exec.Role == nil || exec.Binding.RoleRef.Kind != "Role" || exec.Binding.RoleRef.Name != exec.Role.Name {
+		t.Errorf("CreateBreakGlass() binding %+v doesn't refer to its own role", exec.Binding.RoleRef)
+	}
+	edit, err := CreateBreakGlass(pc, "edit", "bob", "prod", "INC-2", "permbot", now.Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("CreateBreakGlass() error = %v", err)
+	}
+	if edit.Role != nil || edit.Binding.RoleRef.Kind != "ClusterRole" || edit.Binding.RoleRef.Name != "edit" {
+		t.Errorf("CreateBreakGlass() for clusterRole = role %v, roleRef %+v, want binding to ClusterRole edit", edit.Role, edit.Binding.RoleRef)
+	}
+
+	cl := fake.NewSimpleClientset()
+	for _, g := range []*BreakGlassGrant{exec, edit} {
+		if err := ApplyBreakGlass(cl, g); err != nil {
+			t.Fatalf("ApplyBreakGlass() error = %v", err)
+		}
+	}
+	grants, err := ListBreakGlass(cl, "permbot")
+	if err != nil {
+		t.Fatalf("ListBreakGlass() error = %v", err)
+	}
+	if len(grants) != 2 || grants[0].Binding.Name != edit.Binding.Name || grants[1].Role == nil {
+		t.Fatalf("ListBreakGlass() = %+v, want edit then execute with its role", grants)
+	}
+	if !grants[0].Expired(now) || grants[1].Expired(now) || grants[0].Reason != "INC-2" {
+		t.Errorf("ListBreakGlass() expiry/reason = %v %v %q, want expired edit and unexpired execute", grants[0].Expires, grants[1].Expires, grants[0].Reason)
+	}
+	if next, ok := NextBreakGlassExpiry(grants, now); !ok || next.Unix() != exec.Expires.Unix() {
+		t.Errorf("NextBreakGlassExpiry() = %v, %v, want %v", next, ok, exec.Expires)
+	}
+	if refs := grants[1].Refs(); len(refs) != 2 || refs[0].Kind != "RoleBinding" || refs[1].Kind != "Role" {
+		t.Errorf("Refs() = %v, want binding then role", refs)
+	}
+
+	// Break-glass grants aren't in the config, but mustn't be pruned
+	orphans, err := FindOrphans(cl, &DesiredState{}, PruneOptions{Owner: "permbot"})
+	if err != nil {
+		t.Fatalf("FindOrphans() error = %v", err)
+	}
+	if len(orphans) != 0 {
+		t.Errorf("FindOrphans() = %v, want break-glass grants left alone", orphans)
+	}
+}
@@ -4,8 +4,11 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
@@ -16,8 +19,23 @@ import (
 const (
 	roleName  = "permbot-auto-role"
 	ownerName = "permbot"
+	// ownerLabel is the label used to mark objects as managed by a particular permbot owner
+	ownerLabel = "dafni.ac.uk/permbot-owner"
 )
 
+// ConfigRoleName returns the name of the config role a RoleBinding or ClusterRoleBinding
+// was created for, or "" if it doesn't have a name permbot would give it
+func ConfigRoleName(binding ObjectRef) string {
+	prefix := roleName + "-binding-"
+	if binding.Kind == "ClusterRoleBinding" {
+		prefix = roleName + "-global-binding-"
+	}
+	if !strings.HasPrefix(binding.Name, prefix) {
+		return ""
+	}
+	return strings.TrimPrefix(binding.Name, prefix)
+}
+
 // objectAnnotations returns the default annotations to be added to all created objects,
 // which contain the version of permbot used to create them.
 //
@@ -36,40 +54,99 @@ func objectAnnotations(rulesRef string) map[string]string {
 // objectLabels returns the default labels to be added to all created objects.
 func objectLabels(ownerName string) map[string]string {
 	return map[string]string{
-		"dafni.ac.uk/permbot-owner": ownerName,
+		ownerLabel: ownerName,
+	}
+}
+
+// policyRules converts the rules of a role into PolicyRules. Kubernetes rejects namespaced
+// Roles containing nonResourceURLs, so for those any rule with nonResourceURLs is skipped.
+func policyRules(r *types.Role, namespaced bool) []rbacv1.PolicyRule {
+	rules := make([]rbacv1.PolicyRule, 0, len(r.Rules))
+	for i := range r.Rules {
+		rule := r.Rules[i]
+		if namespaced && len(rule.NonResourceURLs) > 0 {
+			log.WithFields(log.Fields{
+				"role":            r.Name,
+				"nonResourceURLs": rule.NonResourceURLs,
+			}).Warn("skipping rule with nonResourceURLs in namespaced role")
+			continue
+		}
+		rules = append(rules, rbacv1.PolicyRule{
+			APIGroups:       rule.APIGroups,
+			Verbs:           rule.Verbs,
+			Resources:       rule.Resources,
+			ResourceNames:   rule.ResourceNames,
+			NonResourceURLs: rule.NonResourceURLs,
+		})
 	}
+	return rules
+}
+
+// createClusterRole defines the ClusterRole for a role with global subjects
+func createClusterRole(cr *types.Role, rulesRef, owner string) rbacv1.ClusterRole {
+	crole := rbacv1.ClusterRole{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "ClusterRole",
+			APIVersion: "rbac.authorization.k8s.io",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        fmt.Sprintf("%s-global-%s", roleName, cr.Name),
+			Labels:      objectLabels(owner),
+			Annotations: objectAnnotations(rulesRef),
+		},
+		Rules: policyRules(cr, false),
+	}
+	return crole
+}
+
+// globalTemplates returns an error if a role with global subjects uses template variables
+func globalTemplates(r *types.Role) error {
+	for i := range r.Rules {
+		if t := r.Rules[i].Templates(); len(t) > 0 {
+			return errors.Errorf("role %q has global subjects, so can't use template variables such as %q", r.Name, t[0])
+		}
+	}
+	for _, list := range [][]string{r.GlobalUsers, r.GlobalGroups, r.GlobalServiceAccounts} {
+		for _, s := range list {
+			if types.IsTemplate(s) {
+				return errors.Errorf("role %q can't use template variables in global subject %q", r.Name, s)
+			}
+		}
+	}
+	return nil
 }
 
 // CreateGlobalResources returns the global ClusterRole and ClusterRoleBindings defined by the configuration
-func CreateGlobalResources(fromconfig *types.PermbotConfig, rulesRef, owner string) (roles []rbacv1.ClusterRole, rolebindings []rbacv1.ClusterRoleBinding, err error) {
+func CreateGlobalResources(fromconfig *types.PermbotConfig, rulesRef, owner string) ([]rbacv1.ClusterRole, []rbacv1.ClusterRoleBinding, error) {
+	// Combine (or reject) duplicate roles, so that each ClusterRole is only defined once
+	merged, err := fromconfig.Merged()
+	if err != nil {
+		return nil, nil, err
+	}
+	return createGlobalResources(merged, rulesRef, owner)
+}
+
+// createGlobalResources is CreateGlobalResources for a config which has already been merged
+func createGlobalResources(fromconfig *types.PermbotConfig, rulesRef, owner string) (roles []rbacv1.ClusterRole, rolebindings []rbacv1.ClusterRoleBinding, err error) {
 	for i := range fromconfig.Roles {
 		cr := fromconfig.Roles[i]
-		subjectCount := len(cr.GlobalUsers) + len(cr.GlobalServiceAccounts)
+		subjectCount := len(cr.GlobalUsers) + len(cr.GlobalGroups) + len(cr.GlobalServiceAccounts)
 		if subjectCount > 0 {
-			// At least one GlobalUsers/GlobalServiceAccounts is listed, so we need to define this as a
+			// At least one GlobalUsers/GlobalGroups/GlobalServiceAccounts is listed, so we need to define this as a
 			// ClusterRole+ClusterRoleBinding.
 			log.WithField("role_name", cr.Name).Debugf("defining as clusterrole+clusterrolebinding due to %d global subjects", subjectCount)
-			crole := rbacv1.ClusterRole{
-				TypeMeta: metav1.TypeMeta{
-					Kind:       "ClusterRole",
-					APIVersion: "rbac.authorization.k8s.io",
-				},
-				ObjectMeta: metav1.ObjectMeta{
-					Name:        fmt.Sprintf("%s-global-%s", roleName, cr.Name),
-					Labels:      objectLabels(owner),
-					Annotations: objectAnnotations(rulesRef),
-				},
-				Rules: make([]rbacv1.PolicyRule, len(cr.Rules)),
+			// There is no project to expand template variables for in cluster-wide objects
+			if err = globalTemplates(&cr); err != nil {
+				return nil, nil, err
 			}
-			for crr := range cr.Rules {
-				rule := cr.Rules[crr]
-				crole.Rules[crr] = rbacv1.PolicyRule{
-					APIGroups: rule.APIGroups,
-					Verbs:     rule.Verbs,
-					Resources: rule.Resources,
-				}
+			// Roles referencing an existing ClusterRole are bound to it directly, without
+			// defining a ClusterRole of our own
+			roleRefName := cr.ClusterRole
+			if roleRefName == "" {
+				crole := createClusterRole(&cr, rulesRef, owner)
+				roles = append(roles, crole)
+				roleRefName = crole.Name
 			}
-			roles = append(roles, crole)
 			// Next the CRB
 			crb := rbacv1.ClusterRoleBinding{
 				TypeMeta: metav1.TypeMeta{
@@ -84,7 +161,7 @@ func CreateGlobalResources(fromconfig *types.PermbotConfig, rulesRef, owner stri
 				RoleRef: rbacv1.RoleRef{
 					APIGroup: "rbac.authorization.k8s.io",
 					Kind:     "ClusterRole",
-					Name:     crole.Name,
+					Name:     roleRefName,
 				},
 				Subjects: make([]rbacv1.Subject, subjectCount),
 			}
@@ -100,6 +177,15 @@ func CreateGlobalResources(fromconfig *types.PermbotConfig, rulesRef, owner stri
 				}
 				i++
 			}
+			// Then the global groups
+			for crg := range cr.GlobalGroups {
+				crb.Subjects[i] = rbacv1.Subject{
+					APIGroup: "rbac.authorization.k8s.io",
+					Kind:     "Group",
+					Name:     cr.GlobalGroups[crg],
+				}
+				i++
+			}
 			// Then add the global service accounts, these have to be prefixed with the namespace
 			for crsa := range cr.GlobalServiceAccounts {
 				nsnparts := strings.SplitN(cr.GlobalServiceAccounts[crsa], ":", 2)
@@ -133,12 +219,24 @@ func CreateGlobalResources(fromconfig *types.PermbotConfig, rulesRef, owner stri
 }
 
 // CreateResourcesForNamespace creates a set of Roles and a set of RoleBindings for the
-// specified namespace, based on the
-func CreateResourcesForNamespace(fromconfig *types.PermbotConfig, ns, rulesRef, ownerName string) (roles []rbacv1.Role, rolebindings []rbacv1.RoleBinding, err error) {
+// specified namespace, based on the project for it in the configuration
+func CreateResourcesForNamespace(fromconfig *types.PermbotConfig, ns, rulesRef, ownerName string) ([]rbacv1.Role, []rbacv1.RoleBinding, error) {
+	// Combine (or reject) duplicate roles/projects, so that each Role and RoleBinding is
+	// only defined once
+	merged, err := fromconfig.Merged()
+	if err != nil {
+		return nil, nil, err
+	}
+	return createResourcesForNamespace(merged, ns, rulesRef, ownerName)
+}
+
+// createResourcesForNamespace is CreateResourcesForNamespace for a config which has already
+// been merged
+func createResourcesForNamespace(fromconfig *types.PermbotConfig, ns, rulesRef, ownerName string) (roles []rbacv1.Role, rolebindings []rbacv1.RoleBinding, err error) {
 	var project *types.Project
 	// First we need to find the applicable project
 	for i := range fromconfig.Projects {
-		if fromconfig.Projects[i].Namespace == ns {
+		if fromconfig.Projects[i].Namespace == ns && fromconfig.Projects[i].NamespaceSelector == nil {
 			log.WithField("project", fromconfig.Projects[i].Namespace).Debug("selected single project via ns")
 			project = &fromconfig.Projects[i]
 		} else {
@@ -153,6 +251,8 @@ func CreateResourcesForNamespace(fromconfig *types.PermbotConfig, ns, rulesRef,
 		err = os.ErrNotExist
 		return
 	}
+	// Grants which expire are left out from this point on
+	now := time.Now()
 	// Next we need to decide what roles are required, this depends on how/if any
 	// roleusers define users of roles in the specified namespace
 	for ri := range fromconfig.Roles {
@@ -176,7 +276,7 @@ func CreateResourcesForNamespace(fromconfig *types.PermbotConfig, ns, rulesRef,
 					// Skip to the next project role users, because this one doesn't match
 					continue
 				}
-				if fromconfig.Projects[pr].Namespace != project.Namespace {
+				if &fromconfig.Projects[pr] != project {
 					log.WithFields(log.Fields{
 						"project":   fromconfig.Projects[pr].Namespace,
 						"desiredNs": project.Namespace,
@@ -195,29 +295,49 @@ func CreateResourcesForNamespace(fromconfig *types.PermbotConfig, ns, rulesRef,
 				// 	continue
 				// }
 
-				// The project defines this role so we define the resource for the namespace
-				role := rbacv1.Role{
-					TypeMeta: metav1.TypeMeta{
-						Kind:       "Role",
-						APIVersion: "rbac.authorization.k8s.io",
-					},
-					ObjectMeta: metav1.ObjectMeta{
-						Name:        fmt.Sprintf("%s-%s", roleName, rl.Name),
-						Namespace:   fromconfig.Projects[pr].Namespace,
-						Labels:      objectLabels(ownerName),
-						Annotations: objectAnnotations(rulesRef),
-					},
-					Rules: make([]rbacv1.PolicyRule, len(rl.Rules)),
+				// The project defines this role so we define the resource for the namespace,
+				// unless the role refers to an existing ClusterRole in which case the
+				// rolebinding points straight at that
+				roleRef := rbacv1.RoleRef{
+					APIGroup: "rbac.authorization.k8s.io",
+					Kind:     "ClusterRole",
+					Name:     rl.ClusterRole,
 				}
-				for rrule := range rl.Rules {
-					role.Rules[rrule] = rbacv1.PolicyRule{
-						Verbs:     rl.Rules[rrule].Verbs,
-						APIGroups: rl.Rules[rrule].APIGroups,
-						Resources: rl.Rules[rrule].Resources,
+				if rl.ClusterRole == "" {
+					// Rules can use the project's template variables
+					expanded := rl
+					if expanded.Rules, err = project.ExpandRules(rl.Rules); err != nil {
+						return nil, nil, errors.Wrapf(err, "role %q in project %q", rl.Name, project.Namespace)
+					}
+					role := rbacv1.Role{
+						TypeMeta: metav1.TypeMeta{
+							Kind:       "Role",
+							APIVersion: "rbac.authorization.k8s.io",
+						},
+						ObjectMeta: metav1.ObjectMeta{
+							Name:        fmt.Sprintf("%s-%s", roleName, rl.Name),
+							Namespace:   fromconfig.Projects[pr].Namespace,
+							Labels:      objectLabels(ownerName),
+							Annotations: objectAnnotations(rulesRef),
+						},
+						Rules: policyRules(&expanded, true),
+					}
+					roles = append(roles, role)
+					roleRef.Kind = "Role"
+					roleRef.Name = role.Name
+				}
+				// Next, the rolebinding, leaving out any subjects whose grant has expired
+				ru := &fromconfig.Projects[pr].Roles[prr]
+				// and expanding any template variables in their names
+				var users, groups, serviceAccounts []string
+				for _, f := range []struct {
+					names []string
+					into  *[]string
+				}{{ru.Users, &users}, {ru.Groups, &groups}, {ru.ServiceAccounts, &serviceAccounts}} {
+					if *f.into, err = project.ExpandAll(ru.Active(f.names, now)); err != nil {
+						return nil, nil, errors.Wrapf(err, "role %q in project %q", rl.Name, project.Namespace)
 					}
 				}
-				roles = append(roles, role)
-				// Next, the rolebinding
 				rolebinding := rbacv1.RoleBinding{
 					TypeMeta: metav1.TypeMeta{
 						Kind:       "RoleBinding",
@@ -229,37 +349,17 @@ func CreateResourcesForNamespace(fromconfig *types.PermbotConfig, ns, rulesRef,
 						Labels:      objectLabels(ownerName),
 						Annotations: objectAnnotations(rulesRef),
 					},
-					RoleRef: rbacv1.RoleRef{
-						APIGroup: "rbac.authorization.k8s.io",
-						Kind:     "Role",
-						Name:     role.Name,
-					},
-					Subjects: make([]rbacv1.Subject, len(fromconfig.Projects[pr].Roles[prr].Users)+len(fromconfig.Projects[pr].Roles[prr].ServiceAccounts)),
+					RoleRef:  roleRef,
+					Subjects: make([]rbacv1.Subject, 0, len(users)+len(groups)+len(serviceAccounts)),
 				}
 				// NOTE: if the config previously had rolebinding users for this project, but
 				// now doesn't (but is still in the file), they will be removed
-				for rru := range fromconfig.Projects[pr].Roles[prr].Users {
-					rolebinding.Subjects[rru] = rbacv1.Subject{
-						APIGroup: "rbac.authorization.k8s.io",
-						Kind:     "User",
-						Name:     fromconfig.Projects[pr].Roles[prr].Users[rru],
-					}
-				}
-				// Need to offset the set-index by this count to not whallop Users
-				cusers := len(fromconfig.Projects[pr].Roles[prr].Users)
-				for rrsa := range fromconfig.Projects[pr].Roles[prr].ServiceAccounts {
-					saname := fromconfig.Projects[pr].Roles[prr].ServiceAccounts[rrsa]
-					sans := fromconfig.Projects[pr].Namespace
-					if strings.Contains(saname, ":") {
-						ps := strings.SplitN(saname, ":", 2)
-						sans = ps[0]
-						saname = ps[1]
-					}
-					rolebinding.Subjects[cusers+rrsa] = rbacv1.Subject{
-						APIGroup:  "",
-						Kind:      "ServiceAccount",
-						Name:      saname,
-						Namespace: sans,
+				for _, f := range []struct {
+					kind  string
+					names []string
+				}{{"User", users}, {"Group", groups}, {"ServiceAccount", serviceAccounts}} {
+					for _, n := range f.names {
+						rolebinding.Subjects = append(rolebinding.Subjects, ProjectSubject(f.kind, n, fromconfig.Projects[pr].Namespace))
 					}
 				}
 				rolebindings = append(rolebindings, rolebinding)
@@ -268,3 +368,61 @@ func CreateResourcesForNamespace(fromconfig *types.PermbotConfig, ns, rulesRef,
 	}
 	return
 }
+
+// ProjectSubject returns the RoleBinding subject for a user, group or service account name
+// (with any template variables already expanded) of a project in namespace ns. Service
+// accounts are given as namespace:name, or just name for one in the project's namespace.
+func ProjectSubject(kind, name, ns string) rbacv1.Subject {
+	if kind != "ServiceAccount" {
+		return rbacv1.Subject{APIGroup: "rbac.authorization.k8s.io", Kind: kind, Name: name}
+	}
+	if strings.Contains(name, ":") {
+		ps := strings.SplitN(name, ":", 2)
+		ns, name = ps[0], ps[1]
+	}
+	return rbacv1.Subject{Kind: "ServiceAccount", Name: name, Namespace: ns}
+}
+
+// CreateNamespace returns the Namespace for a project, carrying the project's labels and
+// annotations as well as the usual owner label and permbot annotations
+func CreateNamespace(p *types.Project, rulesRef, owner string) corev1.Namespace {
+	labels := make(map[string]string, len(p.Labels)+1)
+	for k, v := range p.Labels {
+		labels[k] = v
+	}
+	for k, v := range objectLabels(owner) {
+		labels[k] = v
+	}
+	annotations := make(map[string]string, len(p.Annotations)+2)
+	for k, v := range p.Annotations {
+		annotations[k] = v
+	}
+	for k, v := range objectAnnotations(rulesRef) {
+		annotations[k] = v
+	}
+	return corev1.Namespace{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Namespace",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        p.Namespace,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+	}
+}
+
+// projectMeta returns the metadata of a namespace with only the project's own labels and
+// annotations, which is what permbot sets on namespaces it didn't create. Existing
+// namespaces never get the owner label, so they can never be pruned.
+func projectMeta(desired *metav1.ObjectMeta) *metav1.ObjectMeta {
+	m := desired.DeepCopy()
+	for k := range objectLabels("") {
+		delete(m.Labels, k)
+	}
+	for k := range objectAnnotations("-") {
+		delete(m.Annotations, k)
+	}
+	return m
+}
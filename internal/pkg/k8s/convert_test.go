@@ -3,8 +3,11 @@ package k8s
 import (
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/BurntSushi/toml"
 	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
 	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -194,6 +197,73 @@ func TestCreateGlobalResources(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "global-users-groups-and-service-accounts",
+			args: args{
+				fromconfig: &types.PermbotConfig{
+					Roles: []types.Role{
+						{
+							Name:                  "foo",
+							GlobalUsers:           []string{"CN=x,DC=example,DC=com"},
+							GlobalGroups:          []string{"oidc:admins"},
+							GlobalServiceAccounts: []string{"x:foo"},
+						},
+					},
+				},
+				owner:    "xyzzy",
+				rulesRef: "xxx",
+			},
+			wantRoles: []rbacv1.ClusterRole{
+				{
+					TypeMeta: metav1.TypeMeta{
+						Kind:       "ClusterRole",
+						APIVersion: "rbac.authorization.k8s.io",
+					},
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        fmt.Sprintf("%s-global-%s", roleName, "foo"),
+						Labels:      objectLabels("xyzzy"),
+						Annotations: objectAnnotations("xxx"),
+					},
+					Rules: make([]rbacv1.PolicyRule, 0),
+				},
+			},
+			wantRolebindings: []rbacv1.ClusterRoleBinding{
+				{
+					TypeMeta: metav1.TypeMeta{
+						Kind:       "ClusterRoleBinding",
+						APIVersion: "rbac.authorization.k8s.io",
+					},
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        fmt.Sprintf("%s-auto-role-global-binding-%s", "permbot", "foo"),
+						Labels:      objectLabels("xyzzy"),
+						Annotations: objectAnnotations("xxx"),
+					},
+					RoleRef: rbacv1.RoleRef{
+						APIGroup: "rbac.authorization.k8s.io",
+						Kind:     "ClusterRole",
+						Name:     "permbot-auto-role-global-foo",
+					},
+					Subjects: []rbacv1.Subject{
+						{
+							APIGroup: "rbac.authorization.k8s.io",
+							Kind:     "User",
+							Name:     "CN=x,DC=example,DC=com",
+						},
+						{
+							APIGroup: "rbac.authorization.k8s.io",
+							Kind:     "Group",
+							Name:     "oidc:admins",
+						},
+						{
+							APIGroup:  "",
+							Kind:      "ServiceAccount",
+							Name:      "foo",
+							Namespace: "x",
+						},
+					},
+				},
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -211,3 +281,298 @@ func TestCreateGlobalResources(t *testing.T) {
 		})
 	}
 }
+
+func TestExampleConfig(t *testing.T) {
+	var pc types.PermbotConfig
+	if _, err := toml.DecodeFile("../../../example.toml", &pc); err != nil {
+		t.Fatalf("unable to decode example config: %v", err)
+	}
+	roles, rolebindings, err := CreateResourcesForNamespace(&pc, "default", "", "permbot")
+	if err != nil {
+		t.Fatalf("CreateResourcesForNamespace() error = %v", err)
+	}
+	if len(roles) != 1 || len(rolebindings) != 1 {
+		t.Fatalf("CreateResourcesForNamespace() got %d roles and %d rolebindings, want 1 of each", len(roles), len(rolebindings))
+	}
+	// The two "default" projects are merged, with the repeated users only listed once
+	wantSubjects := []rbacv1.Subject{
+		{APIGroup: "rbac.authorization.k8s.io", Kind: "User", Name: "DC=blah,DC=com,CN=toby lerone"},
+		{APIGroup: "rbac.authorization.k8s.io", Kind: "User", Name: "DC=blah,DC=com,CN=proxy rodriguez"},
+		{APIGroup: "rbac.authorization.k8s.io", Kind: "User", Name: "DC=blah,DC=com,CN=tokyo sexwhale"},
+		{Kind: "ServiceAccount", Name: "someserviceaccount", Namespace: "default"},
+		{Kind: "ServiceAccount", Name: "someserviceaccount", Namespace: "otherns"},
+	}
+	if !reflect.DeepEqual(rolebindings[0].Subjects, wantSubjects) {
+		t.Errorf("rolebinding subjects = %v, want %v", rolebindings[0].Subjects, wantSubjects)
+	}
+
+	croles, crolebindings, err := CreateGlobalResources(&pc, "", "permbot")
+	if err != nil {
+		t.Fatalf("CreateGlobalResources() error = %v", err)
+	}
+	if len(croles) != 1 || len(crolebindings) != 1 {
+		t.Fatalf("CreateGlobalResources() got %d clusterroles and %d clusterrolebindings, want 1 of each", len(croles), len(crolebindings))
+	}
+	// Both "view" roles are merged, so the rules and global subjects of each are combined
+	if len(croles[0].Rules) != 10 {
+		t.Errorf("clusterrole has %d rules, want 10", len(croles[0].Rules))
+	}
+	wantGlobalSubjects := []rbacv1.Subject{
+		{APIGroup: "rbac.authorization.k8s.io", Kind: "User", Name: "DC=blah,DC=com,CN=barry fudge"},
+		{Kind: "ServiceAccount", Name: "some-service-account", Namespace: "some-namspace"},
+	}
+	if !reflect.DeepEqual(crolebindings[0].Subjects, wantGlobalSubjects) {
+		t.Errorf("clusterrolebinding subjects = %v, want %v", crolebindings[0].Subjects, wantGlobalSubjects)
+	}
+
+	// debug extends both merged "view" roles and "execute", as well as its own rule
+	roles, _, err = CreateResourcesForNamespace(&pc, "xyzzy", "", "permbot")
+	if err != nil {
+		t.Fatalf("CreateResourcesForNamespace() error = %v", err)
+	}
+	debugRules := -1
+	for _, r := range roles {
+		if r.Name == "permbot-auto-role-debug" {
+			debugRules = len(r.Rules)
+		}
+	}
+	if debugRules != 12 {
+		t.Errorf("debug role has %d rules, want 12", debugRules)
+	}
+
+	// Without merging, the duplicates are an error
+	pc.Duplicates = types.DuplicatesError
+	if _, _, err := CreateResourcesForNamespace(&pc, "default", "", "permbot"); err == nil {
+		t.Error("CreateResourcesForNamespace() with duplicate namespaces didn't return an error")
+	}
+	if _, _, err := CreateGlobalResources(&pc, "", "permbot"); err == nil {
+		t.Error("CreateGlobalResources() with duplicate roles didn't return an error")
+	}
+}
+
+func TestCreateResourcesForNamespaceClusterRole(t *testing.T) {
+	pc := &types.PermbotConfig{
+		Projects: []types.Project{
+			{Namespace: "a", Roles: []types.RoleUsers{{Role: "edit", Users: []string{"alice"}}}},
+		},
+		Roles: []types.Role{
+			{Name: "edit", ClusterRole: "edit", GlobalUsers: []string{"bob"}},
+		},
+	}
+	roles, rolebindings, err := CreateResourcesForNamespace(pc, "a", "", "permbot")
+	if err != nil {
+		t.Fatalf("CreateResourcesForNamespace() error = %v", err)
+	}
+	if len(roles) != 0 {
+		t.Errorf("CreateResourcesForNamespace() gotRoles = %v, want none", roles)
+	}
+	wantRef := rbacv1.RoleRef{APIGroup: "rbac.authorization.k8s.io", Kind: "ClusterRole", Name: "edit"}
+	if len(rolebindings) != 1 || rolebindings[0].RoleRef != wantRef {
+		t.Errorf("CreateResourcesForNamespace() gotRolebindings = %v, want one binding to %v", rolebindings, wantRef)
+	}
+	croles, crolebindings, err := CreateGlobalResources(pc, "", "permbot")
+	if err != nil {
+		t.Fatalf("CreateGlobalResources() error = %v", err)
+	}
+	if len(croles) != 0 {
+		t.Errorf("CreateGlobalResources() gotRoles = %v, want none", croles)
+	}
+	if len(crolebindings) != 1 || crolebindings[0].RoleRef != wantRef {
+		t.Errorf("CreateGlobalResources() gotRolebindings = %v, want one binding to %v", crolebindings, wantRef)
+	}
+}
+
+func TestCreateResourcesForNamespaceExtends(t *testing.T) {
+	view := types.Rule{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "list"}}
+	exec := types.Rule{APIGroups: []string{""}, Resources: []string{"pods/exec"}, Verbs: []string{"create"}}
+	logs := types.Rule{APIGroups: []string{""}, Resources: []string{"pods/log"}, Verbs: []string{"get"}}
+	pc := &types.PermbotConfig{
+		Projects: []types.Project{
+			{Namespace: "a", Roles: []types.RoleUsers{{Role: "debug", Users: []string{"alice"}}}},
+		},
+		Roles: []types.Role{
+			{Name: "debug", Extends: []string{"execute", "view"}, Rules: []types.Rule{logs}},
+			{Name: "execute", Extends: []string{"view"}, Rules: []types.Rule{exec}},
+			{Name: "view", Rules: []types.Rule{view}, GlobalUsers: []string{"bob"}},
+		},
+	}
+	roles, _, err := CreateResourcesForNamespace(pc, "a", "", "permbot")
+	if err != nil {
+		t.Fatalf("CreateResourcesForNamespace() error = %v", err)
+	}
+	// view's rules are only included once, and its global users aren't inherited
+	want := policyRules(&types.Role{Rules: []types.Rule{view, exec, logs}}, true)
+	if len(roles) != 1 || !reflect.DeepEqual(roles[0].Rules, want) {
+		t.Errorf("CreateResourcesForNamespace() gotRoles = %v, want one role with rules %v", roles, want)
+	}
+	croles, _, err := CreateGlobalResources(pc, "", "permbot")
+	if err != nil {
+		t.Fatalf("CreateGlobalResources() error = %v", err)
+	}
+	if len(croles) != 1 || croles[0].Name != "permbot-auto-role-global-view" {
+		t.Errorf("CreateGlobalResources() gotRoles = %v, want only view", croles)
+	}
+
+	tests := []struct {
+		name  string
+		roles []types.Role
+		want  string
+	}{
+		{"missing", []types.Role{{Name: "a", Extends: []string{"b"}}}, `role "a" extends undefined role "b"`},
+		{"cycle", []types.Role{{Name: "a", Extends: []string{"b"}}, {Name: "b", Extends: []string{"c"}}, {Name: "c", Extends: []string{"a"}}}, "cycle: a -> b -> c -> a"},
+		{"self", []types.Role{{Name: "a", Extends: []string{"a"}}}, "cycle: a -> a"},
+		{"clusterRole", []types.Role{{Name: "a", Extends: []string{"b"}}, {Name: "b", ClusterRole: "edit"}}, "has no rules to include"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pc := &types.PermbotConfig{Roles: tt.roles}
+			if _, _, err := CreateGlobalResources(pc, "", "permbot"); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("CreateGlobalResources() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateResourcesForNamespaceTemplates(t *testing.T) {
+	pc := &types.PermbotConfig{
+		Projects: []types.Project{
+			{
+				Namespace: "team-a",
+				Vars:      map[string]string{"configmap": "app-config", "peer": "team-b"},
+				Roles: []types.RoleUsers{{
+					Role:            "config",
+					Users:           []string{"{{ .Namespace }}-admin"},
+					ServiceAccounts: []string{"{{ .Vars.peer }}:ci"},
+				}},
+			},
+			{Namespace: "team-c", Roles: []types.RoleUsers{{Role: "config", Users: []string{"carol"}}}},
+		},
+		Roles: []types.Role{
+			{Name: "config", Rules: []types.Rule{{APIGroups: []string{""}, Resources: []string{"configmaps"}, ResourceNames: []string{"{{ .Vars.configmap }}"}, Verbs: []string{"get"}}}},
+		},
+	}
+	roles, rolebindings, err := CreateResourcesForNamespace(pc, "team-a", "", "permbot")
+	if err != nil {
+		t.Fatalf("CreateResourcesForNamespace() error = %v", err)
+	}
+	if len(roles) != 1 || !reflect.DeepEqual(roles[0].Rules[0].ResourceNames, []string{"app-config"}) {
+		t.Errorf("CreateResourcesForNamespace() gotRoles = %v, want resourceNames [app-config]", roles)
+	}
+	wantSubjects := []rbacv1.Subject{
+		{APIGroup: "rbac.authorization.k8s.io", Kind: "User", Name: "team-a-admin"},
+		{Kind: "ServiceAccount", Name: "ci", Namespace: "team-b"},
+	}
+	if len(rolebindings) != 1 || !reflect.DeepEqual(rolebindings[0].Subjects, wantSubjects) {
+		t.Errorf("CreateResourcesForNamespace() gotRolebindings = %v, want subjects %v", rolebindings, wantSubjects)
+	}
+
+	// team-c doesn't define the configmap var
+	if _, _, err := CreateResourcesForNamespace(pc, "team-c", "", "permbot"); err == nil || !strings.Contains(err.Error(), `undefined variable "configmap"`) {
+		t.Errorf("CreateResourcesForNamespace() error = %v, want undefined variable", err)
+	}
+	// Global roles have no project to expand variables for
+	pc.Roles[0].GlobalUsers = []string{"admin"}
+	if _, _, err := CreateGlobalResources(pc, "", "permbot"); err == nil || !strings.Contains(err.Error(), "can't use template variables") {
+		t.Errorf("CreateGlobalResources() error = %v, want template variables error", err)
+	}
+}
+
+func TestCreateResourcesForNamespaceGroups(t *testing.T) {
+	pc := &types.PermbotConfig{
+		Projects: []types.Project{
+			{
+				Namespace: "a",
+				Roles: []types.RoleUsers{{
+					Role:            "execute",
+					Users:           []string{"alice"},
+					Groups:          []string{"oidc:devs", "oidc:ops"},
+					ServiceAccounts: []string{"deployer"},
+				}},
+			},
+		},
+		Roles: []types.Role{{Name: "execute"}},
+	}
+	_, rolebindings, err := CreateResourcesForNamespace(pc, "a", "", "permbot")
+	if err != nil {
+		t.Fatalf("CreateResourcesForNamespace() error = %v", err)
+	}
+	want := []rbacv1.Subject{
+		{APIGroup: "rbac.authorization.k8s.io", Kind: "User", Name: "alice"},
+		{APIGroup: "rbac.authorization.k8s.io", Kind: "Group", Name: "oidc:devs"},
+		{APIGroup: "rbac.authorization.k8s.io", Kind: "Group", Name: "oidc:ops"},
+		{Kind: "ServiceAccount", Name: "deployer", Namespace: "a"},
+	}
+	if len(rolebindings) != 1 || !reflect.DeepEqual(rolebindings[0].Subjects, want) {
+		t.Errorf("CreateResourcesForNamespace() gotRolebindings = %v, want subjects %v", rolebindings, want)
+	}
+}
+
+func TestCreateResourcesForNamespaceExpires(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	pc := &types.PermbotConfig{
+		Projects: []types.Project{
+			{
+				Namespace: "a",
+				Roles: []types.RoleUsers{{
+					Role:            "execute",
+					Users:           []string{"alice", "bob", "carol"},
+					Groups:          []string{"oidc:devs"},
+					ServiceAccounts: []string{"other:debugger"},
+					Expires:         map[string]time.Time{"bob": past, "carol": future, "oidc:devs": past, "other:debugger": past},
+				}},
+			},
+		},
+		Roles: []types.Role{{Name: "execute"}},
+	}
+	_, rolebindings, err := CreateResourcesForNamespace(pc, "a", "", "permbot")
+	if err != nil {
+		t.Fatalf("CreateResourcesForNamespace() error = %v", err)
+	}
+	want := []rbacv1.Subject{
+		{APIGroup: "rbac.authorization.k8s.io", Kind: "User", Name: "alice"},
+		{APIGroup: "rbac.authorization.k8s.io", Kind: "User", Name: "carol"},
+	}
+	if len(rolebindings) != 1 || !reflect.DeepEqual(rolebindings[0].Subjects, want) {
+		t.Errorf("CreateResourcesForNamespace() gotRolebindings = %v, want subjects %v", rolebindings, want)
+	}
+	if next, ok := pc.NextExpiry(time.Now()); !ok || !next.Equal(future) {
+		t.Errorf("NextExpiry() = %v, %v, want %v", next, ok, future)
+	}
+}
+
+func TestResourceNamesAndNonResourceURLs(t *testing.T) {
+	pc := &types.PermbotConfig{
+		Projects: []types.Project{
+			{Namespace: "a", Roles: []types.RoleUsers{{Role: "debug", Users: []string{"alice"}}}},
+		},
+		Roles: []types.Role{
+			{
+				Name:        "debug",
+				GlobalUsers: []string{"prometheus"},
+				Rules: []types.Rule{
+					{APIGroups: []string{""}, Resources: []string{"pods/exec"}, ResourceNames: []string{"foo"}, Verbs: []string{"create"}},
+					{NonResourceURLs: []string{"/metrics"}, Verbs: []string{"get"}},
+				},
+			},
+		},
+	}
+	execRule := rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"pods/exec"}, ResourceNames: []string{"foo"}, Verbs: []string{"create"}}
+	metricsRule := rbacv1.PolicyRule{NonResourceURLs: []string{"/metrics"}, Verbs: []string{"get"}}
+
+	roles, _, err := CreateResourcesForNamespace(pc, "a", "", "permbot")
+	if err != nil {
+		t.Fatalf("CreateResourcesForNamespace() error = %v", err)
+	}
+	// nonResourceURLs aren't allowed in namespaced Roles, so that rule is dropped
+	if want := []rbacv1.PolicyRule{execRule}; len(roles) != 1 || !reflect.DeepEqual(roles[0].Rules, want) {
+		t.Errorf("CreateResourcesForNamespace() gotRoles = %v, want rules %v", roles, want)
+	}
+	croles, _, err := CreateGlobalResources(pc, "", "permbot")
+	if err != nil {
+		t.Fatalf("CreateGlobalResources() error = %v", err)
+	}
+	if want := []rbacv1.PolicyRule{execRule, metricsRule}; len(croles) != 1 || !reflect.DeepEqual(croles[0].Rules, want) {
+		t.Errorf("CreateGlobalResources() gotRoles = %v, want rules %v", croles, want)
+	}
+}
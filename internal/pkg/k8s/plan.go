@@ -0,0 +1,355 @@
+package k8s
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Change describes how a single live object differs from the desired state
+type Change struct {
+	Action          Action              `json:"action"`
+	Object          ObjectRef           `json:"object"`
+	SubjectsAdded   []rbacv1.Subject    `json:"subjectsAdded,omitempty"`
+	SubjectsRemoved []rbacv1.Subject    `json:"subjectsRemoved,omitempty"`
+	RulesAdded      []rbacv1.PolicyRule `json:"rulesAdded,omitempty"`
+	RulesRemoved    []rbacv1.PolicyRule `json:"rulesRemoved,omitempty"`
+	// RoleRef is the role a binding refers to, after the change (or before it, for a
+	// binding being pruned)
+	RoleRef *rbacv1.RoleRef `json:"roleRef,omitempty"`
+	// RoleRefFrom/RoleRefTo are set when a binding has to be recreated to point at a
+	// different role
+	RoleRefFrom *rbacv1.RoleRef `json:"roleRefFrom,omitempty"`
+	RoleRefTo   *rbacv1.RoleRef `json:"roleRefTo,omitempty"`
+	// Metadata lists labels and annotations which will be changed
+	Metadata []string `json:"metadata,omitempty"`
+}
+
+// PlanSummary counts the changes in a Plan by action
+type PlanSummary struct {
+	Create    int `json:"create"`
+	Update    int `json:"update"`
+	Delete    int `json:"delete"`
+	Unchanged int `json:"unchanged"`
+}
+
+// Plan is the set of changes required to bring the cluster in line with the desired state
+type Plan struct {
+	Changes []Change    `json:"changes"`
+	Summary PlanSummary `json:"summary"`
+}
+
+func (p *Plan) add(c Change) {
+	switch c.Action {
+	case ActionCreate:
+		p.Summary.Create++
+	case ActionUpdate:
+		p.Summary.Update++
+	case ActionDelete:
+		p.Summary.Delete++
+	case ActionUnchanged:
+		p.Summary.Unchanged++
+	}
+	p.Changes = append(p.Changes, c)
+}
+
+// HasChanges returns true if applying the plan would change anything in the cluster
+func (p *Plan) HasChanges() bool {
+	return p.Summary.Create+p.Summary.Update+p.Summary.Delete > 0
+}
+
+// IsDrift returns true if the change affects what the object grants, rather than just the
+// permbot version/rules-ref annotations. Reordering rules or subjects is not drift.
+func (c *Change) IsDrift() bool {
+	switch c.Action {
+	case ActionCreate, ActionDelete:
+		return true
+	case ActionUpdate:
+		if c.RoleRefFrom != nil || len(c.SubjectsAdded)+len(c.SubjectsRemoved)+len(c.RulesAdded)+len(c.RulesRemoved) > 0 {
+			return true
+		}
+		for _, m := range c.Metadata {
+			if strings.HasPrefix(m, "label ") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Drift returns a copy of the plan containing only the changes for which IsDrift is true
+func (p *Plan) Drift() *Plan {
+	drift := &Plan{}
+	for i := range p.Changes {
+		if p.Changes[i].IsDrift() {
+			drift.add(p.Changes[i])
+		}
+	}
+	drift.Summary.Unchanged = len(p.Changes) - len(drift.Changes)
+	return drift
+}
+
+// Applied returns the changes which actually happened when the plan was applied, i.e.
+// every change except unchanged objects and those in failed
+func (p *Plan) Applied(failed map[ObjectRef]bool) *Plan {
+	applied := &Plan{}
+	for i := range p.Changes {
+		c := &p.Changes[i]
+		if c.Action != ActionUnchanged && !failed[c.Object] {
+			applied.add(*c)
+		}
+	}
+	return applied
+}
+
+// DiffSubjects returns the subjects present only in desired (added) and only in live (removed)
+func DiffSubjects(desired, live []rbacv1.Subject) (added, removed []rbacv1.Subject) {
+	has := func(list []rbacv1.Subject, s rbacv1.Subject) bool {
+		for i := range list {
+			if list[i] == s {
+				return true
+			}
+		}
+		return false
+	}
+	for _, s := range desired {
+		if !has(live, s) {
+			added = append(added, s)
+		}
+	}
+	for _, s := range live {
+		if !has(desired, s) {
+			removed = append(removed, s)
+		}
+	}
+	return
+}
+
+// DiffRules returns the rules present only in desired (added) and only in live (removed)
+func DiffRules(desired, live []rbacv1.PolicyRule) (added, removed []rbacv1.PolicyRule) {
+	has := func(list []rbacv1.PolicyRule, r rbacv1.PolicyRule) bool {
+		for i := range list {
+			if equality.Semantic.DeepEqual(list[i], r) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, r := range desired {
+		if !has(live, r) {
+			added = append(added, r)
+		}
+	}
+	for _, r := range live {
+		if !has(desired, r) {
+			removed = append(removed, r)
+		}
+	}
+	return
+}
+
+func diffRulesObject(ref ObjectRef, desired, live []rbacv1.PolicyRule, dmeta, lmeta *metav1.ObjectMeta) Change {
+	c := Change{Object: ref, Action: ActionUnchanged}
+	if equality.Semantic.DeepEqual(desired, live) && !metaDiffers(dmeta, lmeta) {
+		return c
+	}
+	c.Action = ActionUpdate
+	c.RulesAdded, c.RulesRemoved = DiffRules(desired, live)
+	c.Metadata = metaChanges(dmeta, lmeta)
+	return c
+}
+
+func diffBindingObject(ref ObjectRef, desired, live []rbacv1.Subject, dref, lref rbacv1.RoleRef, dmeta, lmeta *metav1.ObjectMeta) Change {
+	c := Change{Object: ref, Action: ActionUnchanged, RoleRef: &dref}
+	if dref == lref && equality.Semantic.DeepEqual(desired, live) && !metaDiffers(dmeta, lmeta) {
+		return c
+	}
+	c.Action = ActionUpdate
+	c.SubjectsAdded, c.SubjectsRemoved = DiffSubjects(desired, live)
+	if dref != lref {
+		c.RoleRefFrom, c.RoleRefTo = &lref, &dref
+	}
+	c.Metadata = metaChanges(dmeta, lmeta)
+	return c
+}
+
+// BuildPlan compares the desired state with the live objects in the cluster, without
+// changing anything. If prune is set, orphaned objects found using opts are included in the
+// plan as deletions.
+func BuildPlan(cl kubernetes.Interface, desired *DesiredState, prune bool, opts PruneOptions) (*Plan, error) {
+	plan := &Plan{}
+	rbc := cl.RbacV1()
+	for i := range desired.Namespaces {
+		d := &desired.Namespaces[i]
+		ref := ObjectRef{Kind: "Namespace", Name: d.Name}
+		live, err := cl.CoreV1().Namespaces().Get(d.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			plan.add(Change{Action: ActionCreate, Object: ref})
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "unable to get %s", ref)
+		}
+		c := Change{Action: ActionUnchanged, Object: ref, Metadata: metaChanges(namespaceMeta(d, live), &live.ObjectMeta)}
+		if len(c.Metadata) > 0 {
+			c.Action = ActionUpdate
+		}
+		plan.add(c)
+	}
+	for i := range desired.Roles {
+		d := &desired.Roles[i]
+		ref := ObjectRef{Kind: "Role", Namespace: d.Namespace, Name: d.Name}
+		live, err := rbc.Roles(d.Namespace).Get(d.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			plan.add(Change{Action: ActionCreate, Object: ref, RulesAdded: d.Rules})
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "unable to get %s", ref)
+		}
+		plan.add(diffRulesObject(ref, d.Rules, live.Rules, &d.ObjectMeta, &live.ObjectMeta))
+	}
+	for i := range desired.RoleBindings {
+		d := &desired.RoleBindings[i]
+		ref := ObjectRef{Kind: "RoleBinding", Namespace: d.Namespace, Name: d.Name}
+		live, err := rbc.RoleBindings(d.Namespace).Get(d.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			plan.add(Change{Action: ActionCreate, Object: ref, SubjectsAdded: d.Subjects, RoleRef: &d.RoleRef})
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "unable to get %s", ref)
+		}
+		plan.add(diffBindingObject(ref, d.Subjects, live.Subjects, d.RoleRef, live.RoleRef, &d.ObjectMeta, &live.ObjectMeta))
+	}
+	for i := range desired.ClusterRoles {
+		d := &desired.ClusterRoles[i]
+		ref := ObjectRef{Kind: "ClusterRole", Name: d.Name}
+		live, err := rbc.ClusterRoles().Get(d.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			plan.add(Change{Action: ActionCreate, Object: ref, RulesAdded: d.Rules})
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "unable to get %s", ref)
+		}
+		plan.add(diffRulesObject(ref, d.Rules, live.Rules, &d.ObjectMeta, &live.ObjectMeta))
+	}
+	for i := range desired.ClusterRoleBindings {
+		d := &desired.ClusterRoleBindings[i]
+		ref := ObjectRef{Kind: "ClusterRoleBinding", Name: d.Name}
+		live, err := rbc.ClusterRoleBindings().Get(d.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			plan.add(Change{Action: ActionCreate, Object: ref, SubjectsAdded: d.Subjects, RoleRef: &d.RoleRef})
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "unable to get %s", ref)
+		}
+		plan.add(diffBindingObject(ref, d.Subjects, live.Subjects, d.RoleRef, live.RoleRef, &d.ObjectMeta, &live.ObjectMeta))
+	}
+	if !prune {
+		return plan, nil
+	}
+	orphans, err := FindOrphans(cl, desired, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range orphans {
+		c := Change{Action: ActionDelete, Object: o}
+		// Include what the object currently grants, so the plan shows what is being revoked
+		switch o.Kind {
+		case "Role":
+			if live, err := rbc.Roles(o.Namespace).Get(o.Name, metav1.GetOptions{}); err == nil {
+				c.RulesRemoved = live.Rules
+			}
+		case "RoleBinding":
+			if live, err := rbc.RoleBindings(o.Namespace).Get(o.Name, metav1.GetOptions{}); err == nil {
+				c.SubjectsRemoved, c.RoleRef = live.Subjects, &live.RoleRef
+			}
+		case "ClusterRole":
+			if live, err := rbc.ClusterRoles().Get(o.Name, metav1.GetOptions{}); err == nil {
+				c.RulesRemoved = live.Rules
+			}
+		case "ClusterRoleBinding":
+			if live, err := rbc.ClusterRoleBindings().Get(o.Name, metav1.GetOptions{}); err == nil {
+				c.SubjectsRemoved, c.RoleRef = live.Subjects, &live.RoleRef
+			}
+		}
+		plan.add(c)
+	}
+	return plan, nil
+}
+
+// FormatSubject returns a short human readable form of a subject, e.g. User "x" or
+// ServiceAccount "ns:name"
+func FormatSubject(s rbacv1.Subject) string {
+	if s.Namespace != "" {
+		return fmt.Sprintf("%s %q", s.Kind, s.Namespace+":"+s.Name)
+	}
+	return fmt.Sprintf("%s %q", s.Kind, s.Name)
+}
+
+// FormatRule returns a short human readable form of a policy rule
+func FormatRule(r rbacv1.PolicyRule) string {
+	parts := []string{}
+	field := func(name string, vals []string) {
+		if len(vals) > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%q", name, vals))
+		}
+	}
+	field("apiGroups", r.APIGroups)
+	field("resources", r.Resources)
+	field("resourceNames", r.ResourceNames)
+	field("nonResourceURLs", r.NonResourceURLs)
+	field("verbs", r.Verbs)
+	return strings.Join(parts, " ")
+}
+
+var planVerbs = map[Action]struct {
+	symbol string
+	desc   string
+}{
+	ActionCreate: {"+", "created"},
+	ActionUpdate: {"~", "updated"},
+	ActionDelete: {"-", "pruned"},
+}
+
+// WriteText writes the plan in a human readable, Terraform-like format. Unchanged objects
+// are omitted.
+func (p *Plan) WriteText(w io.Writer) {
+	if !p.HasChanges() {
+		fmt.Fprintf(w, "No changes. %d objects are up to date.\n", p.Summary.Unchanged)
+		return
+	}
+	fmt.Fprintln(w, "Permbot will perform the following actions:")
+	for _, c := range p.Changes {
+		v, ok := planVerbs[c.Action]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(w, "\n  %s %s will be %s\n", v.symbol, c.Object, v.desc)
+		if c.RoleRefFrom != nil {
+			fmt.Fprintf(w, "      ~ roleRef %s/%s -> %s/%s\n", c.RoleRefFrom.Kind, c.RoleRefFrom.Name, c.RoleRefTo.Kind, c.RoleRefTo.Name)
+		}
+		for _, s := range c.SubjectsAdded {
+			fmt.Fprintf(w, "      + %s\n", FormatSubject(s))
+		}
+		for _, s := range c.SubjectsRemoved {
+			fmt.Fprintf(w, "      - %s\n", FormatSubject(s))
+		}
+		for _, r := range c.RulesAdded {
+			fmt.Fprintf(w, "      + rule %s\n", FormatRule(r))
+		}
+		for _, r := range c.RulesRemoved {
+			fmt.Fprintf(w, "      - rule %s\n", FormatRule(r))
+		}
+		for _, m := range c.Metadata {
+			fmt.Fprintf(w, "      ~ %s\n", m)
+		}
+	}
+	fmt.Fprintf(w, "\nPlan: %d to create, %d to update, %d to prune, %d unchanged.\n",
+		p.Summary.Create, p.Summary.Update, p.Summary.Delete, p.Summary.Unchanged)
+}
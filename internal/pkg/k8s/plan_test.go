@@ -0,0 +1,189 @@
+package k8s
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+func TestBuildPlan(t *testing.T) {
+	pc := &types.PermbotConfig{
+		Projects: []types.Project{
+			{Namespace: "a", Roles: []types.RoleUsers{{Role: "execute", Users: []string{"alice", "bob"}}}},
+			{Namespace: "b", Roles: []types.RoleUsers{{Role: "execute", Users: []string{"carol"}}}},
+		},
+		Roles: []types.Role{
+			{
+				Name:  "execute",
+				Rules: []types.Rule{{APIGroups: []string{""}, Resources: []string{"pods/exec"}, Verbs: []string{"create"}}},
+			},
+		},
+	}
+	desired, err := CreateDesiredState(pc, "", "permbot", true, nil)
+	if err != nil {
+		t.Fatalf("CreateDesiredState() error = %v", err)
+	}
+	// Namespace "a" already exists, but with a hand-added user and missing bob
+	liveRole := desired.Roles[0].DeepCopy()
+	liveBinding := desired.RoleBindings[0].DeepCopy()
+	liveBinding.Subjects = []rbacv1.Subject{
+		{APIGroup: "rbac.authorization.k8s.io", Kind: "User", Name: "alice"},
+		{APIGroup: "rbac.authorization.k8s.io", Kind: "User", Name: "mallory"},
+	}
+	// A leftover binding from a project since removed from the config
+	orphan := liveBinding.DeepCopy()
+	orphan.Namespace = "gone"
+	cl := fake.NewSimpleClientset(liveRole, liveBinding, orphan)
+
+	plan, err := BuildPlan(cl, desired, true, PruneOptions{Owner: "permbot", Global: true})
+	if err != nil {
+		t.Fatalf("BuildPlan() error = %v", err)
+	}
+	wantSummary := PlanSummary{Create: 2, Update: 1, Delete: 1, Unchanged: 1}
+	if plan.Summary != wantSummary {
+		t.Errorf("Summary = %+v, want %+v", plan.Summary, wantSummary)
+	}
+	var update *Change
+	for i := range plan.Changes {
+		if plan.Changes[i].Action == ActionUpdate {
+			update = &plan.Changes[i]
+		}
+	}
+	if update == nil {
+		t.Fatalf("no update in plan: %+v", plan.Changes)
+	}
+	wantAdded := []rbacv1.Subject{{APIGroup: "rbac.authorization.k8s.io", Kind: "User", Name: "bob"}}
+	wantRemoved := []rbacv1.Subject{{APIGroup: "rbac.authorization.k8s.io", Kind: "User", Name: "mallory"}}
+	if !reflect.DeepEqual(update.SubjectsAdded, wantAdded) {
+		t.Errorf("SubjectsAdded = %v, want %v", update.SubjectsAdded, wantAdded)
+	}
+	if !reflect.DeepEqual(update.SubjectsRemoved, wantRemoved) {
+		t.Errorf("SubjectsRemoved = %v, want %v", update.SubjectsRemoved, wantRemoved)
+	}
+
+	var out bytes.Buffer
+	plan.WriteText(&out)
+	for _, want := range []string{
+		"+ Role/b/permbot-auto-role-execute will be created",
+		"~ RoleBinding/a/permbot-auto-role-binding-execute will be updated",
+		"+ User \"bob\"",
+		"- User \"mallory\"",
+		"- RoleBinding/gone/permbot-auto-role-binding-execute will be pruned",
+		"Plan: 2 to create, 1 to update, 1 to prune, 1 unchanged.",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("WriteText() output missing %q, got:\n%s", want, out.String())
+		}
+	}
+
+	// Only the changes which didn't fail were applied
+	applied := plan.Applied(map[ObjectRef]bool{{Kind: "Role", Namespace: "b", Name: "permbot-auto-role-execute"}: true})
+	wantApplied := PlanSummary{Create: 1, Update: 1, Delete: 1}
+	if applied.Summary != wantApplied || len(applied.Changes) != 3 {
+		t.Errorf("Applied() = %+v, want %+v", applied.Summary, wantApplied)
+	}
+}
+
+func TestChangeIsDrift(t *testing.T) {
+	tests := []struct {
+		name   string
+		change Change
+		want   bool
+	}{
+		{name: "unchanged", change: Change{Action: ActionUnchanged}, want: false},
+		{name: "missing", change: Change{Action: ActionCreate}, want: true},
+		{name: "orphan", change: Change{Action: ActionDelete}, want: true},
+		{
+			name:   "annotation-only",
+			change: Change{Action: ActionUpdate, Metadata: []string{"annotation dafni.ac.uk/permbot-rules-ref"}},
+			want:   false,
+		},
+		{
+			name:   "owner-label-removed",
+			change: Change{Action: ActionUpdate, Metadata: []string{"label dafni.ac.uk/permbot-owner"}},
+			want:   true,
+		},
+		{
+			name:   "extra-subject",
+			change: Change{Action: ActionUpdate, SubjectsRemoved: []rbacv1.Subject{{Kind: "User", Name: "mallory"}}},
+			want:   true,
+		},
+		{name: "reordered", change: Change{Action: ActionUpdate}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.change.IsDrift(); got != tt.want {
+				t.Errorf("IsDrift() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildPlanCreateNamespace(t *testing.T) {
+	pc := &types.PermbotConfig{
+		Projects: []types.Project{
+			{Namespace: "new", CreateNamespace: true, Roles: []types.RoleUsers{{Role: "view", Users: []string{"alice"}}}},
+			{Namespace: "missing", Roles: []types.RoleUsers{{Role: "view", Users: []string{"bob"}}}},
+		},
+		Roles: []types.Role{{Name: "view", ClusterRole: "view"}},
+	}
+	// Neither namespace exists, but "new" will be created so its project is still included
+	desired, err := CreateDesiredState(pc, "", "permbot", false, NamespaceExists(fake.NewSimpleClientset()))
+	if err != nil {
+		t.Fatalf("CreateDesiredState() error = %v", err)
+	}
+	plan, err := BuildPlan(fake.NewSimpleClientset(), desired, false, PruneOptions{Owner: "permbot"})
+	if err != nil {
+		t.Fatalf("BuildPlan() error = %v", err)
+	}
+	var got []string
+	for _, c := range plan.Changes {
+		got = append(got, string(c.Action)+" "+c.Object.String())
+	}
+	want := []string{
+		"create Namespace/new",
+		"create RoleBinding/new/permbot-auto-role-binding-view",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("BuildPlan() changes = %v, want %v", got, want)
+	}
+}
+
+func TestCreateDesiredStateNamespaceErrors(t *testing.T) {
+	pc := &types.PermbotConfig{
+		Projects: []types.Project{
+			{Namespace: "exists", Roles: []types.RoleUsers{{Role: "view", Users: []string{"alice"}}}},
+			{Namespace: "missing", Roles: []types.RoleUsers{{Role: "view", Users: []string{"bob"}}}},
+		},
+		Roles: []types.Role{{Name: "view", ClusterRole: "view"}},
+	}
+	cl := fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "exists"}})
+	desired, err := CreateDesiredState(pc, "", "permbot", false, NamespaceExists(cl))
+	if err != nil {
+		t.Fatalf("CreateDesiredState() error = %v", err)
+	}
+	if len(desired.RoleBindings) != 1 || desired.RoleBindings[0].Namespace != "exists" {
+		t.Errorf("CreateDesiredState() rolebindings = %+v, want only one in exists", desired.RoleBindings)
+	}
+
+	// Anything but NotFound must not be mistaken for a missing namespace, or the project's
+	// objects would be pruned
+	cl.PrependReactor("get", "namespaces", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "namespaces"}, "exists", nil)
+	})
+	if _, err := CreateDesiredState(pc, "", "permbot", false, NamespaceExists(cl)); err == nil || !strings.Contains(err.Error(), "unable to get namespace exists") {
+		t.Errorf("CreateDesiredState() error = %v, want forbidden namespace error", err)
+	}
+}
@@ -0,0 +1,170 @@
+package k8s
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ObjectRef identifies a single RBAC object in the cluster
+type ObjectRef struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+}
+
+// String returns the reference as Kind/Name or Kind/Namespace/Name for namespaced objects
+func (o ObjectRef) String() string {
+	if o.Namespace == "" {
+		return fmt.Sprintf("%s/%s", o.Kind, o.Name)
+	}
+	return fmt.Sprintf("%s/%s/%s", o.Kind, o.Namespace, o.Name)
+}
+
+// PruneOptions controls which objects are considered for pruning
+type PruneOptions struct {
+	// Owner is the value of the owner label, only objects carrying it are ever pruned
+	Owner string
+	// ProtectedNamespaces lists namespaces in which nothing is ever pruned
+	ProtectedNamespaces []string
+	// Global enables pruning of ClusterRoles and ClusterRoleBindings. This should only be
+	// set when the desired state contains the global resources, otherwise all of them
+	// would be treated as orphans.
+	Global bool
+	// Namespaces enables pruning of namespaces created by permbot (for projects with
+	// createNamespace) which no project uses any more. Namespaces without the owner label
+	// are never pruned.
+	Namespaces bool
+}
+
+// OwnerSelector returns the label selector matching all objects created for the given owner
+func OwnerSelector(owner string) string {
+	return fmt.Sprintf("%s=%s", ownerLabel, owner)
+}
+
+// IsOwnedBy reports whether obj carries the owner label for owner
+func IsOwnedBy(obj metav1.Object, owner string) bool {
+	return obj.GetLabels()[ownerLabel] == owner
+}
+
+// pruneOrder is the order in which kinds are deleted, bindings go before the roles they
+// reference so that nothing is left pointing at a missing role
+var pruneOrder = map[string]int{
+	"RoleBinding":        0,
+	"Role":               1,
+	"ClusterRoleBinding": 2,
+	"ClusterRole":        3,
+	"Namespace":          4,
+}
+
+// FindOrphans lists every object labelled with the configured owner that is not part of
+// the desired state, i.e. objects which were created by a previous run of permbot but
+// which the current configuration no longer produces. Break-glass grants are left alone.
+func FindOrphans(cl kubernetes.Interface, desired *DesiredState, opts PruneOptions) (orphans []ObjectRef, err error) {
+	want := desired.refs()
+	protected := make(map[string]bool, len(opts.ProtectedNamespaces))
+	for _, ns := range opts.ProtectedNamespaces {
+		protected[ns] = true
+	}
+	lo := metav1.ListOptions{LabelSelector: OwnerSelector(opts.Owner)}
+	rbc := cl.RbacV1()
+	consider := func(ref ObjectRef) {
+		if want[ref] {
+			return
+		}
+		if (ref.Namespace != "" && protected[ref.Namespace]) || (ref.Kind == "Namespace" && protected[ref.Name]) {
+			log.WithField("object", ref.String()).Debug("not pruning object in protected namespace")
+			return
+		}
+		orphans = append(orphans, ref)
+	}
+	rl, err := rbc.Roles(metav1.NamespaceAll).List(lo)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list roles")
+	}
+	for i := range rl.Items {
+		if isBreakGlass(&rl.Items[i]) {
+			// break-glass grants are removed when they expire rather than pruned
+			continue
+		}
+		consider(ObjectRef{Kind: "Role", Namespace: rl.Items[i].Namespace, Name: rl.Items[i].Name})
+	}
+	rbl, err := rbc.RoleBindings(metav1.NamespaceAll).List(lo)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list rolebindings")
+	}
+	for i := range rbl.Items {
+		if isBreakGlass(&rbl.Items[i]) {
+			continue
+		}
+		consider(ObjectRef{Kind: "RoleBinding", Namespace: rbl.Items[i].Namespace, Name: rbl.Items[i].Name})
+	}
+	if opts.Global {
+		crl, err := rbc.ClusterRoles().List(lo)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to list clusterroles")
+		}
+		for i := range crl.Items {
+			consider(ObjectRef{Kind: "ClusterRole", Name: crl.Items[i].Name})
+		}
+		crbl, err := rbc.ClusterRoleBindings().List(lo)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to list clusterrolebindings")
+		}
+		for i := range crbl.Items {
+			consider(ObjectRef{Kind: "ClusterRoleBinding", Name: crbl.Items[i].Name})
+		}
+	}
+	if opts.Namespaces {
+		nsl, err := cl.CoreV1().Namespaces().List(lo)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to list namespaces")
+		}
+		for i := range nsl.Items {
+			consider(ObjectRef{Kind: "Namespace", Name: nsl.Items[i].Name})
+		}
+	}
+	sort.SliceStable(orphans, func(i, j int) bool {
+		return pruneOrder[orphans[i].Kind] < pruneOrder[orphans[j].Kind]
+	})
+	return orphans, nil
+}
+
+// Prune deletes the given objects from the cluster. Failures are logged and the remaining
+// objects are still deleted, an error is returned if any deletion failed.
+func Prune(cl kubernetes.Interface, orphans []ObjectRef) (pruned []ObjectRef, err error) {
+	rbc := cl.RbacV1()
+	failed := 0
+	for _, o := range orphans {
+		var derr error
+		switch o.Kind {
+		case "Role":
+			derr = rbc.Roles(o.Namespace).Delete(o.Name, &metav1.DeleteOptions{})
+		case "RoleBinding":
+			derr = rbc.RoleBindings(o.Namespace).Delete(o.Name, &metav1.DeleteOptions{})
+		case "ClusterRole":
+			derr = rbc.ClusterRoles().Delete(o.Name, &metav1.DeleteOptions{})
+		case "ClusterRoleBinding":
+			derr = rbc.ClusterRoleBindings().Delete(o.Name, &metav1.DeleteOptions{})
+		case "Namespace":
+			derr = cl.CoreV1().Namespaces().Delete(o.Name, &metav1.DeleteOptions{})
+		default:
+			derr = errors.Errorf("unknown kind %q", o.Kind)
+		}
+		if derr != nil {
+			log.WithError(derr).WithField("object", o.String()).Error("unable to prune object")
+			failed++
+			continue
+		}
+		log.WithField("object", o.String()).Info("pruned object")
+		pruned = append(pruned, o)
+	}
+	if failed > 0 {
+		err = errors.Errorf("failed to prune %d objects", failed)
+	}
+	return
+}
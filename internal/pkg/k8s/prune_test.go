@@ -0,0 +1,144 @@
+package k8s
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+func labelledMeta(name, namespace, owner string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:      name,
+		Namespace: namespace,
+		Labels:    objectLabels(owner),
+	}
+}
+
+func TestFindOrphans(t *testing.T) {
+	existing := []runtime.Object{
+		&rbacv1.Role{ObjectMeta: labelledMeta("permbot-auto-role-execute", "a", "permbot")},
+		&rbacv1.RoleBinding{ObjectMeta: labelledMeta("permbot-auto-role-binding-execute", "a", "permbot")},
+		&rbacv1.Role{ObjectMeta: labelledMeta("permbot-auto-role-execute", "b", "permbot")},
+		&rbacv1.RoleBinding{ObjectMeta: labelledMeta("permbot-auto-role-binding-execute", "b", "permbot")},
+		&rbacv1.Role{ObjectMeta: labelledMeta("permbot-auto-role-execute", "kube-system", "permbot")},
+		// Owned by someone else, never touched
+		&rbacv1.Role{ObjectMeta: labelledMeta("permbot-auto-role-execute", "c", "other")},
+		// Not labelled at all
+		&rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: "handmade", Namespace: "a"}},
+		&rbacv1.ClusterRole{ObjectMeta: labelledMeta("permbot-auto-role-global-view", "", "permbot")},
+		&rbacv1.ClusterRoleBinding{ObjectMeta: labelledMeta("permbot-auto-role-global-binding-view", "", "permbot")},
+		// Namespaces created by permbot, "a" is still used by the desired state
+		&corev1.Namespace{ObjectMeta: labelledMeta("a", "", "permbot")},
+		&corev1.Namespace{ObjectMeta: labelledMeta("gone", "", "permbot")},
+		&corev1.Namespace{ObjectMeta: labelledMeta("kube-system", "", "permbot")},
+		// Not created by permbot, never pruned
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "b"}},
+	}
+	desired := &DesiredState{
+		Roles:        []rbacv1.Role{{ObjectMeta: labelledMeta("permbot-auto-role-execute", "a", "permbot")}},
+		RoleBindings: []rbacv1.RoleBinding{{ObjectMeta: labelledMeta("permbot-auto-role-binding-execute", "a", "permbot")}},
+	}
+	tests := []struct {
+		name string
+		opts PruneOptions
+		want []ObjectRef
+	}{
+		{
+			name: "namespaced-only",
+			opts: PruneOptions{Owner: "permbot", ProtectedNamespaces: []string{"kube-system"}},
+			want: []ObjectRef{
+				{Kind: "RoleBinding", Namespace: "b", Name: "permbot-auto-role-binding-execute"},
+				{Kind: "Role", Namespace: "b", Name: "permbot-auto-role-execute"},
+			},
+		},
+		{
+			name: "with-global",
+			opts: PruneOptions{Owner: "permbot", ProtectedNamespaces: []string{"kube-system"}, Global: true},
+			want: []ObjectRef{
+				{Kind: "RoleBinding", Namespace: "b", Name: "permbot-auto-role-binding-execute"},
+				{Kind: "Role", Namespace: "b", Name: "permbot-auto-role-execute"},
+				{Kind: "ClusterRoleBinding", Name: "permbot-auto-role-global-binding-view"},
+				{Kind: "ClusterRole", Name: "permbot-auto-role-global-view"},
+			},
+		},
+		{
+			name: "with-namespaces",
+			opts: PruneOptions{Owner: "permbot", ProtectedNamespaces: []string{"kube-system"}, Namespaces: true},
+			want: []ObjectRef{
+				{Kind: "RoleBinding", Namespace: "b", Name: "permbot-auto-role-binding-execute"},
+				{Kind: "Role", Namespace: "b", Name: "permbot-auto-role-execute"},
+				{Kind: "Namespace", Name: "gone"},
+			},
+		},
+		{
+			name: "no-protected-namespaces",
+			opts: PruneOptions{Owner: "permbot"},
+			want: []ObjectRef{
+				{Kind: "RoleBinding", Namespace: "b", Name: "permbot-auto-role-binding-execute"},
+				{Kind: "Role", Namespace: "b", Name: "permbot-auto-role-execute"},
+				{Kind: "Role", Namespace: "kube-system", Name: "permbot-auto-role-execute"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cl := fake.NewSimpleClientset(existing...)
+			got, err := FindOrphans(cl, desired, tt.opts)
+			if err != nil {
+				t.Fatalf("FindOrphans() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FindOrphans() = %v, want %v", got, tt.want)
+			}
+			pruned, err := Prune(cl, got)
+			if err != nil {
+				t.Fatalf("Prune() error = %v", err)
+			}
+			if !reflect.DeepEqual(pruned, tt.want) {
+				t.Errorf("Prune() = %v, want %v", pruned, tt.want)
+			}
+			left, err := FindOrphans(cl, desired, tt.opts)
+			if err != nil {
+				t.Fatalf("FindOrphans() after prune error = %v", err)
+			}
+			if len(left) != 0 {
+				t.Errorf("FindOrphans() after prune = %v, want none", left)
+			}
+		})
+	}
+}
+
+func TestFindOrphansProjectNamespaces(t *testing.T) {
+	pc := &types.PermbotConfig{
+		Roles: []types.Role{{Name: "view", ClusterRole: "view"}},
+		Projects: []types.Project{
+			// no longer sets createNamespace, and has no objects of its own
+			{Namespace: "kept"},
+			// only binds to an existing ClusterRole, and is skipped as if it didn't exist
+			{Namespace: "skipped", Roles: []types.RoleUsers{{Role: "view", Users: []string{"alice"}}}},
+		},
+	}
+	desired, err := CreateDesiredState(pc, "", "permbot", false, func(ns string) (bool, error) { return ns != "skipped", nil })
+	if err != nil {
+		t.Fatalf("CreateDesiredState() error = %v", err)
+	}
+	cl := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: labelledMeta("kept", "", "permbot")},
+		&corev1.Namespace{ObjectMeta: labelledMeta("skipped", "", "permbot")},
+		&corev1.Namespace{ObjectMeta: labelledMeta("gone", "", "permbot")},
+	)
+	got, err := FindOrphans(cl, desired, PruneOptions{Owner: "permbot", Namespaces: true})
+	if err != nil {
+		t.Fatalf("FindOrphans() error = %v", err)
+	}
+	if want := []ObjectRef{{Kind: "Namespace", Name: "gone"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FindOrphans() = %v, want %v", got, want)
+	}
+}
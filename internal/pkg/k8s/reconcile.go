@@ -0,0 +1,256 @@
+package k8s
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Action describes what was done to a single object when reconciling it
+type Action string
+
+const (
+	// ActionCreate means the object did not exist and was created
+	ActionCreate Action = "create"
+	// ActionUpdate means the object existed but differed, and was updated
+	ActionUpdate Action = "update"
+	// ActionUnchanged means the object already matched the desired state
+	ActionUnchanged Action = "unchanged"
+	// ActionDelete means the object is no longer defined by the config and was pruned
+	ActionDelete Action = "delete"
+)
+
+// Stats counts the outcomes of a reconcile run
+type Stats struct {
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+	Failed    int `json:"failed"`
+}
+
+func (s *Stats) record(a Action, err error) {
+	if err != nil {
+		s.Failed++
+		return
+	}
+	switch a {
+	case ActionCreate:
+		s.Created++
+	case ActionUpdate:
+		s.Updated++
+	case ActionUnchanged:
+		s.Unchanged++
+	}
+}
+
+// Reconciler applies RBAC objects to a cluster with create-or-update semantics, only
+// updating objects whose rules, subjects, labels or annotations differ from the desired
+// state.
+type Reconciler struct {
+	client kubernetes.Interface
+	// Stats holds the counts of everything applied by this Reconciler so far
+	Stats Stats
+	// Observer, if set, is called with the result of applying every object
+	Observer func(ref ObjectRef, a Action, err error)
+}
+
+// record counts the result of applying an object and passes it to the Observer
+func (r *Reconciler) record(ref ObjectRef, a Action, err error) {
+	r.Stats.record(a, err)
+	if r.Observer != nil {
+		r.Observer(ref, a, err)
+	}
+}
+
+// NewReconciler creates a Reconciler using the specified client
+func NewReconciler(cl kubernetes.Interface) *Reconciler {
+	return &Reconciler{client: cl}
+}
+
+// metaChanges lists every label or annotation in desired which is missing or different in
+// live. Extra labels/annotations on the live object (e.g. added by kubectl) are ignored.
+func metaChanges(desired, live *metav1.ObjectMeta) (changed []string) {
+	for _, k := range sortedKeys(desired.Labels) {
+		if lv, ok := live.Labels[k]; !ok || lv != desired.Labels[k] {
+			changed = append(changed, "label "+k)
+		}
+	}
+	for _, k := range sortedKeys(desired.Annotations) {
+		if lv, ok := live.Annotations[k]; !ok || lv != desired.Annotations[k] {
+			changed = append(changed, "annotation "+k)
+		}
+	}
+	return
+}
+
+// metaDiffers returns true if metaChanges would report any change
+func metaDiffers(desired, live *metav1.ObjectMeta) bool {
+	return len(metaChanges(desired, live)) > 0
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// mergeMeta copies the desired labels and annotations onto the live object, keeping any
+// extra ones already present.
+func mergeMeta(desired, live *metav1.ObjectMeta) {
+	if live.Labels == nil {
+		live.Labels = make(map[string]string, len(desired.Labels))
+	}
+	for k, v := range desired.Labels {
+		live.Labels[k] = v
+	}
+	if live.Annotations == nil {
+		live.Annotations = make(map[string]string, len(desired.Annotations))
+	}
+	for k, v := range desired.Annotations {
+		live.Annotations[k] = v
+	}
+}
+
+// namespaceMeta returns the labels and annotations permbot manages on an existing
+// namespace. Namespaces created by another owner (or not by permbot at all) only get the
+// project's own labels and annotations, never the owner label.
+func namespaceMeta(desired, live *corev1.Namespace) *metav1.ObjectMeta {
+	if live.Labels[ownerLabel] == desired.Labels[ownerLabel] {
+		return &desired.ObjectMeta
+	}
+	return projectMeta(&desired.ObjectMeta)
+}
+
+// ApplyNamespace creates a Namespace if it doesn't exist, or otherwise updates its labels
+// and annotations
+func (r *Reconciler) ApplyNamespace(desired *corev1.Namespace) (a Action, err error) {
+	defer func() { r.record(ObjectRef{Kind: "Namespace", Name: desired.Name}, a, err) }()
+	nc := r.client.CoreV1().Namespaces()
+	live, err := nc.Get(desired.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = nc.Create(desired)
+		return ActionCreate, errors.Wrap(err, "unable to create namespace")
+	} else if err != nil {
+		return "", errors.Wrap(err, "unable to get namespace")
+	}
+	want := namespaceMeta(desired, live)
+	if !metaDiffers(want, &live.ObjectMeta) {
+		return ActionUnchanged, nil
+	}
+	mergeMeta(want, &live.ObjectMeta)
+	_, err = nc.Update(live)
+	return ActionUpdate, errors.Wrap(err, "unable to update namespace")
+}
+
+// ApplyRole creates or updates a Role
+func (r *Reconciler) ApplyRole(desired *rbacv1.Role) (a Action, err error) {
+	defer func() { r.record(ObjectRef{Kind: "Role", Namespace: desired.Namespace, Name: desired.Name}, a, err) }()
+	rc := r.client.RbacV1().Roles(desired.Namespace)
+	live, err := rc.Get(desired.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = rc.Create(desired)
+		return ActionCreate, errors.Wrap(err, "unable to create role")
+	} else if err != nil {
+		return "", errors.Wrap(err, "unable to get role")
+	}
+	if equality.Semantic.DeepEqual(desired.Rules, live.Rules) && !metaDiffers(&desired.ObjectMeta, &live.ObjectMeta) {
+		return ActionUnchanged, nil
+	}
+	live.Rules = desired.Rules
+	mergeMeta(&desired.ObjectMeta, &live.ObjectMeta)
+	_, err = rc.Update(live)
+	return ActionUpdate, errors.Wrap(err, "unable to update role")
+}
+
+// ApplyRoleBinding creates or updates a RoleBinding. As the RoleRef of a binding is
+// immutable, a binding referencing a different role is deleted and recreated.
+func (r *Reconciler) ApplyRoleBinding(desired *rbacv1.RoleBinding) (a Action, err error) {
+	defer func() {
+		r.record(ObjectRef{Kind: "RoleBinding", Namespace: desired.Namespace, Name: desired.Name}, a, err)
+	}()
+	rbc := r.client.RbacV1().RoleBindings(desired.Namespace)
+	live, err := rbc.Get(desired.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = rbc.Create(desired)
+		return ActionCreate, errors.Wrap(err, "unable to create rolebinding")
+	} else if err != nil {
+		return "", errors.Wrap(err, "unable to get rolebinding")
+	}
+	if live.RoleRef != desired.RoleRef {
+		log.WithFields(log.Fields{
+			"rolebinding": desired.Name,
+			"namespace":   desired.Namespace,
+		}).Info("roleRef changed, recreating rolebinding")
+		if err = rbc.Delete(desired.Name, &metav1.DeleteOptions{}); err != nil {
+			return ActionUpdate, errors.Wrap(err, "unable to delete rolebinding for recreation")
+		}
+		_, err = rbc.Create(desired)
+		return ActionUpdate, errors.Wrap(err, "unable to recreate rolebinding")
+	}
+	if equality.Semantic.DeepEqual(desired.Subjects, live.Subjects) && !metaDiffers(&desired.ObjectMeta, &live.ObjectMeta) {
+		return ActionUnchanged, nil
+	}
+	live.Subjects = desired.Subjects
+	mergeMeta(&desired.ObjectMeta, &live.ObjectMeta)
+	_, err = rbc.Update(live)
+	return ActionUpdate, errors.Wrap(err, "unable to update rolebinding")
+}
+
+// ApplyClusterRole creates or updates a ClusterRole
+func (r *Reconciler) ApplyClusterRole(desired *rbacv1.ClusterRole) (a Action, err error) {
+	defer func() { r.record(ObjectRef{Kind: "ClusterRole", Name: desired.Name}, a, err) }()
+	crc := r.client.RbacV1().ClusterRoles()
+	live, err := crc.Get(desired.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = crc.Create(desired)
+		return ActionCreate, errors.Wrap(err, "unable to create clusterrole")
+	} else if err != nil {
+		return "", errors.Wrap(err, "unable to get clusterrole")
+	}
+	if equality.Semantic.DeepEqual(desired.Rules, live.Rules) && !metaDiffers(&desired.ObjectMeta, &live.ObjectMeta) {
+		return ActionUnchanged, nil
+	}
+	live.Rules = desired.Rules
+	mergeMeta(&desired.ObjectMeta, &live.ObjectMeta)
+	_, err = crc.Update(live)
+	return ActionUpdate, errors.Wrap(err, "unable to update clusterrole")
+}
+
+// ApplyClusterRoleBinding creates or updates a ClusterRoleBinding, recreating it if the
+// RoleRef has changed.
+func (r *Reconciler) ApplyClusterRoleBinding(desired *rbacv1.ClusterRoleBinding) (a Action, err error) {
+	defer func() { r.record(ObjectRef{Kind: "ClusterRoleBinding", Name: desired.Name}, a, err) }()
+	crbc := r.client.RbacV1().ClusterRoleBindings()
+	live, err := crbc.Get(desired.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = crbc.Create(desired)
+		return ActionCreate, errors.Wrap(err, "unable to create clusterrolebinding")
+	} else if err != nil {
+		return "", errors.Wrap(err, "unable to get clusterrolebinding")
+	}
+	if live.RoleRef != desired.RoleRef {
+		log.WithField("clusterrolebinding", desired.Name).Info("roleRef changed, recreating clusterrolebinding")
+		if err = crbc.Delete(desired.Name, &metav1.DeleteOptions{}); err != nil {
+			return ActionUpdate, errors.Wrap(err, "unable to delete clusterrolebinding for recreation")
+		}
+		_, err = crbc.Create(desired)
+		return ActionUpdate, errors.Wrap(err, "unable to recreate clusterrolebinding")
+	}
+	if equality.Semantic.DeepEqual(desired.Subjects, live.Subjects) && !metaDiffers(&desired.ObjectMeta, &live.ObjectMeta) {
+		return ActionUnchanged, nil
+	}
+	live.Subjects = desired.Subjects
+	mergeMeta(&desired.ObjectMeta, &live.ObjectMeta)
+	_, err = crbc.Update(live)
+	return ActionUpdate, errors.Wrap(err, "unable to update clusterrolebinding")
+}
@@ -0,0 +1,189 @@
+package k8s
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+func TestReconcilerNamespaced(t *testing.T) {
+	pc := &types.PermbotConfig{
+		Projects: []types.Project{
+			{
+				Namespace: "a",
+				Roles:     []types.RoleUsers{{Role: "execute", Users: []string{"alice"}}},
+			},
+		},
+		Roles: []types.Role{
+			{
+				Name:  "execute",
+				Rules: []types.Rule{{APIGroups: []string{""}, Resources: []string{"pods/exec"}, Verbs: []string{"create"}}},
+			},
+		},
+	}
+	cl := fake.NewSimpleClientset()
+	apply := func(rulesRef string) (Action, Action) {
+		rl, rb, err := CreateResourcesForNamespace(pc, "a", rulesRef, "permbot")
+		if err != nil {
+			t.Fatalf("CreateResourcesForNamespace() error = %v", err)
+		}
+		rec := NewReconciler(cl)
+		ra, err := rec.ApplyRole(&rl[0])
+		if err != nil {
+			t.Fatalf("ApplyRole() error = %v", err)
+		}
+		rba, err := rec.ApplyRoleBinding(&rb[0])
+		if err != nil {
+			t.Fatalf("ApplyRoleBinding() error = %v", err)
+		}
+		return ra, rba
+	}
+	steps := []struct {
+		name            string
+		change          func()
+		rulesRef        string
+		wantRole        Action
+		wantRoleBinding Action
+	}{
+		{name: "initial-create", wantRole: ActionCreate, wantRoleBinding: ActionCreate},
+		{name: "no-change", wantRole: ActionUnchanged, wantRoleBinding: ActionUnchanged},
+		{
+			name:            "add-user",
+			change:          func() { pc.Projects[0].Roles[0].Users = append(pc.Projects[0].Roles[0].Users, "bob") },
+			wantRole:        ActionUnchanged,
+			wantRoleBinding: ActionUpdate,
+		},
+		{
+			name:            "change-rules",
+			change:          func() { pc.Roles[0].Rules[0].Verbs = []string{"create", "get"} },
+			wantRole:        ActionUpdate,
+			wantRoleBinding: ActionUnchanged,
+		},
+		{name: "change-annotations", rulesRef: "abc123", wantRole: ActionUpdate, wantRoleBinding: ActionUpdate},
+	}
+	for _, st := range steps {
+		t.Run(st.name, func(t *testing.T) {
+			if st.change != nil {
+				st.change()
+			}
+			ra, rba := apply(st.rulesRef)
+			if ra != st.wantRole {
+				t.Errorf("ApplyRole() = %v, want %v", ra, st.wantRole)
+			}
+			if rba != st.wantRoleBinding {
+				t.Errorf("ApplyRoleBinding() = %v, want %v", rba, st.wantRoleBinding)
+			}
+		})
+	}
+	live, err := cl.RbacV1().RoleBindings("a").Get("permbot-auto-role-binding-execute", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unable to get rolebinding: %v", err)
+	}
+	if len(live.Subjects) != 2 {
+		t.Errorf("rolebinding has %d subjects, want 2", len(live.Subjects))
+	}
+}
+
+func TestReconcilerKeepsForeignMetadata(t *testing.T) {
+	desired := rbacv1.ClusterRole{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "permbot-auto-role-global-view",
+			Labels:      objectLabels("permbot"),
+			Annotations: objectAnnotations(""),
+		},
+	}
+	live := desired.DeepCopy()
+	live.Annotations["kubectl.kubernetes.io/last-applied-configuration"] = "{}"
+	cl := fake.NewSimpleClientset(live)
+	rec := NewReconciler(cl)
+	act, err := rec.ApplyClusterRole(&desired)
+	if err != nil {
+		t.Fatalf("ApplyClusterRole() error = %v", err)
+	}
+	if act != ActionUnchanged {
+		t.Errorf("ApplyClusterRole() = %v, want %v", act, ActionUnchanged)
+	}
+	if rec.Stats != (Stats{Unchanged: 1}) {
+		t.Errorf("Stats = %+v, want 1 unchanged", rec.Stats)
+	}
+}
+
+func TestReconcilerRecreatesOnRoleRefChange(t *testing.T) {
+	desired := rbacv1.ClusterRoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "permbot-auto-role-global-binding-view",
+			Labels: objectLabels("permbot"),
+		},
+		RoleRef: rbacv1.RoleRef{APIGroup: "rbac.authorization.k8s.io", Kind: "ClusterRole", Name: "permbot-auto-role-global-view"},
+	}
+	live := desired.DeepCopy()
+	live.RoleRef.Name = "something-else"
+	cl := fake.NewSimpleClientset(live)
+	rec := NewReconciler(cl)
+	act, err := rec.ApplyClusterRoleBinding(&desired)
+	if err != nil {
+		t.Fatalf("ApplyClusterRoleBinding() error = %v", err)
+	}
+	if act != ActionUpdate {
+		t.Errorf("ApplyClusterRoleBinding() = %v, want %v", act, ActionUpdate)
+	}
+	got, err := cl.RbacV1().ClusterRoleBindings().Get(desired.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unable to get clusterrolebinding: %v", err)
+	}
+	if got.RoleRef != desired.RoleRef {
+		t.Errorf("roleRef = %+v, want %+v", got.RoleRef, desired.RoleRef)
+	}
+}
+
+func TestApplyNamespace(t *testing.T) {
+	project := &types.Project{
+		Namespace:       "team",
+		CreateNamespace: true,
+		Labels:          map[string]string{"team": "xyzzy"},
+		Annotations:     map[string]string{"contact": "xyzzy@example.com"},
+	}
+	desired := CreateNamespace(project, "", "permbot")
+
+	// Missing namespaces are created with the owner label
+	cl := fake.NewSimpleClientset()
+	rec := NewReconciler(cl)
+	if act, err := rec.ApplyNamespace(&desired); err != nil || act != ActionCreate {
+		t.Fatalf("ApplyNamespace() = %v, %v, want %v", act, err, ActionCreate)
+	}
+	if act, err := rec.ApplyNamespace(&desired); err != nil || act != ActionUnchanged {
+		t.Fatalf("ApplyNamespace() again = %v, %v, want %v", act, err, ActionUnchanged)
+	}
+	live, err := cl.CoreV1().Namespaces().Get("team", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsOwnedBy(live, "permbot") || live.Labels["team"] != "xyzzy" || live.Annotations["contact"] != "xyzzy@example.com" {
+		t.Errorf("created namespace metadata = %v %v", live.Labels, live.Annotations)
+	}
+
+	// Existing namespaces only get the project's labels, so they can never be pruned
+	cl = fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team", Labels: map[string]string{"existing": "yes"}}})
+	rec = NewReconciler(cl)
+	if act, err := rec.ApplyNamespace(&desired); err != nil || act != ActionUpdate {
+		t.Fatalf("ApplyNamespace() existing = %v, %v, want %v", act, err, ActionUpdate)
+	}
+	if act, err := rec.ApplyNamespace(&desired); err != nil || act != ActionUnchanged {
+		t.Fatalf("ApplyNamespace() existing again = %v, %v, want %v", act, err, ActionUnchanged)
+	}
+	live, err = cl.CoreV1().Namespaces().Get("team", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, owned := live.Labels[ownerLabel]; owned {
+		t.Errorf("existing namespace was given owner label: %v", live.Labels)
+	}
+	if live.Labels["team"] != "xyzzy" || live.Labels["existing"] != "yes" {
+		t.Errorf("existing namespace labels = %v", live.Labels)
+	}
+}
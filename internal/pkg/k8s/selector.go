@@ -0,0 +1,182 @@
+package k8s
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+// HasSelectors reports whether any project uses a namespaceSelector
+func HasSelectors(pc *types.PermbotConfig) bool {
+	for i := range pc.Projects {
+		if pc.Projects[i].NamespaceSelector != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// namespaceMatcher matches namespaces against a compiled NamespaceSelector
+type namespaceMatcher struct {
+	glob   string
+	regex  *regexp.Regexp
+	labels labels.Selector
+}
+
+// newNamespaceMatcher compiles a selector, returning an error if it is invalid or empty
+func newNamespaceMatcher(sel *types.NamespaceSelector) (*namespaceMatcher, error) {
+	m := &namespaceMatcher{glob: sel.Glob}
+	if sel.Glob == "" && sel.Regex == "" && sel.Labels == "" {
+		return nil, errors.New("namespaceSelector must set glob, regex or labels")
+	}
+	if _, err := path.Match(sel.Glob, ""); err != nil {
+		return nil, errors.Wrapf(err, "bad namespaceSelector glob %q", sel.Glob)
+	}
+	if sel.Regex != "" {
+		var err error
+		if m.regex, err = regexp.Compile("^(?:" + sel.Regex + ")$"); err != nil {
+			return nil, errors.Wrapf(err, "bad namespaceSelector regex %q", sel.Regex)
+		}
+	}
+	if sel.Labels != "" {
+		var err error
+		if m.labels, err = labels.Parse(sel.Labels); err != nil {
+			return nil, errors.Wrapf(err, "bad namespaceSelector labels %q", sel.Labels)
+		}
+	}
+	return m, nil
+}
+
+func (m *namespaceMatcher) matches(ns *corev1.Namespace) bool {
+	if m.glob != "" {
+		if ok, _ := path.Match(m.glob, ns.Name); !ok {
+			return false
+		}
+	}
+	if m.regex != nil && !m.regex.MatchString(ns.Name) {
+		return false
+	}
+	if m.labels != nil && !m.labels.Matches(labels.Set(ns.Labels)) {
+		return false
+	}
+	return true
+}
+
+// ValidateSelector returns an error if a namespaceSelector is empty or invalid
+func ValidateSelector(sel *types.NamespaceSelector) error {
+	_, err := newNamespaceMatcher(sel)
+	return err
+}
+
+// SelectorMatches reports whether a namespaceSelector matches ns, returning an error if the
+// selector is empty or invalid
+func SelectorMatches(sel *types.NamespaceSelector, ns *corev1.Namespace) (bool, error) {
+	m, err := newNamespaceMatcher(sel)
+	if err != nil {
+		return false, err
+	}
+	return m.matches(ns), nil
+}
+
+// ResolveSelectors returns a copy of the config in which each project with a
+// namespaceSelector is replaced by a copy of it for every namespace it matches. Namespaces
+// which have a project of their own, or were matched by an earlier selector, are left to
+// that project. Terminating namespaces are never matched.
+func ResolveSelectors(pc *types.PermbotConfig, namespaces []corev1.Namespace) (*types.PermbotConfig, error) {
+	if !HasSelectors(pc) {
+		return pc, nil
+	}
+	out := *pc
+	out.Projects = nil
+	claimed := make(map[string]string)
+	for i := range pc.Projects {
+		if pc.Projects[i].NamespaceSelector == nil {
+			out.Projects = append(out.Projects, pc.Projects[i])
+			claimed[pc.Projects[i].Namespace] = "its own project"
+		}
+	}
+	sorted := append([]corev1.Namespace{}, namespaces...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	for i := range pc.Projects {
+		p := &pc.Projects[i]
+		if p.NamespaceSelector == nil {
+			continue
+		}
+		m, err := newNamespaceMatcher(p.NamespaceSelector)
+		if err != nil {
+			return nil, errors.Wrapf(err, "project[%d]", i)
+		}
+		for j := range sorted {
+			ns := &sorted[j]
+			if ns.Status.Phase == corev1.NamespaceTerminating || !m.matches(ns) {
+				continue
+			}
+			logger := log.WithFields(log.Fields{"namespace": ns.Name, "selector": p.NamespaceSelector.String()})
+			if by, ok := claimed[ns.Name]; ok {
+				logger.WithField("claimedBy", by).Debug("namespace matches selector, but is already claimed")
+				continue
+			}
+			claimed[ns.Name] = "an earlier namespaceSelector"
+			logger.Debug("namespace matches selector")
+			resolved := *p
+			resolved.Namespace = ns.Name
+			resolved.NamespaceSelector = nil
+			out.Projects = append(out.Projects, resolved)
+		}
+	}
+	return &out, nil
+}
+
+// ResolveClusterSelectors is ResolveSelectors against the namespaces in the cluster, which
+// are only listed if the config has any selectors
+func ResolveClusterSelectors(cl kubernetes.Interface, pc *types.PermbotConfig) (*types.PermbotConfig, error) {
+	if !HasSelectors(pc) {
+		return pc, nil
+	}
+	list, err := cl.CoreV1().Namespaces().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list namespaces")
+	}
+	return ResolveSelectors(pc, list.Items)
+}
+
+// ReadNamespaces reads a list of namespaces to resolve selectors against without a cluster.
+// The file is either JSON, as output by kubectl get namespaces -o json, or a list of
+// namespace names, one per line, in which case the namespaces have no labels.
+func ReadNamespaces(fn string) ([]corev1.Namespace, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open namespaces file")
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var list corev1.NamespaceList
+		if err := json.Unmarshal(trimmed, &list); err != nil {
+			return nil, errors.Wrapf(err, "unable to decode namespaces file %s", fn)
+		}
+		return list.Items, nil
+	}
+	var namespaces []corev1.Namespace
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		name := strings.TrimSpace(sc.Text())
+		if name == "" || strings.HasPrefix(name, "#") {
+			continue
+		}
+		namespaces = append(namespaces, corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}})
+	}
+	return namespaces, errors.Wrapf(sc.Err(), "unable to read namespaces file %s", fn)
+}
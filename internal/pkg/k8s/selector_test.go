@@ -0,0 +1,131 @@
+package k8s
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func namespace(name string, labels map[string]string) corev1.Namespace {
+	return corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+}
+
+func TestResolveSelectors(t *testing.T) {
+	terminating := namespace("review-gone", nil)
+	terminating.Status.Phase = corev1.NamespaceTerminating
+	namespaces := []corev1.Namespace{
+		namespace("review-2", map[string]string{"env": "review"}),
+		namespace("review-1", map[string]string{"env": "review"}),
+		namespace("review-own", nil),
+		namespace("team-a", map[string]string{"team": "a"}),
+		namespace("team-b", map[string]string{"team": "b", "env": "review"}),
+		namespace("other", nil),
+		terminating,
+	}
+	tests := []struct {
+		name     string
+		selector types.NamespaceSelector
+		want     []string
+	}{
+		{"glob", types.NamespaceSelector{Glob: "review-*"}, []string{"review-own", "review-1", "review-2"}},
+		{"regex", types.NamespaceSelector{Regex: "team-[ab]"}, []string{"review-own", "team-a", "team-b"}},
+		{"regex-whole-name", types.NamespaceSelector{Regex: "team"}, []string{"review-own"}},
+		{"labels", types.NamespaceSelector{Labels: "env=review"}, []string{"review-own", "review-1", "review-2", "team-b"}},
+		{"all-fields-match", types.NamespaceSelector{Glob: "team-*", Labels: "env=review"}, []string{"review-own", "team-b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sel := tt.selector
+			pc := &types.PermbotConfig{Projects: []types.Project{
+				{NamespaceSelector: &sel, Roles: []types.RoleUsers{{Role: "view", Users: []string{"{{ .Namespace }}-owner"}}}},
+				{Namespace: "review-own"},
+			}}
+			got, err := ResolveSelectors(pc, namespaces)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, p := range got.Projects {
+				if p.NamespaceSelector != nil {
+					t.Errorf("project %q still has a selector", p.Namespace)
+				}
+				names = append(names, p.Namespace)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("ResolveSelectors() namespaces = %v, want %v", names, tt.want)
+			}
+			if len(pc.Projects) != 2 || pc.Projects[0].NamespaceSelector == nil {
+				t.Errorf("ResolveSelectors() modified its input")
+			}
+		})
+	}
+}
+
+func TestResolveSelectorsFirstWins(t *testing.T) {
+	pc := &types.PermbotConfig{
+		Projects: []types.Project{
+			{NamespaceSelector: &types.NamespaceSelector{Glob: "team-*"}, Roles: []types.RoleUsers{{Role: "view", Users: []string{"{{ .Namespace }}-owner"}}}},
+			{NamespaceSelector: &types.NamespaceSelector{Glob: "*"}, Roles: []types.RoleUsers{{Role: "view", Users: []string{"everyone"}}}},
+		},
+		Roles: []types.Role{{Name: "view", Rules: []types.Rule{{Resources: []string{"pods"}, Verbs: []string{"get"}}}}},
+	}
+	cl := fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}}, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "b"}})
+	resolved, err := ResolveClusterSelectors(cl, pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := CreateDesiredState(resolved, "", "permbot", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subjects := make(map[string]string)
+	for _, rb := range ds.RoleBindings {
+		subjects[rb.Namespace] = rb.Subjects[0].Name
+	}
+	want := map[string]string{"team-a": "team-a-owner", "b": "everyone"}
+	if !reflect.DeepEqual(subjects, want) {
+		t.Errorf("subjects = %v, want %v", subjects, want)
+	}
+	// Unresolved selectors define nothing
+	if ds, err = CreateDesiredState(pc, "", "permbot", false, nil); err != nil || len(ds.RoleBindings) != 0 {
+		t.Errorf("CreateDesiredState() of unresolved selectors = %v, %v, want no bindings", ds.RoleBindings, err)
+	}
+}
+
+func TestReadNamespaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name    string
+		content string
+		want    []corev1.Namespace
+	}{
+		{"names", "# review apps\nreview-1\n\n  review-2  \n", []corev1.Namespace{namespace("review-1", nil), namespace("review-2", nil)}},
+		{"json", `{"apiVersion": "v1", "kind": "List", "items": [{"metadata": {"name": "a", "labels": {"env": "review"}}}]}`, []corev1.Namespace{namespace("a", map[string]string{"env": "review"})}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn := filepath.Join(dir, tt.name)
+			if err := ioutil.WriteFile(fn, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadNamespaces(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadNamespaces() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package k8s
+
+import (
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+// DesiredState is the complete set of RBAC objects produced from a configuration
+type DesiredState struct {
+	// Namespaces are created (if missing) before anything else, for projects which set
+	// createNamespace
+	Namespaces          []corev1.Namespace
+	Roles               []rbacv1.Role
+	RoleBindings        []rbacv1.RoleBinding
+	ClusterRoles        []rbacv1.ClusterRole
+	ClusterRoleBindings []rbacv1.ClusterRoleBinding
+	// projectNamespaces are the namespaces of every project in the config, including those
+	// skipped because their namespace doesn't exist, which are never orphans
+	projectNamespaces map[string]bool
+}
+
+// refs returns the set of all objects contained in the desired state
+func (ds *DesiredState) refs() map[ObjectRef]bool {
+	r := make(map[ObjectRef]bool)
+	for ns := range ds.projectNamespaces {
+		r[ObjectRef{Kind: "Namespace", Name: ns}] = true
+	}
+	for i := range ds.Namespaces {
+		r[ObjectRef{Kind: "Namespace", Name: ds.Namespaces[i].Name}] = true
+	}
+	for i := range ds.Roles {
+		r[ObjectRef{Kind: "Role", Namespace: ds.Roles[i].Namespace, Name: ds.Roles[i].Name}] = true
+		// a namespace still used by a project is never an orphan, even if the project no
+		// longer sets createNamespace
+		r[ObjectRef{Kind: "Namespace", Name: ds.Roles[i].Namespace}] = true
+	}
+	for i := range ds.RoleBindings {
+		r[ObjectRef{Kind: "RoleBinding", Namespace: ds.RoleBindings[i].Namespace, Name: ds.RoleBindings[i].Name}] = true
+		r[ObjectRef{Kind: "Namespace", Name: ds.RoleBindings[i].Namespace}] = true
+	}
+	for i := range ds.ClusterRoles {
+		r[ObjectRef{Kind: "ClusterRole", Name: ds.ClusterRoles[i].Name}] = true
+	}
+	for i := range ds.ClusterRoleBindings {
+		r[ObjectRef{Kind: "ClusterRoleBinding", Name: ds.ClusterRoleBindings[i].Name}] = true
+	}
+	return r
+}
+
+// NamespaceExists returns an includeNamespace function for CreateDesiredState which includes
+// the projects whose namespace exists in the cluster. Only a NotFound error means the
+// namespace is missing, any other error (e.g. a timeout) is returned, so that a project is
+// never dropped from the desired state (and its objects pruned) by mistake.
+func NamespaceExists(cl kubernetes.Interface) func(ns string) (bool, error) {
+	nsc := cl.CoreV1().Namespaces()
+	return func(ns string) (bool, error) {
+		_, err := nsc.Get(ns, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			log.WithField("namespace", ns).Warn("namespace doesn't exist - skipping project")
+			return false, nil
+		} else if err != nil {
+			return false, errors.Wrapf(err, "unable to get namespace %s", ns)
+		}
+		return true, nil
+	}
+}
+
+// CreateDesiredState returns every object defined by the configuration. Projects for which
+// includeNamespace returns false (e.g. because the namespace doesn't exist in the cluster)
+// are skipped, a nil includeNamespace includes every project. If includeNamespace returns
+// an error, so does CreateDesiredState. Projects with a namespaceSelector are skipped, so
+// must be resolved with ResolveSelectors first. Global resources are only included if
+// global is set.
+func CreateDesiredState(fromconfig *types.PermbotConfig, rulesRef, owner string, global bool, includeNamespace func(ns string) (bool, error)) (*DesiredState, error) {
+	// Merge once up front, rather than once per project
+	fromconfig, err := fromconfig.Merged()
+	if err != nil {
+		return nil, err
+	}
+	ds := &DesiredState{projectNamespaces: make(map[string]bool)}
+	for i := range fromconfig.Projects {
+		ns := fromconfig.Projects[i].Namespace
+		if fromconfig.Projects[i].NamespaceSelector != nil {
+			log.WithField("selector", fromconfig.Projects[i].NamespaceSelector.String()).Debug("skipping unresolved namespaceSelector for desired state")
+			continue
+		}
+		// a namespace is still wanted while a project uses it, even if the project has no
+		// objects in it or no longer sets createNamespace
+		ds.projectNamespaces[ns] = true
+		if fromconfig.Projects[i].CreateNamespace {
+			// the namespace will be created if it's missing
+			ds.Namespaces = append(ds.Namespaces, CreateNamespace(&fromconfig.Projects[i], rulesRef, owner))
+		} else if includeNamespace != nil {
+			include, err := includeNamespace(ns)
+			if err != nil {
+				return nil, err
+			}
+			if !include {
+				log.WithField("namespace", ns).Debug("skipping namespace for desired state")
+				continue
+			}
+		}
+		rl, rb, err := createResourcesForNamespace(fromconfig, ns, rulesRef, owner)
+		if err != nil {
+			return nil, err
+		}
+		ds.Roles = append(ds.Roles, rl...)
+		ds.RoleBindings = append(ds.RoleBindings, rb...)
+	}
+	if global {
+		crl, crb, err := createGlobalResources(fromconfig, rulesRef, owner)
+		if err != nil {
+			return nil, err
+		}
+		ds.ClusterRoles = crl
+		ds.ClusterRoleBindings = crb
+	}
+	return ds, nil
+}
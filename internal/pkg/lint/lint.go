@@ -0,0 +1,250 @@
+// Package lint flags roles in a permbot config which grant dangerous permissions, such as
+// reading secrets or creating RoleBindings, which can let a subject escalate its own access.
+package lint
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/k8s"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/query"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/validate"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+// Severity levels, which match SARIF's result levels
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Check describes one of the things the linter looks for
+type Check struct {
+	// ID is used to suppress findings with lintIgnore, e.g. PB001
+	ID          string
+	Name        string
+	Severity    string
+	Description string
+}
+
+// Checks is every check the linter makes, in ID order
+var Checks = []Check{
+	{"PB001", "SecretsRead", SeverityError, "Reading secrets exposes service account tokens and credentials, which can be used to act as other subjects"},
+	{"PB002", "EscalationVerbs", SeverityError, "The escalate, bind and impersonate verbs bypass RBAC's privilege escalation prevention"},
+	{"PB003", "Wildcard", SeverityWarning, "Wildcards grant access to every verb, resource or API group, including ones added in future"},
+	{"PB004", "PodExecSystem", SeverityError, "Exec into pods in kube-system (or in every namespace) gives access to the credentials of cluster components"},
+	{"PB005", "BindingWrite", SeverityWarning, "Creating or changing RoleBindings lets a subject grant the roles it holds to others, or more with the bind verb"},
+}
+
+func check(id string) Check {
+	for _, c := range Checks {
+		if c.ID == id {
+			return c
+		}
+	}
+	panic("unknown lint check " + id)
+}
+
+// Finding is a single dangerous permission found in a config
+type Finding struct {
+	validate.Problem
+	RuleID   string `json:"ruleId"`
+	Severity string `json:"severity"`
+	// Suppressed is set for findings listed in the lintIgnore of the rule or its role
+	Suppressed bool `json:"suppressed,omitempty"`
+}
+
+// String formats the finding as file:line: path: severity ID: message
+func (f Finding) String() string {
+	p := f.Problem
+	p.Message = fmt.Sprintf("%s %s: %s", f.Severity, f.RuleID, p.Message)
+	return p.String()
+}
+
+var (
+	rbacGroup = rbacv1.GroupName
+	secrets   = query.Resource{Resource: "secrets"}
+	podExec   = query.Resource{Resource: "pods", Subresource: "exec"}
+	// escalation maps each escalation verb to the resources it is dangerous on
+	escalation = []struct {
+		verb      string
+		resources []query.Resource
+	}{
+		{"escalate", []query.Resource{{Resource: "roles", Group: rbacGroup}, {Resource: "clusterroles", Group: rbacGroup}}},
+		{"bind", []query.Resource{{Resource: "roles", Group: rbacGroup}, {Resource: "clusterroles", Group: rbacGroup}}},
+		{"impersonate", []query.Resource{{Resource: "users"}, {Resource: "groups"}, {Resource: "serviceaccounts"}}},
+	}
+	bindings = []query.Resource{{Resource: "rolebindings", Group: rbacGroup}, {Resource: "clusterrolebindings", Group: rbacGroup}}
+	// kubeSystem is matched against namespaceSelectors, with the label Kubernetes gives every
+	// namespace with its name, as its other labels can't be known without a cluster
+	kubeSystem = &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:   "kube-system",
+		Labels: map[string]string{"kubernetes.io/metadata.name": "kube-system"},
+	}}
+)
+
+// inKubeSystem reports whether a project applies to kube-system, either by name or through
+// a namespaceSelector. Invalid selectors are left to validate mode.
+func inKubeSystem(p *types.Project) bool {
+	if p.NamespaceSelector == nil {
+		return p.Namespace == kubeSystem.Name
+	}
+	ok, err := k8s.SelectorMatches(p.NamespaceSelector, kubeSystem)
+	return err == nil && ok
+}
+
+// allowed returns those of verbs which the rule allows on any of resources
+func allowed(rule *rbacv1.PolicyRule, verbs []string, resources ...query.Resource) (out []string) {
+	for _, v := range verbs {
+		for _, res := range resources {
+			if query.Allows(rule, v, res) {
+				out = append(out, v)
+				break
+			}
+		}
+	}
+	return
+}
+
+// Config lints every rule of every role in a decoded config. Findings returned have a Path
+// but no File or Line.
+func Config(pc *types.PermbotConfig) (findings []Finding) {
+	// Roles are bound cluster-wide if any role of the same name (there may be several when
+	// duplicates are merged) has global subjects, and in kube-system if a project there (or
+	// with a namespaceSelector matching it) uses them
+	global := make(map[string]bool)
+	for i := range pc.Roles {
+		r := &pc.Roles[i]
+		if len(r.GlobalUsers) > 0 || len(r.GlobalGroups) > 0 || len(r.GlobalServiceAccounts) > 0 {
+			global[r.Name] = true
+		}
+	}
+	system := make(map[string]bool)
+	for i := range pc.Projects {
+		if inKubeSystem(&pc.Projects[i]) {
+			for _, ru := range pc.Projects[i].Roles {
+				system[ru.Role] = true
+			}
+		}
+	}
+	// The rules of extended roles are also bound wherever the roles extending them are
+	extends := make(map[string][]string)
+	for i := range pc.Roles {
+		extends[pc.Roles[i].Name] = append(extends[pc.Roles[i].Name], pc.Roles[i].Extends...)
+	}
+	for _, used := range []map[string]bool{global, system} {
+		var mark func(name string)
+		mark = func(name string) {
+			for _, parent := range extends[name] {
+				if !used[parent] {
+					used[parent] = true
+					mark(parent)
+				}
+			}
+		}
+		// Parents marked while ranging are already marked recursively, so it doesn't matter
+		// whether the range visits them
+		for name := range used {
+			mark(name)
+		}
+	}
+	for i := range pc.Roles {
+		r := &pc.Roles[i]
+		if r.ClusterRole != "" {
+			// Rules are ignored for roles which bind to an existing ClusterRole
+			continue
+		}
+		for j := range r.Rules {
+			rule := &r.Rules[j]
+			path := fmt.Sprintf("role[%d].rules[%d]", i, j)
+			add := func(id, format string, args ...interface{}) {
+				c := check(id)
+				findings = append(findings, Finding{
+					Problem:    validate.Problem{Path: path, Message: fmt.Sprintf(format, args...)},
+					RuleID:     c.ID,
+					Severity:   c.Severity,
+					Suppressed: has(r.LintIgnore, id) || has(rule.LintIgnore, id),
+				})
+			}
+			pr := &rbacv1.PolicyRule{
+				APIGroups:       rule.APIGroups,
+				Resources:       rule.Resources,
+				ResourceNames:   rule.ResourceNames,
+				NonResourceURLs: rule.NonResourceURLs,
+				Verbs:           rule.Verbs,
+			}
+			if vs := allowed(pr, []string{"get", "list", "watch"}, secrets); len(vs) > 0 {
+				add("PB001", "role %q can read secrets (%s)", r.Name, strings.Join(vs, ", "))
+			}
+			for _, e := range escalation {
+				if vs := allowed(pr, []string{e.verb}, e.resources...); len(vs) > 0 {
+					add("PB002", "role %q has the %s verb", r.Name, e.verb)
+				}
+			}
+			var wild []string
+			for _, f := range []struct {
+				name string
+				list []string
+			}{{"apiGroups", rule.APIGroups}, {"resources", rule.Resources}, {"verbs", rule.Verbs}, {"nonResourceURLs", rule.NonResourceURLs}} {
+				if has(f.list, "*") {
+					wild = append(wild, f.name)
+				}
+			}
+			if len(wild) > 0 {
+				add("PB003", "role %q uses a * wildcard in %s", r.Name, strings.Join(wild, ", "))
+			}
+			if len(allowed(pr, []string{"create"}, podExec)) > 0 {
+				switch {
+				case global[r.Name]:
+					add("PB004", "role %q can exec into pods and is bound cluster-wide, including kube-system", r.Name)
+				case system[r.Name]:
+					add("PB004", "role %q can exec into pods and is used in kube-system", r.Name)
+				}
+			}
+			if vs := allowed(pr, []string{"create", "update", "patch"}, bindings...); len(vs) > 0 {
+				add("PB005", "role %q can change role bindings (%s)", r.Name, strings.Join(vs, ", "))
+			}
+		}
+	}
+	return
+}
+
+func has(list []string, v string) bool {
+	for _, l := range list {
+		if l == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Files lints several config files as a single combined config, as they are loaded by
+// permbot, reporting findings against the file and line each rule came from. An error is
+// only returned if a file can't be read or parsed at all.
+func Files(fns []string) ([]Finding, error) {
+	src, err := validate.Load(fns)
+	if err != nil {
+		return nil, err
+	}
+	findings := Config(&src.Config)
+	for i := range findings {
+		findings[i].Problem = src.Locate(findings[i].Problem)
+	}
+	order := make(map[string]int, len(fns))
+	for i, fn := range fns {
+		order[fn] = i
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		a, b := findings[i], findings[j]
+		if a.File != b.File {
+			return order[a.File] < order[b.File]
+		}
+		return a.Line < b.Line
+	})
+	return findings, nil
+}
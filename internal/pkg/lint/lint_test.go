@@ -0,0 +1,144 @@
+package lint
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+const dangerousConfig = `[[role]]
+name = "admin"
+globalUsers = ["root"]
+
+[[role.rules]]
+apiGroups = ["*"]
+resources = ["*"]
+verbs = ["*"]
+lintIgnore = ["PB003"]
+
+[[role]]
+name = "debug"
+
+[[role.rules]]
+apiGroups = [""]
+resources = ["pods/exec", "secrets"]
+verbs = ["create", "get"]
+
+[[role.rules]]
+apiGroups = ["rbac.authorization.k8s.io"]
+resources = ["rolebindings"]
+verbs = ["create", "delete"]
+
+[[role]]
+name = "safe"
+lintIgnore = ["PB001"]
+
+[[role.rules]]
+apiGroups = [""]
+resources = ["pods", "secrets"]
+verbs = ["list"]
+
+[[project]]
+namespace = "kube-system"
+
+[[project.roles]]
+role = "debug"
+users = ["alice"]
+`
+
+func TestFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permbot-lint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "permbot.toml")
+	if err := ioutil.WriteFile(fn, []byte(dangerousConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	findings, err := Files([]string{fn})
+	if err != nil {
+		t.Fatalf("Files() error = %v", err)
+	}
+	var got []string
+	for _, f := range findings {
+		s := f.String()[len(dir)+1:]
+		if f.Suppressed {
+			s += " (suppressed)"
+		}
+		got = append(got, s)
+	}
+	want := []string{
+		`permbot.toml:5: role[0].rules[0]: error PB001: role "admin" can read secrets (get, list, watch)`,
+		`permbot.toml:5: role[0].rules[0]: error PB002: role "admin" has the escalate verb`,
+		`permbot.toml:5: role[0].rules[0]: error PB002: role "admin" has the bind verb`,
+		`permbot.toml:5: role[0].rules[0]: error PB002: role "admin" has the impersonate verb`,
+		`permbot.toml:5: role[0].rules[0]: warning PB003: role "admin" uses a * wildcard in apiGroups, resources, verbs (suppressed)`,
+		`permbot.toml:5: role[0].rules[0]: error PB004: role "admin" can exec into pods and is bound cluster-wide, including kube-system`,
+		`permbot.toml:5: role[0].rules[0]: warning PB005: role "admin" can change role bindings (create, update, patch)`,
+		`permbot.toml:14: role[1].rules[0]: error PB001: role "debug" can read secrets (get)`,
+		`permbot.toml:14: role[1].rules[0]: error PB004: role "debug" can exec into pods and is used in kube-system`,
+		`permbot.toml:19: role[1].rules[1]: warning PB005: role "debug" can change role bindings (create)`,
+		`permbot.toml:28: role[2].rules[0]: error PB001: role "safe" can read secrets (list) (suppressed)`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Files() findings:\n%v\nwant:\n%v", got, want)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteSARIF(&buf, findings, "test"); err != nil {
+		t.Fatalf("WriteSARIF() error = %v", err)
+	}
+	var log sarifLog
+	if err := json.Unmarshal(buf.Bytes(), &log); err != nil {
+		t.Fatalf("WriteSARIF() wrote invalid JSON: %v", err)
+	}
+	results := log.Runs[0].Results
+	if log.Version != "2.1.0" || len(log.Runs[0].Tool.Driver.Rules) != len(Checks) || len(results) != len(findings) {
+		t.Fatalf("WriteSARIF() = %s", buf.String())
+	}
+	last := results[len(results)-1]
+	if last.RuleID != "PB001" || Checks[last.RuleIndex].ID != "PB001" || last.Level != "error" || len(last.Suppressions) != 1 {
+		t.Errorf("WriteSARIF() last result = %+v", last)
+	}
+	loc := last.Locations[0].PhysicalLocation
+	if loc.ArtifactLocation.URI != filepath.ToSlash(fn) || loc.Region.StartLine != 28 {
+		t.Errorf("WriteSARIF() last location = %+v", loc)
+	}
+}
+
+func TestConfigKubeSystemSelector(t *testing.T) {
+	tests := []struct {
+		name string
+		sel  types.NamespaceSelector
+		want bool
+	}{
+		{"glob", types.NamespaceSelector{Glob: "kube-*"}, true},
+		{"regex", types.NamespaceSelector{Regex: "kube-(system|public)"}, true},
+		{"name label", types.NamespaceSelector{Labels: "kubernetes.io/metadata.name in (kube-system)"}, true},
+		{"other namespaces", types.NamespaceSelector{Glob: "review-*"}, false},
+		{"other labels", types.NamespaceSelector{Labels: "env=review"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sel := tt.sel
+			pc := &types.PermbotConfig{
+				Roles:    []types.Role{{Name: "debug", Rules: []types.Rule{{APIGroups: []string{""}, Resources: []string{"pods/exec"}, Verbs: []string{"create"}}}}},
+				Projects: []types.Project{{NamespaceSelector: &sel, Roles: []types.RoleUsers{{Role: "debug", Users: []string{"alice"}}}}},
+			}
+			got := false
+			for _, f := range Config(pc) {
+				got = got || f.RuleID == "PB004"
+			}
+			if got != tt.want {
+				t.Errorf("Config() PB004 for selector %s = %v, want %v", sel.String(), got, tt.want)
+			}
+		})
+	}
+}
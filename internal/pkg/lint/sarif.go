@@ -0,0 +1,114 @@
+package lint
+
+import (
+	"encoding/json"
+	"io"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// The subset of SARIF 2.1.0 (https://docs.oasis-open.org/sarif/sarif/v2.1.0/) needed to
+// report findings to code review tools
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name    string      `json:"name"`
+	Version string      `json:"version,omitempty"`
+	Rules   []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID                   string       `json:"id"`
+	Name                 string       `json:"name"`
+	ShortDescription     sarifMessage `json:"shortDescription"`
+	DefaultConfiguration struct {
+		Level string `json:"level"`
+	} `json:"defaultConfiguration"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID       string             `json:"ruleId"`
+	RuleIndex    int                `json:"ruleIndex"`
+	Level        string             `json:"level"`
+	Message      sarifMessage       `json:"message"`
+	Locations    []sarifLocation    `json:"locations,omitempty"`
+	Suppressions []sarifSuppression `json:"suppressions,omitempty"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+		Region *sarifRegion `json:"region,omitempty"`
+	} `json:"physicalLocation"`
+}
+
+type sarifRegion struct {
+	StartLine int `json:"startLine"`
+}
+
+type sarifSuppression struct {
+	Kind string `json:"kind"`
+}
+
+// WriteSARIF writes the findings as a SARIF log, with suppressed findings marked as
+// suppressed in source rather than left out. version is the version of permbot.
+func WriteSARIF(w io.Writer, findings []Finding, version string) error {
+	driver := sarifDriver{Name: "permbot", Version: version}
+	index := make(map[string]int, len(Checks))
+	for i, c := range Checks {
+		r := sarifRule{ID: c.ID, Name: c.Name, ShortDescription: sarifMessage{c.Description}}
+		r.DefaultConfiguration.Level = c.Severity
+		driver.Rules = append(driver.Rules, r)
+		index[c.ID] = i
+	}
+	results := []sarifResult{}
+	for _, f := range findings {
+		res := sarifResult{
+			RuleID:    f.RuleID,
+			RuleIndex: index[f.RuleID],
+			Level:     f.Severity,
+			Message:   sarifMessage{f.Path + ": " + f.Message},
+		}
+		if f.File != "" {
+			var loc sarifLocation
+			loc.PhysicalLocation.ArtifactLocation.URI = filepath.ToSlash(f.File)
+			if f.Line > 0 {
+				loc.PhysicalLocation.Region = &sarifRegion{StartLine: f.Line}
+			}
+			res.Locations = []sarifLocation{loc}
+		}
+		if f.Suppressed {
+			res.Suppressions = []sarifSuppression{{Kind: "inSource"}}
+		}
+		results = append(results, res)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{{Tool: sarifTool{Driver: driver}, Results: results}},
+	})
+	return errors.Wrap(err, "unable to write SARIF")
+}
@@ -0,0 +1,248 @@
+// Package metrics records the results of reconcile runs and exposes them in the Prometheus
+// text format on /metrics, or writes them to a file at the end of one-shot runs. It is
+// deliberately small rather than pulling in the Prometheus client library, as permbot only
+// needs a handful of counters, gauges and one histogram.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/k8s"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the reconcile duration histogram
+var durationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// objectActions maps reconciler actions to the action label of permbot_objects_total
+var objectActions = map[k8s.Action]string{
+	k8s.ActionCreate: "created",
+	k8s.ActionUpdate: "updated",
+	k8s.ActionDelete: "pruned",
+}
+
+type objectKey struct {
+	action, kind, namespace string
+}
+
+type roleKey struct {
+	role, namespace string
+}
+
+// Metrics holds the current value of every metric. All methods are safe to call on a nil
+// *Metrics, which does nothing, so callers don't need to check whether metrics are enabled.
+type Metrics struct {
+	mu           sync.Mutex
+	objects      map[objectKey]float64
+	reconciles   map[string]float64
+	buckets      []float64
+	durationSum  float64
+	durationN    float64
+	lastSuccess  float64
+	roleSubjects map[roleKey]float64
+	drift        float64
+}
+
+// New creates an empty set of metrics
+func New() *Metrics {
+	return &Metrics{
+		objects:      make(map[objectKey]float64),
+		reconciles:   make(map[string]float64),
+		buckets:      make([]float64, len(durationBuckets)),
+		roleSubjects: make(map[roleKey]float64),
+	}
+}
+
+// ObjectApplied records the result of applying an object, it can be used as a
+// k8s.Reconciler Observer. Unchanged objects aren't counted.
+func (m *Metrics) ObjectApplied(ref k8s.ObjectRef, a k8s.Action, err error) {
+	if m == nil {
+		return
+	}
+	action, ok := objectActions[a]
+	if err != nil {
+		action = "failed"
+	} else if !ok {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[objectKey{action: action, kind: ref.Kind, namespace: ref.Namespace}]++
+}
+
+// ObjectsPruned records the result of pruning orphans, of which only pruned were deleted
+func (m *Metrics) ObjectsPruned(orphans, pruned []k8s.ObjectRef) {
+	if m == nil {
+		return
+	}
+	done := make(map[k8s.ObjectRef]bool, len(pruned))
+	for _, o := range pruned {
+		done[o] = true
+	}
+	for _, o := range orphans {
+		var err error
+		if !done[o] {
+			err = errors.New("not pruned")
+		}
+		m.ObjectApplied(o, k8s.ActionDelete, err)
+	}
+}
+
+// ReconcileDone records a complete reconcile run which took d
+func (m *Metrics) ReconcileDone(d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	secs := d.Seconds()
+	for i, le := range durationBuckets {
+		if secs <= le {
+			m.buckets[i]++
+		}
+	}
+	m.durationSum += secs
+	m.durationN++
+	if err != nil {
+		m.reconciles["failure"]++
+		return
+	}
+	m.reconciles["success"]++
+	m.lastSuccess = float64(time.Now().UnixNano()) / 1e9
+}
+
+// SetRoleSubjects records the number of subjects bound to each role by the config, per
+// project namespace and for global bindings (with an empty namespace). Subjects whose grant
+// has expired aren't bound, so aren't counted.
+func (m *Metrics) SetRoleSubjects(pc *types.PermbotConfig) {
+	if m == nil {
+		return
+	}
+	now := time.Now()
+	counts := make(map[roleKey]float64)
+	for _, r := range pc.Roles {
+		if n := len(r.GlobalUsers) + len(r.GlobalGroups) + len(r.GlobalServiceAccounts); n > 0 {
+			counts[roleKey{role: r.Name}] += float64(n)
+		}
+	}
+	for _, p := range pc.Projects {
+		for i := range p.Roles {
+			ru := &p.Roles[i]
+			n := len(ru.Active(ru.Users, now)) + len(ru.Active(ru.Groups, now)) + len(ru.Active(ru.ServiceAccounts, now))
+			counts[roleKey{role: ru.Role, namespace: p.Namespace}] += float64(n)
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.roleSubjects = counts
+}
+
+// SetDrift records the number of objects found to differ from the config
+func (m *Metrics) SetDrift(n int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.drift = float64(n)
+}
+
+// escape escapes a label value for the text format
+func escape(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// series is a single line of output, with its labels already formatted
+type series struct {
+	labels string
+	value  float64
+}
+
+func writeMetric(w io.Writer, name, typ, help string, ss []series) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	sort.SliceStable(ss, func(i, j int) bool { return ss[i].labels < ss[j].labels })
+	for _, s := range ss {
+		if s.labels != "" {
+			fmt.Fprintf(w, "%s{%s} %s\n", name, s.labels, formatValue(s.value))
+		} else {
+			fmt.Fprintf(w, "%s %s\n", name, formatValue(s.value))
+		}
+	}
+}
+
+// WriteText writes every metric in the Prometheus text exposition format
+func (m *Metrics) WriteText(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ss []series
+	for k, v := range m.objects {
+		ss = append(ss, series{fmt.Sprintf(`action="%s",kind="%s",namespace="%s"`, k.action, k.kind, escape(k.namespace)), v})
+	}
+	writeMetric(w, "permbot_objects_total", "counter", "RBAC objects created, updated, pruned or failed, by kind and namespace.", ss)
+
+	ss = nil
+	for _, result := range []string{"success", "failure"} {
+		ss = append(ss, series{fmt.Sprintf(`result="%s"`, result), m.reconciles[result]})
+	}
+	writeMetric(w, "permbot_reconciles_total", "counter", "Completed reconcile runs, by result.", ss)
+
+	fmt.Fprintf(w, "# HELP permbot_reconcile_duration_seconds Time taken by reconcile runs.\n# TYPE permbot_reconcile_duration_seconds histogram\n")
+	for i, le := range durationBuckets {
+		fmt.Fprintf(w, "permbot_reconcile_duration_seconds_bucket{le=\"%s\"} %s\n", formatValue(le), formatValue(m.buckets[i]))
+	}
+	fmt.Fprintf(w, "permbot_reconcile_duration_seconds_bucket{le=\"+Inf\"} %s\n", formatValue(m.durationN))
+	fmt.Fprintf(w, "permbot_reconcile_duration_seconds_sum %s\n", formatValue(m.durationSum))
+	fmt.Fprintf(w, "permbot_reconcile_duration_seconds_count %s\n", formatValue(m.durationN))
+
+	writeMetric(w, "permbot_last_success_timestamp_seconds", "gauge", "Unix time of the last successful reconcile run.", []series{{value: m.lastSuccess}})
+
+	ss = nil
+	for k, v := range m.roleSubjects {
+		ss = append(ss, series{fmt.Sprintf(`namespace="%s",role="%s"`, escape(k.namespace), escape(k.role)), v})
+	}
+	writeMetric(w, "permbot_role_subjects", "gauge", "Subjects bound to each role by the config, by namespace (empty for global bindings).", ss)
+
+	writeMetric(w, "permbot_drift_objects", "gauge", "Objects which differed from the config in the last run.", []series{{value: m.drift}})
+}
+
+// WriteFile writes every metric to the file fn in the Prometheus text format, e.g. for
+// node_exporter's textfile collector. The file is replaced atomically, so it is never
+// scraped half-written.
+func (m *Metrics) WriteFile(fn string) error {
+	var buf bytes.Buffer
+	m.WriteText(&buf)
+	tmp := fn + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return errors.Wrap(err, "unable to write metrics")
+	}
+	return errors.Wrap(os.Rename(tmp, fn), "unable to write metrics")
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteText(w)
+}
+
+// Serve listens on addr, serving the metrics on /metrics. It only returns on error.
+func (m *Metrics) Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	return http.ListenAndServe(addr, mux)
+}
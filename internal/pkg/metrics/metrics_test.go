@@ -0,0 +1,119 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/k8s"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+func TestMetrics(t *testing.T) {
+	m := New()
+	rb := k8s.ObjectRef{Kind: "RoleBinding", Namespace: "a", Name: "permbot-auto-role-binding-execute"}
+	m.ObjectApplied(rb, k8s.ActionCreate, nil)
+	m.ObjectApplied(rb, k8s.ActionUpdate, nil)
+	m.ObjectApplied(rb, k8s.ActionUnchanged, nil)
+	m.ObjectApplied(k8s.ObjectRef{Kind: "ClusterRole", Name: "x"}, k8s.ActionCreate, errors.New("forbidden"))
+	orphans := []k8s.ObjectRef{{Kind: "Role", Namespace: "gone", Name: "r"}, {Kind: "Role", Namespace: "stuck", Name: "r"}}
+	m.ObjectsPruned(orphans, orphans[:1])
+	m.ReconcileDone(300*time.Millisecond, nil)
+	m.ReconcileDone(2*time.Second, errors.New("failed"))
+	m.SetRoleSubjects(&types.PermbotConfig{
+		Projects: []types.Project{{Namespace: "a", Roles: []types.RoleUsers{{
+			Role:   "execute",
+			Users:  []string{"alice", "bob", "dave"},
+			Groups: []string{"devs"},
+			// dave's grant has expired, so isn't bound any more
+			Expires: map[string]time.Time{"bob": time.Now().Add(time.Hour), "dave": time.Now().Add(-time.Hour)},
+		}}}},
+		Roles: []types.Role{{Name: "view", GlobalUsers: []string{"carol"}}},
+	})
+	m.SetDrift(4)
+
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	for _, want := range []string{
+		"# TYPE permbot_objects_total counter",
+		`permbot_objects_total{action="created",kind="RoleBinding",namespace="a"} 1`,
+		`permbot_objects_total{action="updated",kind="RoleBinding",namespace="a"} 1`,
+		`permbot_objects_total{action="failed",kind="ClusterRole",namespace=""} 1`,
+		`permbot_objects_total{action="pruned",kind="Role",namespace="gone"} 1`,
+		`permbot_objects_total{action="failed",kind="Role",namespace="stuck"} 1`,
+		`permbot_reconciles_total{result="success"} 1`,
+		`permbot_reconciles_total{result="failure"} 1`,
+		`permbot_reconcile_duration_seconds_bucket{le="0.25"} 0`,
+		`permbot_reconcile_duration_seconds_bucket{le="0.5"} 1`,
+		`permbot_reconcile_duration_seconds_bucket{le="2.5"} 2`,
+		`permbot_reconcile_duration_seconds_bucket{le="+Inf"} 2`,
+		`permbot_reconcile_duration_seconds_sum 2.3`,
+		`permbot_reconcile_duration_seconds_count 2`,
+		`permbot_role_subjects{namespace="a",role="execute"} 3`,
+		`permbot_role_subjects{namespace="",role="view"} 1`,
+		`permbot_drift_objects 4`,
+	} {
+		if !strings.Contains(string(body), want+"\n") {
+			t.Errorf("metrics missing %q, got:\n%s", want, body)
+		}
+	}
+	if strings.Contains(string(body), `action="unchanged"`) {
+		t.Errorf("unchanged objects should not be counted")
+	}
+	if strings.Contains(string(body), "permbot_last_success_timestamp_seconds 0\n") {
+		t.Errorf("last success timestamp not set")
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permbot-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := New()
+	m.SetDrift(3)
+	fn := filepath.Join(dir, "permbot.prom")
+	for i := 0; i < 2; i++ {
+		if err := m.WriteFile(fn); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "\npermbot_drift_objects 3\n") {
+		t.Errorf("WriteFile() wrote:\n%s", data)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("WriteFile() left %d files, want just the metrics", len(files))
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+	m.ObjectApplied(k8s.ObjectRef{Kind: "Role"}, k8s.ActionCreate, nil)
+	m.ObjectsPruned([]k8s.ObjectRef{{Kind: "Role"}}, nil)
+	m.ReconcileDone(time.Second, nil)
+	m.SetRoleSubjects(&types.PermbotConfig{})
+	m.SetDrift(1)
+}
@@ -0,0 +1,210 @@
+// Package notify sends the changes made by a reconcile run to chat services and webhooks.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/k8s"
+)
+
+// ChangeSet describes everything a single reconcile run changed in the cluster
+type ChangeSet struct {
+	Version  string          `json:"version"`
+	Owner    string          `json:"owner"`
+	RulesRef string          `json:"rulesRef,omitempty"`
+	Time     time.Time       `json:"time"`
+	Changes  []k8s.Change    `json:"changes"`
+	Summary  k8s.PlanSummary `json:"summary"`
+}
+
+// Notifier is implemented by anything which can be told about a change set
+type Notifier interface {
+	Notify(cs *ChangeSet) error
+}
+
+// DefaultTemplate is used to format messages when no other template is given. It is a
+// text/template executed with the ChangeSet, with the extra functions subject and rule to
+// format rbacv1.Subjects and rbacv1.PolicyRules.
+const DefaultTemplate = `permbot ({{ .Owner }}{{ if .RulesRef }} @ {{ .RulesRef }}{{ end }}): {{ .Summary.Create }} created, {{ .Summary.Update }} updated, {{ .Summary.Delete }} pruned
+{{ range .Changes }}
+* {{ .Action }} {{ .Object }}
+{{- if .RoleRefTo }}
+    roleRef {{ .RoleRefFrom.Kind }}/{{ .RoleRefFrom.Name }} -> {{ .RoleRefTo.Kind }}/{{ .RoleRefTo.Name }}
+{{- end }}
+{{- range .SubjectsAdded }}
+    + {{ subject . }}
+{{- end }}
+{{- range .SubjectsRemoved }}
+    - {{ subject . }}
+{{- end }}
+{{- range .RulesAdded }}
+    + rule {{ rule . }}
+{{- end }}
+{{- range .RulesRemoved }}
+    - rule {{ rule . }}
+{{- end }}
+{{- end }}
+`
+
+// NewTemplate parses a message template, see DefaultTemplate
+func NewTemplate(text string) (*template.Template, error) {
+	t, err := template.New("message").Funcs(template.FuncMap{
+		"subject": k8s.FormatSubject,
+		"rule":    k8s.FormatRule,
+	}).Parse(text)
+	return t, errors.Wrap(err, "unable to parse notification template")
+}
+
+var defaultTemplate = template.Must(NewTemplate(DefaultTemplate))
+
+// render formats the change set with tmpl, or the default template if tmpl is nil
+func render(tmpl *template.Template, cs *ChangeSet) (string, error) {
+	if tmpl == nil {
+		tmpl = defaultTemplate
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, cs); err != nil {
+		return "", errors.Wrap(err, "unable to render notification")
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// defaultClient is used by notifiers without a Client. It has a timeout, so that a webhook
+// which never responds can't hold up reconciling.
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// postJSON posts payload as JSON to url, treating any non-2xx response as an error
+func postJSON(client *http.Client, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode notification")
+	}
+	if client == nil {
+		client = defaultClient
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "unable to send notification")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.Errorf("notification rejected with %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// Slack posts messages to a Slack incoming webhook
+type Slack struct {
+	URL      string
+	Template *template.Template
+	Client   *http.Client
+}
+
+// NewSlack creates a Slack notifier for the incoming webhook url
+func NewSlack(url string, tmpl *template.Template) *Slack {
+	return &Slack{URL: url, Template: tmpl}
+}
+
+// Notify implements Notifier
+func (s *Slack) Notify(cs *ChangeSet) error {
+	text, err := render(s.Template, cs)
+	if err != nil {
+		return err
+	}
+	return postJSON(s.Client, s.URL, map[string]string{"text": text})
+}
+
+// Teams posts messages to a Microsoft Teams incoming webhook as a MessageCard
+type Teams struct {
+	URL      string
+	Template *template.Template
+	Client   *http.Client
+}
+
+// NewTeams creates a Teams notifier for the incoming webhook url
+func NewTeams(url string, tmpl *template.Template) *Teams {
+	return &Teams{URL: url, Template: tmpl}
+}
+
+// teamsCard is the subset of the MessageCard format used for notifications
+type teamsCard struct {
+	Type    string `json:"@type"`
+	Context string `json:"@context"`
+	Summary string `json:"summary"`
+	Text    string `json:"text"`
+}
+
+// Notify implements Notifier
+func (t *Teams) Notify(cs *ChangeSet) error {
+	text, err := render(t.Template, cs)
+	if err != nil {
+		return err
+	}
+	return postJSON(t.Client, t.URL, teamsCard{
+		Type:    "MessageCard",
+		Context: "https://schema.org/extensions",
+		Summary: "permbot changes",
+		// Teams renders text as markdown, where a single newline doesn't break the line
+		Text: strings.Replace(text, "\n", "\n\n", -1),
+	})
+}
+
+// Webhook posts the complete change set as JSON, along with the rendered message
+type Webhook struct {
+	URL      string
+	Template *template.Template
+	Client   *http.Client
+}
+
+// NewWebhook creates a generic JSON webhook notifier for url
+func NewWebhook(url string, tmpl *template.Template) *Webhook {
+	return &Webhook{URL: url, Template: tmpl}
+}
+
+// webhookPayload is the body posted by Webhook
+type webhookPayload struct {
+	*ChangeSet
+	Message string `json:"message"`
+}
+
+// Notify implements Notifier
+func (w *Webhook) Notify(cs *ChangeSet) error {
+	text, err := render(w.Template, cs)
+	if err != nil {
+		return err
+	}
+	return postJSON(w.Client, w.URL, webhookPayload{ChangeSet: cs, Message: text})
+}
+
+// All sends the change set to every notifier, logging any failures. A failed notification
+// never fails the reconcile.
+func All(notifiers []Notifier, cs *ChangeSet) {
+	for _, n := range notifiers {
+		if err := n.Notify(cs); err != nil {
+			log.WithError(err).WithField("notifier", typeName(n)).Error("unable to send notification")
+		}
+	}
+}
+
+func typeName(n Notifier) string {
+	switch n.(type) {
+	case *Slack:
+		return "slack"
+	case *Teams:
+		return "teams"
+	case *Webhook:
+		return "webhook"
+	}
+	return "other"
+}
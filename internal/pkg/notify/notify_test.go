@@ -0,0 +1,158 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/k8s"
+)
+
+func testChangeSet() *ChangeSet {
+	return &ChangeSet{
+		Version:  "v1.2.3",
+		Owner:    "permbot",
+		RulesRef: "abc123",
+		Time:     time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Changes: []k8s.Change{
+			{
+				Action:          k8s.ActionUpdate,
+				Object:          k8s.ObjectRef{Kind: "RoleBinding", Namespace: "xyzzy", Name: "permbot-auto-role-binding-execute"},
+				SubjectsAdded:   []rbacv1.Subject{{Kind: "User", Name: "alice"}},
+				SubjectsRemoved: []rbacv1.Subject{{Kind: "User", Name: "mallory"}},
+			},
+			{
+				Action:     k8s.ActionCreate,
+				Object:     k8s.ObjectRef{Kind: "ClusterRole", Name: "permbot-auto-role-global-view"},
+				RulesAdded: []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}}},
+			},
+		},
+		Summary: k8s.PlanSummary{Create: 1, Update: 1},
+	}
+}
+
+// receiver is a test server which records the JSON body of every request
+func receiver(t *testing.T, status int) (*httptest.Server, <-chan map[string]interface{}) {
+	bodies := make(chan map[string]interface{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		var body map[string]interface{}
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Errorf("invalid JSON body %q: %v", data, err)
+		}
+		bodies <- body
+		w.WriteHeader(status)
+		w.Write([]byte("nope"))
+	}))
+	return srv, bodies
+}
+
+func TestNotifiers(t *testing.T) {
+	srv, bodies := receiver(t, http.StatusOK)
+	defer srv.Close()
+	wantLines := []string{
+		"permbot (permbot @ abc123): 1 created, 1 updated, 0 pruned",
+		"",
+		`* update RoleBinding/xyzzy/permbot-auto-role-binding-execute`,
+		`    + User "alice"`,
+		`    - User "mallory"`,
+		`* create ClusterRole/permbot-auto-role-global-view`,
+		`    + rule apiGroups=[""] resources=["pods"] verbs=["get"]`,
+	}
+	tests := []struct {
+		name     string
+		notifier Notifier
+		field    string
+		sep      string
+	}{
+		{name: "slack", notifier: NewSlack(srv.URL, nil), field: "text", sep: "\n"},
+		{name: "teams", notifier: NewTeams(srv.URL, nil), field: "text", sep: "\n\n"},
+		{name: "webhook", notifier: NewWebhook(srv.URL, nil), field: "message", sep: "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.notifier.Notify(testChangeSet()); err != nil {
+				t.Fatalf("Notify() error = %v", err)
+			}
+			body := <-bodies
+			if got, want := body[tt.field], strings.Join(wantLines, tt.sep); got != want {
+				t.Errorf("%s = %q, want %q", tt.field, got, want)
+			}
+		})
+	}
+
+	// The generic webhook also gets the structured change set
+	NewWebhook(srv.URL, nil).Notify(testChangeSet())
+	body := <-bodies
+	if body["rulesRef"] != "abc123" || body["version"] != "v1.2.3" {
+		t.Errorf("webhook body missing change set fields: %v", body)
+	}
+	changes, _ := body["changes"].([]interface{})
+	if len(changes) != 2 {
+		t.Errorf("webhook changes = %v, want 2", body["changes"])
+	}
+	// Teams needs a MessageCard
+	NewTeams(srv.URL, nil).Notify(testChangeSet())
+	if body := <-bodies; body["@type"] != "MessageCard" {
+		t.Errorf("teams body = %v, want a MessageCard", body)
+	}
+}
+
+func TestNotifyTemplate(t *testing.T) {
+	srv, bodies := receiver(t, http.StatusOK)
+	defer srv.Close()
+	tmpl, err := NewTemplate(`{{ len .Changes }} changes by {{ .Owner }}{{ range .Changes }}{{ range .SubjectsAdded }} +{{ .Name }}{{ end }}{{ end }}`)
+	if err != nil {
+		t.Fatalf("NewTemplate() error = %v", err)
+	}
+	if err := NewSlack(srv.URL, tmpl).Notify(testChangeSet()); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+	if got := (<-bodies)["text"]; got != "2 changes by permbot +alice" {
+		t.Errorf("text = %q", got)
+	}
+	if _, err := NewTemplate("{{ .Owner "); err == nil {
+		t.Error("NewTemplate() of broken template succeeded")
+	}
+}
+
+func TestNotifyRejected(t *testing.T) {
+	srv, _ := receiver(t, http.StatusForbidden)
+	defer srv.Close()
+	err := NewSlack(srv.URL, nil).Notify(testChangeSet())
+	if err == nil || !strings.Contains(err.Error(), "403") || !strings.Contains(err.Error(), "nope") {
+		t.Errorf("Notify() error = %v, want 403 with body", err)
+	}
+}
+
+func TestNotifyTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer srv.Close()
+	defer close(hang)
+	saved := defaultClient
+	defer func() { defaultClient = saved }()
+	defaultClient = &http.Client{Timeout: 100 * time.Millisecond}
+
+	done := make(chan error)
+	go func() { done <- NewWebhook(srv.URL, nil).Notify(testChangeSet()) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Notify() to hung webhook succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Notify() to hung webhook didn't time out")
+	}
+}
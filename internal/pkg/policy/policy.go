@@ -0,0 +1,251 @@
+// Package policy enforces organisation-wide constraints, written by platform admins in
+// policy files kept apart from the permbot config, on the bindings the config produces.
+package policy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/k8s"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/query"
+)
+
+// Policy is a single constraint. The selectors (SubjectKinds to Resource) pick the grants
+// the policy applies to, every selector which is set must match. The constraints
+// (MaxNamespaces to Deny) are then checked against those grants, at least one must be set.
+type Policy struct {
+	Name        string `toml:"name" json:"name"`
+	Description string `toml:"description" json:"description,omitempty"`
+
+	// SubjectKinds are User, Group and/or ServiceAccount
+	SubjectKinds []string `toml:"subjectKinds" json:"subjectKinds,omitempty"`
+	// Subjects are glob patterns (as in path.Match) of subject names, namespace:name for
+	// service accounts
+	Subjects []string `toml:"subjects" json:"subjects,omitempty"`
+	// Namespaces are glob patterns of namespaces, such as prod-*. Cluster-wide grants never
+	// match, denyGlobal restricts those.
+	Namespaces []string `toml:"namespaces" json:"namespaces,omitempty"`
+	// Roles are names of roles in the config
+	Roles []string `toml:"roles" json:"roles,omitempty"`
+	// Verb and Resource (given as kubectl does, e.g. pods/exec) select grants of rules which
+	// allow the verb on the resource. Bindings to existing ClusterRoles never match, as their
+	// rules aren't known.
+	Verb     string `toml:"verb" json:"verb,omitempty"`
+	Resource string `toml:"resource" json:"resource,omitempty"`
+
+	// MaxNamespaces is the most namespaces any one subject may have matching grants in. A
+	// cluster-wide grant counts as every namespace.
+	MaxNamespaces int `toml:"maxNamespaces" json:"maxNamespaces,omitempty"`
+	// AllowedRoles are the only roles matching grants may be of
+	AllowedRoles []string `toml:"allowedRoles" json:"allowedRoles,omitempty"`
+	// DeniedRoles are roles matching grants may not be of
+	DeniedRoles []string `toml:"deniedRoles" json:"deniedRoles,omitempty"`
+	// DenyGlobal forbids matching cluster-wide grants (from global subjects of a role)
+	DenyGlobal bool `toml:"denyGlobal" json:"denyGlobal,omitempty"`
+	// Deny forbids any matching grant at all
+	Deny bool `toml:"deny" json:"deny,omitempty"`
+}
+
+// file is the layout of a policy file
+type file struct {
+	Policies []Policy `toml:"policy"`
+}
+
+// Violation is a grant, or set of grants for MaxNamespaces, which breaks a policy
+type Violation struct {
+	Policy  string `json:"policy"`
+	Subject string `json:"subject"`
+	// Namespace is empty for cluster-wide grants and MaxNamespaces violations
+	Namespace string `json:"namespace,omitempty"`
+	Role      string `json:"role,omitempty"`
+	Message   string `json:"message"`
+}
+
+// String formats the violation as policy: subject: message
+func (v Violation) String() string {
+	return fmt.Sprintf("policy %q: %s: %s", v.Policy, v.Subject, v.Message)
+}
+
+// Load decodes and checks the policy files fns
+func Load(fns []string) ([]Policy, error) {
+	var policies []Policy
+	names := make(map[string]string)
+	for _, fn := range fns {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to open policy")
+		}
+		var f file
+		md, err := toml.Decode(string(data), &f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to decode policy %s", fn)
+		}
+		if keys := md.Undecoded(); len(keys) > 0 {
+			return nil, errors.Errorf("unknown key %s in policy %s", keys[0], fn)
+		}
+		for i := range f.Policies {
+			p := &f.Policies[i]
+			if err := p.check(); err != nil {
+				return nil, errors.Wrapf(err, "invalid policy[%d] in %s", i, fn)
+			}
+			if other, dup := names[p.Name]; dup {
+				return nil, errors.Errorf("duplicate policy %q in %s, first defined in %s", p.Name, fn, other)
+			}
+			names[p.Name] = fn
+		}
+		policies = append(policies, f.Policies...)
+	}
+	return policies, nil
+}
+
+// check returns an error if the policy can't be evaluated
+func (p *Policy) check() error {
+	if p.Name == "" {
+		return errors.New("policy has no name")
+	}
+	for _, k := range p.SubjectKinds {
+		if k != "User" && k != "Group" && k != "ServiceAccount" {
+			return errors.Errorf("policy %q has unknown subject kind %q, should be User, Group or ServiceAccount", p.Name, k)
+		}
+	}
+	for _, pat := range append(append([]string{}, p.Subjects...), p.Namespaces...) {
+		if _, err := path.Match(pat, ""); err != nil {
+			return errors.Wrapf(err, "policy %q has bad pattern %q", p.Name, pat)
+		}
+	}
+	if (p.Verb == "") != (p.Resource == "") {
+		return errors.Errorf("policy %q must set both verb and resource, or neither", p.Name)
+	}
+	if p.MaxNamespaces < 0 {
+		return errors.Errorf("policy %q has negative maxNamespaces", p.Name)
+	}
+	if p.MaxNamespaces == 0 && len(p.AllowedRoles) == 0 && len(p.DeniedRoles) == 0 && !p.DenyGlobal && !p.Deny {
+		return errors.Errorf("policy %q has no constraint - set maxNamespaces, allowedRoles, deniedRoles, denyGlobal or deny", p.Name)
+	}
+	return nil
+}
+
+// subjectName returns a subject's name, as namespace:name for service accounts
+func subjectName(g *query.Grant) string {
+	if g.Subject.Kind == "ServiceAccount" {
+		return g.Subject.Namespace + ":" + g.Subject.Name
+	}
+	return g.Subject.Name
+}
+
+func has(list []string, v string) bool {
+	for _, l := range list {
+		if l == v {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, v string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, v); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// selects reports whether the policy applies to a grant
+func (p *Policy) selects(g *query.Grant) bool {
+	if len(p.SubjectKinds) > 0 && !has(p.SubjectKinds, g.Subject.Kind) {
+		return false
+	}
+	if len(p.Subjects) > 0 && !matchAny(p.Subjects, subjectName(g)) {
+		return false
+	}
+	if len(p.Namespaces) > 0 && (g.Namespace == "" || !matchAny(p.Namespaces, g.Namespace)) {
+		return false
+	}
+	if len(p.Roles) > 0 && !has(p.Roles, k8s.ConfigRoleName(g.Binding)) {
+		return false
+	}
+	if p.Verb != "" && (g.Unknown() || !query.Allows(g.Rule, p.Verb, query.ParseResource(p.Resource))) {
+		return false
+	}
+	return true
+}
+
+// Evaluate checks every policy against the grants, returning the violations found. Each
+// subject, namespace and role is reported at most once per policy.
+func Evaluate(policies []Policy, grants []query.Grant) (violations []Violation) {
+	for i := range policies {
+		p := &policies[i]
+		seen := make(map[string]bool)
+		// namespaces records the namespaces each subject has matching grants in, "" for
+		// cluster-wide grants
+		namespaces := make(map[string]map[string]bool)
+		var order []string
+		for j := range grants {
+			g := &grants[j]
+			if !p.selects(g) {
+				continue
+			}
+			subject := k8s.FormatSubject(g.Subject)
+			role := k8s.ConfigRoleName(g.Binding)
+			if namespaces[subject] == nil {
+				namespaces[subject] = make(map[string]bool)
+				order = append(order, subject)
+			}
+			namespaces[subject][g.Namespace] = true
+			key := subject + "\x00" + g.Namespace + "\x00" + role
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			where := "namespace " + g.Namespace
+			if g.Namespace == "" {
+				where = "cluster-wide"
+			}
+			add := func(format string, args ...interface{}) {
+				violations = append(violations, Violation{
+					Policy:    p.Name,
+					Subject:   subject,
+					Namespace: g.Namespace,
+					Role:      role,
+					Message:   fmt.Sprintf(format, args...) + " (" + where + ")",
+				})
+			}
+			switch {
+			case p.Deny:
+				add("is granted role %q", role)
+			case len(p.AllowedRoles) > 0 && !has(p.AllowedRoles, role):
+				add("is granted role %q, only %s are allowed", role, strings.Join(p.AllowedRoles, ", "))
+			case has(p.DeniedRoles, role):
+				add("is granted denied role %q", role)
+			case p.DenyGlobal && g.Namespace == "":
+				add("is granted role %q", role)
+			}
+		}
+		if p.MaxNamespaces == 0 {
+			continue
+		}
+		for _, subject := range order {
+			ns := namespaces[subject]
+			if ns[""] {
+				violations = append(violations, Violation{Policy: p.Name, Subject: subject,
+					Message: fmt.Sprintf("is granted access cluster-wide, more than the %d namespaces allowed", p.MaxNamespaces)})
+			} else if len(ns) > p.MaxNamespaces {
+				list := make([]string, 0, len(ns))
+				for n := range ns {
+					list = append(list, n)
+				}
+				sort.Strings(list)
+				violations = append(violations, Violation{Policy: p.Name, Subject: subject,
+					Message: fmt.Sprintf("is granted access in %d namespaces, more than the %d allowed: %s", len(ns), p.MaxNamespaces, strings.Join(list, ", "))})
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,112 @@
+package policy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/k8s"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/query"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+const orgPolicy = `[[policy]]
+name = "exec-sprawl"
+description = "No user may hold exec in more than 2 namespaces"
+subjectKinds = ["User"]
+verb = "create"
+resource = "pods/exec"
+maxNamespaces = 2
+
+[[policy]]
+name = "prod-roles"
+namespaces = ["prod-*"]
+allowedRoles = ["view", "execute"]
+
+[[policy]]
+name = "no-global-service-accounts"
+subjectKinds = ["ServiceAccount"]
+denyGlobal = true
+`
+
+func TestEvaluate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permbot-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "policy.toml")
+	if err := ioutil.WriteFile(fn, []byte(orgPolicy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	policies, err := Load([]string{fn})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	execute := types.RoleUsers{Role: "execute", Users: []string{"alice"}}
+	pc := &types.PermbotConfig{
+		Projects: []types.Project{
+			{Namespace: "dev-a", Roles: []types.RoleUsers{execute}},
+			{Namespace: "dev-b", Roles: []types.RoleUsers{execute}},
+			{Namespace: "prod-a", Roles: []types.RoleUsers{execute, {Role: "edit", Users: []string{"bob"}}}},
+		},
+		Roles: []types.Role{
+			{Name: "execute", Rules: []types.Rule{
+				{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}},
+				{APIGroups: []string{""}, Resources: []string{"pods/exec"}, Verbs: []string{"create"}},
+			}},
+			{Name: "edit", ClusterRole: "edit"},
+			{Name: "metrics", Rules: []types.Rule{{NonResourceURLs: []string{"/metrics"}, Verbs: []string{"get"}}}, GlobalServiceAccounts: []string{"monitoring:prometheus"}},
+		},
+	}
+	ds, err := k8s.CreateDesiredState(pc, "", "permbot", true, nil)
+	if err != nil {
+		t.Fatalf("CreateDesiredState() error = %v", err)
+	}
+	var got []string
+	for _, v := range Evaluate(policies, query.Grants(ds)) {
+		got = append(got, v.String())
+	}
+	want := []string{
+		`policy "exec-sprawl": User "alice": is granted access in 3 namespaces, more than the 2 allowed: dev-a, dev-b, prod-a`,
+		`policy "prod-roles": User "bob": is granted role "edit", only view, execute are allowed (namespace prod-a)`,
+		`policy "no-global-service-accounts": ServiceAccount "monitoring:prometheus": is granted role "metrics" (cluster-wide)`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Evaluate() violations:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		want   string
+	}{
+		{"no constraint", "[[policy]]\nname = \"x\"\nsubjectKinds = [\"User\"]\n", "has no constraint"},
+		{"unknown key", "[[policy]]\nname = \"x\"\ndeny = true\nmaxNamespace = 5\n", "unknown key policy.maxNamespace"},
+		{"bad kind", "[[policy]]\nname = \"x\"\ndeny = true\nsubjectKinds = [\"Users\"]\n", "unknown subject kind"},
+		{"verb only", "[[policy]]\nname = \"x\"\ndeny = true\nverb = \"get\"\n", "both verb and resource"},
+		{"duplicate", "[[policy]]\nname = \"x\"\ndeny = true\n[[policy]]\nname = \"x\"\ndeny = true\n", "duplicate policy"},
+	}
+	dir, err := ioutil.TempDir("", "permbot-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn := filepath.Join(dir, "policy.toml")
+			if err := ioutil.WriteFile(fn, []byte(tt.policy), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Load([]string{fn}); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Load() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+// Package query answers "who can" and "what can" questions about the RBAC objects a config
+// produces, without needing a cluster.
+package query
+
+import (
+	"sort"
+	"strings"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/k8s"
+)
+
+// Grant is a single rule given to a subject by a binding
+type Grant struct {
+	Subject rbacv1.Subject `json:"subject"`
+	// Namespace is where the rule applies, empty for cluster-wide bindings which apply in
+	// every namespace
+	Namespace string         `json:"namespace,omitempty"`
+	Role      rbacv1.RoleRef `json:"role"`
+	Binding   k8s.ObjectRef  `json:"binding"`
+	// Rule is nil when the binding refers to an existing ClusterRole (such as "edit") whose
+	// rules aren't in the config, so can't be checked offline
+	Rule *rbacv1.PolicyRule `json:"rule,omitempty"`
+	// NameRestricted is set when the rule only applies to the objects in its resourceNames,
+	// rather than every object of its resources
+	NameRestricted bool `json:"nameRestricted,omitempty"`
+}
+
+// Unknown reports whether the grant's rules aren't known from the config
+func (g *Grant) Unknown() bool {
+	return g.Rule == nil
+}
+
+// Grants lists every rule given to every subject by the desired state
+func Grants(ds *k8s.DesiredState) []Grant {
+	roles := make(map[string][]rbacv1.PolicyRule)
+	key := func(ref rbacv1.RoleRef, ns string) string {
+		if ref.Kind == "ClusterRole" {
+			return "ClusterRole/" + ref.Name
+		}
+		return "Role/" + ns + "/" + ref.Name
+	}
+	for i := range ds.Roles {
+		roles["Role/"+ds.Roles[i].Namespace+"/"+ds.Roles[i].Name] = ds.Roles[i].Rules
+	}
+	for i := range ds.ClusterRoles {
+		roles["ClusterRole/"+ds.ClusterRoles[i].Name] = ds.ClusterRoles[i].Rules
+	}
+	var grants []Grant
+	add := func(subjects []rbacv1.Subject, ns string, ref rbacv1.RoleRef, binding k8s.ObjectRef) {
+		rules, known := roles[key(ref, ns)]
+		for _, s := range subjects {
+			if !known {
+				grants = append(grants, Grant{Subject: s, Namespace: ns, Role: ref, Binding: binding})
+				continue
+			}
+			for i := range rules {
+				grants = append(grants, Grant{Subject: s, Namespace: ns, Role: ref, Binding: binding, Rule: &rules[i], NameRestricted: len(rules[i].ResourceNames) > 0})
+			}
+		}
+	}
+	for _, b := range ds.RoleBindings {
+		add(b.Subjects, b.Namespace, b.RoleRef, k8s.ObjectRef{Kind: "RoleBinding", Namespace: b.Namespace, Name: b.Name})
+	}
+	for _, b := range ds.ClusterRoleBindings {
+		add(b.Subjects, "", b.RoleRef, k8s.ObjectRef{Kind: "ClusterRoleBinding", Name: b.Name})
+	}
+	sort.SliceStable(grants, func(i, j int) bool {
+		if grants[i].Namespace != grants[j].Namespace {
+			return grants[i].Namespace < grants[j].Namespace
+		}
+		return k8s.FormatSubject(grants[i].Subject) < k8s.FormatSubject(grants[j].Subject)
+	})
+	return grants
+}
+
+// Resource is what a query asks about, parsed from the forms kubectl uses, such as
+// "pods", "pods/exec", "deployments.apps" or a non-resource URL like "/metrics"
+type Resource struct {
+	Group       string
+	Resource    string
+	Subresource string
+	// URL is set for non-resource URLs instead of the other fields
+	URL string
+	// Name is the name of a single object, which must then be in the resourceNames of rules
+	// which have them. When it is empty, such rules still match, as they allow the verb on
+	// some objects of the resource.
+	Name string
+}
+
+// ParseResource parses a resource, see Resource
+func ParseResource(s string) Resource {
+	if strings.HasPrefix(s, "/") {
+		return Resource{URL: s}
+	}
+	var r Resource
+	if i := strings.Index(s, "/"); i >= 0 {
+		s, r.Subresource = s[:i], s[i+1:]
+	}
+	if i := strings.Index(s, "."); i >= 0 {
+		s, r.Group = s[:i], s[i+1:]
+	}
+	r.Resource = s
+	return r
+}
+
+// has reports whether list contains v or the "*" wildcard
+func has(list []string, v string) bool {
+	for _, l := range list {
+		if l == v || l == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether list contains v, without wildcards
+func contains(list []string, v string) bool {
+	for _, l := range list {
+		if l == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether rule permits verb on resource, following the Kubernetes RBAC
+// matching rules for wildcards and resourceNames (see Resource.Name)
+func Allows(rule *rbacv1.PolicyRule, verb string, res Resource) bool {
+	if !has(rule.Verbs, verb) {
+		return false
+	}
+	if res.Name != "" && len(rule.ResourceNames) > 0 && !contains(rule.ResourceNames, res.Name) {
+		return false
+	}
+	if res.URL != "" {
+		for _, u := range rule.NonResourceURLs {
+			if u == res.URL || u == rbacv1.NonResourceAll || (strings.HasSuffix(u, "*") && strings.HasPrefix(res.URL, strings.TrimSuffix(u, "*"))) {
+				return true
+			}
+		}
+		return false
+	}
+	if !has(rule.APIGroups, res.Group) {
+		return false
+	}
+	name := res.Resource
+	if res.Subresource != "" {
+		name += "/" + res.Subresource
+	}
+	for _, r := range rule.Resources {
+		if r == name || r == rbacv1.ResourceAll || (res.Subresource != "" && r == "*/"+res.Subresource) {
+			return true
+		}
+	}
+	return false
+}
+
+// WhoCan returns the grants allowing verb on resource in namespace, including cluster-wide
+// grants. An empty namespace matches grants in any namespace. Grants whose rules aren't
+// known are included, as they may allow it.
+func WhoCan(grants []Grant, verb string, res Resource, namespace string) []Grant {
+	var out []Grant
+	for i := range grants {
+		g := &grants[i]
+		if namespace != "" && g.Namespace != "" && g.Namespace != namespace {
+			continue
+		}
+		if res.URL != "" && g.Namespace != "" {
+			// non-resource URLs can only be granted cluster-wide
+			continue
+		}
+		if g.Unknown() || Allows(g.Rule, verb, res) {
+			out = append(out, *g)
+		}
+	}
+	return out
+}
+
+// WhatCan returns every grant to subject. Service accounts can be given as
+// "system:serviceaccount:namespace:name".
+func WhatCan(grants []Grant, kind, name string) []Grant {
+	var want rbacv1.Subject
+	if parts := strings.SplitN(name, ":", 4); kind == "User" && len(parts) == 4 && parts[0] == "system" && parts[1] == "serviceaccount" {
+		want = rbacv1.Subject{Kind: "ServiceAccount", Namespace: parts[2], Name: parts[3]}
+	} else {
+		want = rbacv1.Subject{APIGroup: rbacv1.GroupName, Kind: kind, Name: name}
+	}
+	var out []Grant
+	for _, g := range grants {
+		if g.Subject == want {
+			out = append(out, g)
+		}
+	}
+	return out
+}
@@ -0,0 +1,132 @@
+package query
+
+import (
+	"reflect"
+	"testing"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/k8s"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+func TestParseResource(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Resource
+	}{
+		{"pods", Resource{Resource: "pods"}},
+		{"pods/exec", Resource{Resource: "pods", Subresource: "exec"}},
+		{"deployments.apps", Resource{Resource: "deployments", Group: "apps"}},
+		{"deployments.apps/scale", Resource{Resource: "deployments", Group: "apps", Subresource: "scale"}},
+		{"/metrics", Resource{URL: "/metrics"}},
+	}
+	for _, tt := range tests {
+		if got := ParseResource(tt.in); got != tt.want {
+			t.Errorf("ParseResource(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestAllows(t *testing.T) {
+	tests := []struct {
+		name string
+		rule rbacv1.PolicyRule
+		verb string
+		res  string
+		want bool
+	}{
+		{"exact", rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"pods/exec"}, Verbs: []string{"create"}}, "create", "pods/exec", true},
+		{"wrong verb", rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"pods/exec"}, Verbs: []string{"create"}}, "get", "pods/exec", false},
+		{"not subresource", rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"create"}}, "create", "pods/exec", false},
+		{"wrong group", rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"deployments"}, Verbs: []string{"get"}}, "get", "deployments.apps", false},
+		{"wildcards", rbacv1.PolicyRule{APIGroups: []string{"*"}, Resources: []string{"*"}, Verbs: []string{"*"}}, "delete", "deployments.apps", true},
+		{"any subresource", rbacv1.PolicyRule{APIGroups: []string{"apps"}, Resources: []string{"*/scale"}, Verbs: []string{"update"}}, "update", "deployments.apps/scale", true},
+		{"url", rbacv1.PolicyRule{NonResourceURLs: []string{"/metrics"}, Verbs: []string{"get"}}, "get", "/metrics", true},
+		{"url prefix", rbacv1.PolicyRule{NonResourceURLs: []string{"/healthz/*"}, Verbs: []string{"get"}}, "get", "/healthz/ready", true},
+		{"url on resource rule", rbacv1.PolicyRule{APIGroups: []string{"*"}, Resources: []string{"*"}, Verbs: []string{"get"}}, "get", "/metrics", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Allows(&tt.rule, tt.verb, ParseResource(tt.res)); got != tt.want {
+				t.Errorf("Allows(%s %s) = %v, want %v", tt.verb, tt.res, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowsResourceNames(t *testing.T) {
+	named := rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"configmaps"}, ResourceNames: []string{"a"}, Verbs: []string{"get"}}
+	every := rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"get"}}
+	tests := []struct {
+		name   string
+		rule   rbacv1.PolicyRule
+		object string
+		want   bool
+	}{
+		{"no name given", named, "", true},
+		{"named object", named, "a", true},
+		{"other object", named, "b", false},
+		{"rule for every object", every, "b", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ParseResource("configmaps")
+			res.Name = tt.object
+			if got := Allows(&tt.rule, "get", res); got != tt.want {
+				t.Errorf("Allows(get configmaps %q) = %v, want %v", tt.object, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWhoCanWhatCan(t *testing.T) {
+	pc := &types.PermbotConfig{
+		Projects: []types.Project{
+			{Namespace: "a", Roles: []types.RoleUsers{{Role: "execute", Users: []string{"alice"}}, {Role: "edit", Groups: []string{"devs"}}}},
+			{Namespace: "b", Roles: []types.RoleUsers{{Role: "execute", ServiceAccounts: []string{"ci"}}}},
+		},
+		Roles: []types.Role{
+			{
+				Name:        "execute",
+				Rules:       []types.Rule{{APIGroups: []string{""}, Resources: []string{"pods/exec"}, Verbs: []string{"create"}}},
+				GlobalUsers: []string{"admin"},
+			},
+			{Name: "edit", ClusterRole: "edit"},
+		},
+	}
+	ds, err := k8s.CreateDesiredState(pc, "", "permbot", true, nil)
+	if err != nil {
+		t.Fatalf("CreateDesiredState() error = %v", err)
+	}
+	grants := Grants(ds)
+	subjects := func(gs []Grant) (out []string) {
+		for _, g := range gs {
+			out = append(out, k8s.FormatSubject(g.Subject)+" "+g.Namespace)
+		}
+		return
+	}
+
+	// The cluster-wide admin, alice in a, and devs who may be able to through edit
+	got := subjects(WhoCan(grants, "create", ParseResource("pods/exec"), "a"))
+	want := []string{`User "admin" `, `Group "devs" a`, `User "alice" a`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("WhoCan(a) = %q, want %q", got, want)
+	}
+	got = subjects(WhoCan(grants, "create", ParseResource("pods/exec"), "b"))
+	want = []string{`User "admin" `, `ServiceAccount "b:ci" b`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("WhoCan(b) = %q, want %q", got, want)
+	}
+
+	got = subjects(WhatCan(grants, "User", "alice"))
+	want = []string{`User "alice" a`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("WhatCan(alice) = %q, want %q", got, want)
+	}
+	got = subjects(WhatCan(grants, "User", "system:serviceaccount:b:ci"))
+	want = []string{`ServiceAccount "b:ci" b`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("WhatCan(ci) = %q, want %q", got, want)
+	}
+}
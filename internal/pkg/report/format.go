@@ -0,0 +1,153 @@
+package report
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// scope is the value of the scope column for a row
+func (r *Row) scope() string {
+	if r.Namespace == "" {
+		return "cluster"
+	}
+	return "namespace"
+}
+
+// VerbsText is the verbs as a comma-separated list, or the ClusterRole bound to if the
+// verbs aren't known
+func (r *Row) VerbsText() string {
+	if r.ClusterRole != "" {
+		return "(ClusterRole " + r.ClusterRole + ")"
+	}
+	return strings.Join(r.Verbs, ", ")
+}
+
+// ResourcesText is the resources as a comma-separated list
+func (r *Row) ResourcesText() string {
+	return strings.Join(r.Resources, ", ")
+}
+
+// ExpiresText is the expiry time, or an empty string for grants which don't expire
+func (r *Row) ExpiresText() string {
+	if r.Expires == nil {
+		return ""
+	}
+	return r.Expires.UTC().Format(time.RFC3339)
+}
+
+// WriteCSV writes every row, with a scope column of namespace or cluster to tell them apart
+func (rep *Report) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"scope", "subjectKind", "subject", "namespace", "role", "clusterRole", "verbs", "resources", "expires"})
+	for _, rows := range [][]Row{rep.Namespaced, rep.Global} {
+		for i := range rows {
+			r := &rows[i]
+			cw.Write([]string{r.scope(), r.SubjectKind, r.Subject, r.Namespace, r.Role, r.ClusterRole,
+				strings.Join(r.Verbs, " "), strings.Join(r.Resources, " "), r.ExpiresText()})
+		}
+	}
+	cw.Flush()
+	return errors.Wrap(cw.Error(), "unable to write report")
+}
+
+// markdownCell escapes characters which would break a table cell
+func markdownCell(s string) string {
+	return strings.NewReplacer("|", `\|`, "\n", " ").Replace(s)
+}
+
+// WriteMarkdown writes a table of namespace grants and a table of cluster-wide grants
+func (rep *Report) WriteMarkdown(w io.Writer) error {
+	fmt.Fprintf(w, "# Permbot access report\n\nGenerated %s.\n", rep.Generated.Format(time.RFC3339))
+	section := func(title string, rows []Row, namespaced bool) {
+		fmt.Fprintf(w, "\n## %s\n\n", title)
+		if len(rows) == 0 {
+			fmt.Fprintln(w, "None.")
+			return
+		}
+		if namespaced {
+			fmt.Fprintln(w, "| Subject | Kind | Namespace | Role | Verbs | Resources | Expires |")
+			fmt.Fprintln(w, "|---|---|---|---|---|---|---|")
+		} else {
+			fmt.Fprintln(w, "| Subject | Kind | Role | Verbs | Resources |")
+			fmt.Fprintln(w, "|---|---|---|---|---|")
+		}
+		for i := range rows {
+			r := &rows[i]
+			cells := []string{r.Subject, r.SubjectKind}
+			if namespaced {
+				cells = append(cells, r.Namespace)
+			}
+			cells = append(cells, r.Role, r.VerbsText(), r.ResourcesText())
+			if namespaced {
+				cells = append(cells, r.ExpiresText())
+			}
+			for j := range cells {
+				cells[j] = markdownCell(cells[j])
+			}
+			fmt.Fprintf(w, "| %s |\n", strings.Join(cells, " | "))
+		}
+	}
+	section("Namespace access", rep.Namespaced, true)
+	section("Cluster-wide access", rep.Global, false)
+	return nil
+}
+
+// htmlTemplate is a single page with no external resources, so it can be attached to a
+// review ticket. Typing in the filter box hides rows which don't contain the text.
+var htmlTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Permbot access report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; vertical-align: top; }
+th { background: #eee; }
+input { font-size: 1em; padding: 0.3em; width: 30em; }
+</style>
+</head>
+<body>
+<h1>Permbot access report</h1>
+<p>Generated {{ .Generated.Format "2006-01-02T15:04:05Z07:00" }}.</p>
+<p><input id="filter" type="search" placeholder="Filter by subject, namespace, role, verb or resource"></p>
+<h2>Namespace access</h2>
+<table>
+<thead><tr><th>Subject</th><th>Kind</th><th>Namespace</th><th>Role</th><th>Verbs</th><th>Resources</th><th>Expires</th></tr></thead>
+<tbody>
+{{- range .Namespaced }}
+<tr><td>{{ .Subject }}</td><td>{{ .SubjectKind }}</td><td>{{ .Namespace }}</td><td>{{ .Role }}</td><td>{{ .VerbsText }}</td><td>{{ .ResourcesText }}</td><td>{{ .ExpiresText }}</td></tr>
+{{- end }}
+</tbody>
+</table>
+<h2>Cluster-wide access</h2>
+<table>
+<thead><tr><th>Subject</th><th>Kind</th><th>Role</th><th>Verbs</th><th>Resources</th></tr></thead>
+<tbody>
+{{- range .Global }}
+<tr><td>{{ .Subject }}</td><td>{{ .SubjectKind }}</td><td>{{ .Role }}</td><td>{{ .VerbsText }}</td><td>{{ .ResourcesText }}</td></tr>
+{{- end }}
+</tbody>
+</table>
+<script>
+document.getElementById("filter").addEventListener("input", function () {
+  var q = this.value.toLowerCase();
+  document.querySelectorAll("tbody tr").forEach(function (tr) {
+    tr.style.display = tr.textContent.toLowerCase().indexOf(q) >= 0 ? "" : "none";
+  });
+});
+</script>
+</body>
+</html>
+`))
+
+// WriteHTML writes a self-contained HTML page with both tables and a filter box
+func (rep *Report) WriteHTML(w io.Writer) error {
+	return errors.Wrap(htmlTemplate.Execute(w, rep), "unable to write report")
+}
@@ -0,0 +1,174 @@
+// Package report produces an access matrix of subject, namespace and role from a config,
+// with the verbs and resources of each rule granted, for access reviews.
+package report
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	rbacv1 "k8s.io/api/rbac/v1"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/k8s"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/query"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+// Row is a single rule of a role granted to a single subject, in a namespace or
+// cluster-wide. Keeping rules apart means each row's verbs only apply to its resources.
+type Row struct {
+	// SubjectKind is User, Group or ServiceAccount
+	SubjectKind string `json:"subjectKind"`
+	// Subject is the subject's name, namespace:name for service accounts
+	Subject string `json:"subject"`
+	// Namespace is empty for cluster-wide grants
+	Namespace string `json:"namespace,omitempty"`
+	Role      string `json:"role"`
+	// ClusterRole is set for roles which bind to an existing ClusterRole, whose verbs and
+	// resources aren't known from the config, in which case there is a single row
+	ClusterRole string   `json:"clusterRole,omitempty"`
+	Verbs       []string `json:"verbs"`
+	Resources   []string `json:"resources"`
+	// Expires is set for grants which expire
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Report is the complete access matrix, with namespace-scoped and cluster-wide grants kept
+// apart
+type Report struct {
+	Generated  time.Time `json:"generated"`
+	Namespaced []Row     `json:"namespaced"`
+	Global     []Row     `json:"global"`
+}
+
+// resourceName formats a rule's resource as kubectl does, e.g. deployments.apps
+func resourceName(resource, group string) string {
+	if group == "" || (group == "*" && resource == "*") {
+		return resource
+	}
+	if i := strings.Index(resource, "/"); i >= 0 {
+		return resource[:i] + "." + group + resource[i:]
+	}
+	return resource + "." + group
+}
+
+// ruleText returns the verbs and resources of a rule, with resources formatted as kubectl
+// does and any resourceNames they are restricted to in brackets
+func ruleText(rule *rbacv1.PolicyRule) (verbs, resources []string) {
+	verbs = append([]string{}, rule.Verbs...)
+	sort.Strings(verbs)
+	resources = []string{}
+	for _, g := range rule.APIGroups {
+		for _, res := range rule.Resources {
+			name := resourceName(res, g)
+			if len(rule.ResourceNames) > 0 {
+				name += "[" + strings.Join(rule.ResourceNames, ",") + "]"
+			}
+			resources = append(resources, name)
+		}
+	}
+	resources = append(resources, rule.NonResourceURLs...)
+	sort.Strings(resources)
+	return
+}
+
+// subjectName returns a subject's name, as namespace:name for service accounts
+func subjectName(s rbacv1.Subject) string {
+	if s.Kind == "ServiceAccount" {
+		return s.Namespace + ":" + s.Name
+	}
+	return s.Name
+}
+
+// expiryKey identifies a subject's grant of a role in a namespace
+func expiryKey(ns, role string, s rbacv1.Subject) string {
+	return ns + "\x00" + role + "\x00" + k8s.FormatSubject(s)
+}
+
+// expiries returns when each expiring grant of the config expires, by expiryKey
+func expiries(pc *types.PermbotConfig) (map[string]time.Time, error) {
+	out := make(map[string]time.Time)
+	for i := range pc.Projects {
+		p := &pc.Projects[i]
+		for _, ru := range p.Roles {
+			for _, f := range []struct {
+				kind  string
+				names []string
+			}{{"User", ru.Users}, {"Group", ru.Groups}, {"ServiceAccount", ru.ServiceAccounts}} {
+				for _, n := range f.names {
+					t, ok := ru.Expires[n]
+					if !ok {
+						continue
+					}
+					expanded, err := p.Expand(n)
+					if err != nil {
+						return nil, errors.Wrapf(err, "role %q in project %q", ru.Role, p.Namespace)
+					}
+					out[expiryKey(p.Namespace, ru.Role, k8s.ProjectSubject(f.kind, expanded, p.Namespace))] = t
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// Build creates the access matrix for a config, generated at now, from the same objects
+// the other modes apply or query. Grants which have expired are left out, as they are from
+// the cluster.
+func Build(pc *types.PermbotConfig, now time.Time) (*Report, error) {
+	pc, err := pc.Merged()
+	if err != nil {
+		return nil, err
+	}
+	ds, err := k8s.CreateDesiredState(pc, "", "permbot", true, nil)
+	if err != nil {
+		return nil, err
+	}
+	expires, err := expiries(pc)
+	if err != nil {
+		return nil, err
+	}
+	rep := &Report{Generated: now.UTC(), Namespaced: []Row{}, Global: []Row{}}
+	for _, g := range query.Grants(ds) {
+		rw := Row{
+			SubjectKind: g.Subject.Kind,
+			Subject:     subjectName(g.Subject),
+			Namespace:   g.Namespace,
+			Role:        k8s.ConfigRoleName(g.Binding),
+		}
+		if g.Unknown() {
+			rw.ClusterRole, rw.Verbs, rw.Resources = g.Role.Name, []string{}, []string{}
+		} else {
+			rw.Verbs, rw.Resources = ruleText(g.Rule)
+		}
+		if g.Namespace == "" {
+			rep.Global = append(rep.Global, rw)
+			continue
+		}
+		if t, ok := expires[expiryKey(g.Namespace, rw.Role, g.Subject)]; ok {
+			rw.Expires = &t
+		}
+		rep.Namespaced = append(rep.Namespaced, rw)
+	}
+	sortRows(rep.Namespaced)
+	sortRows(rep.Global)
+	return rep, nil
+}
+
+// sortRows sorts by subject, then namespace and role, keeping the rules of a role in order
+func sortRows(rows []Row) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.SubjectKind != b.SubjectKind {
+			return a.SubjectKind < b.SubjectKind
+		}
+		if a.Subject != b.Subject {
+			return a.Subject < b.Subject
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Role < b.Role
+	})
+}
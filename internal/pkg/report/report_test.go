@@ -0,0 +1,153 @@
+package report
+
+import (
+	"bytes"
+	"encoding/csv"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+// testReport builds a report in which ci's grant expires in an hour, the time formatted as
+// in the report is returned too
+func testReport(t *testing.T) (*Report, string) {
+	t.Helper()
+	now := time.Now().UTC().Truncate(time.Second)
+	pc := &types.PermbotConfig{
+		Projects: []types.Project{{
+			Namespace: "a",
+			Roles: []types.RoleUsers{
+				{
+					Role:            "execute",
+					Users:           []string{"<alice>", "bob"},
+					ServiceAccounts: []string{"ci"},
+					Expires:         map[string]time.Time{"bob": now.Add(-time.Hour), "ci": now.Add(time.Hour)},
+				},
+				{Role: "edit", Groups: []string{"devs"}},
+			},
+		}},
+		Roles: []types.Role{
+			{
+				Name: "execute",
+				Rules: []types.Rule{
+					{APIGroups: []string{""}, Resources: []string{"pods/exec"}, Verbs: []string{"create"}},
+					{APIGroups: []string{"apps"}, Resources: []string{"deployments"}, ResourceNames: []string{"web"}, Verbs: []string{"get", "create"}},
+					{NonResourceURLs: []string{"/metrics"}, Verbs: []string{"get"}},
+				},
+				GlobalServiceAccounts: []string{"monitoring:"},
+			},
+			{Name: "edit", ClusterRole: "edit"},
+		},
+	}
+	rep, err := Build(pc, now)
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	return rep, now.Add(time.Hour).Format(time.RFC3339)
+}
+
+func TestBuild(t *testing.T) {
+	rep, expires := testReport(t)
+	var got []string
+	for _, rows := range [][]Row{rep.Namespaced, rep.Global} {
+		for i := range rows {
+			r := &rows[i]
+			got = append(got, strings.Join([]string{r.scope(), r.SubjectKind, r.Subject, r.Namespace, r.Role, r.VerbsText(), r.ResourcesText(), r.ExpiresText()}, "|"))
+		}
+	}
+	// Each rule is a row of its own, so verbs are only listed against the resources they
+	// apply to
+	want := []string{
+		"namespace|Group|devs|a|edit|(ClusterRole edit)||",
+		"namespace|ServiceAccount|a:ci|a|execute|create|pods/exec|" + expires,
+		"namespace|ServiceAccount|a:ci|a|execute|create, get|deployments.apps[web]|" + expires,
+		"namespace|User|<alice>|a|execute|create|pods/exec|",
+		"namespace|User|<alice>|a|execute|create, get|deployments.apps[web]|",
+		"cluster|ServiceAccount|default:monitoring||execute|create|pods/exec|",
+		"cluster|ServiceAccount|default:monitoring||execute|create, get|deployments.apps[web]|",
+		"cluster|ServiceAccount|default:monitoring||execute|get|/metrics|",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Build() rows =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestWrite(t *testing.T) {
+	rep, expires := testReport(t)
+
+	var buf bytes.Buffer
+	if err := rep.WriteCSV(&buf); err != nil {
+		t.Fatalf("WriteCSV() error = %v", err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("WriteCSV() wrote invalid CSV: %v", err)
+	}
+	if len(records) != 9 || records[0][0] != "scope" || records[5][0] != "namespace" || records[6][0] != "cluster" {
+		t.Errorf("WriteCSV() = %q, want header, 5 namespace rows and 3 cluster rows", records)
+	}
+
+	buf.Reset()
+	if err := rep.WriteMarkdown(&buf); err != nil {
+		t.Fatalf("WriteMarkdown() error = %v", err)
+	}
+	md := buf.String()
+	for _, want := range []string{
+		"## Namespace access",
+		"| a:ci | ServiceAccount | a | execute | create, get | deployments.apps[web] | " + expires + " |",
+		"## Cluster-wide access",
+		"| default:monitoring | ServiceAccount | execute | get | /metrics |",
+	} {
+		if !strings.Contains(md, want) {
+			t.Errorf("WriteMarkdown() missing %q in:\n%s", want, md)
+		}
+	}
+
+	buf.Reset()
+	if err := rep.WriteHTML(&buf); err != nil {
+		t.Fatalf("WriteHTML() error = %v", err)
+	}
+	html := buf.String()
+	if !strings.Contains(html, "<td>&lt;alice&gt;</td>") || strings.Contains(html, "<alice>") {
+		t.Errorf("WriteHTML() didn't escape subject names:\n%s", html)
+	}
+	if strings.Contains(html, "src=") || strings.Contains(html, "href=") {
+		t.Errorf("WriteHTML() page isn't self-contained")
+	}
+}
+
+func TestBuildTemplates(t *testing.T) {
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	pc := &types.PermbotConfig{
+		Projects: []types.Project{{
+			Namespace: "a",
+			Vars:      map[string]string{"owner": "alice", "cm": "a-config"},
+			Roles: []types.RoleUsers{{
+				Role:            "config",
+				Users:           []string{"{{ .Vars.owner }}"},
+				ServiceAccounts: []string{"{{ .Namespace }}-ci"},
+				Expires:         map[string]time.Time{"{{ .Vars.owner }}": expires},
+			}},
+		}},
+		Roles: []types.Role{{Name: "config", Rules: []types.Rule{{APIGroups: []string{""}, Resources: []string{"configmaps"}, ResourceNames: []string{"{{ .Vars.cm }}"}, Verbs: []string{"get"}}}}},
+	}
+	rep, err := Build(pc, time.Now())
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	var got []string
+	for i := range rep.Namespaced {
+		r := &rep.Namespaced[i]
+		got = append(got, strings.Join([]string{r.Subject, r.ResourcesText(), r.ExpiresText()}, "|"))
+	}
+	want := []string{
+		"a:a-ci|configmaps[a-config]|",
+		"alice|configmaps[a-config]|" + expires.Format(time.RFC3339),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Build() rows = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,127 @@
+package validate
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// positions maps config paths such as "project[1].roles[0].role" to the line of the file
+// on which they are defined. The TOML decoder doesn't expose positions, so this is built
+// by a simple scan of table headers and keys, which is enough for the way permbot configs
+// are written. Paths which can't be found (e.g. inline tables) map to line 0.
+type positions struct {
+	lines map[string]int
+}
+
+var (
+	arrayHeader = regexp.MustCompile(`^\[\[\s*([^\]]+?)\s*\]\]`)
+	tableHeader = regexp.MustCompile(`^\[\s*([^\]]+?)\s*\]`)
+	keyLine     = regexp.MustCompile(`^("[^"]*"|[A-Za-z0-9_-]+)\s*=`)
+	indexSuffix = regexp.MustCompile(`\[\d+\]`)
+)
+
+// stripComment removes a trailing # comment, ignoring any # inside quoted strings
+func stripComment(line string) string {
+	inString := byte(0)
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case inString != 0 && c == '\\' && inString == '"':
+			i++
+		case inString != 0 && c == inString:
+			inString = 0
+		case inString == 0 && (c == '"' || c == '\''):
+			inString = c
+		case inString == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func scanPositions(r io.Reader) (*positions, error) {
+	p := &positions{lines: make(map[string]int)}
+	// last holds the index of the most recent element of each array of tables, keyed by
+	// the (already indexed) path of the array
+	last := make(map[string]int)
+	resolve := func(parts []string) string {
+		path := ""
+		for _, part := range parts {
+			if path != "" {
+				path += "."
+			}
+			path += strings.Trim(strings.TrimSpace(part), `"`)
+			if idx, ok := last[path]; ok {
+				path = fmt.Sprintf("%s[%d]", path, idx)
+			}
+		}
+		return path
+	}
+	current := ""
+	sc := bufio.NewScanner(r)
+	lineno := 0
+	for sc.Scan() {
+		lineno++
+		line := strings.TrimSpace(stripComment(sc.Text()))
+		if m := arrayHeader.FindStringSubmatch(line); m != nil {
+			parts := strings.Split(m[1], ".")
+			parent := resolve(parts[:len(parts)-1])
+			arr := strings.Trim(strings.TrimSpace(parts[len(parts)-1]), `"`)
+			if parent != "" {
+				arr = parent + "." + arr
+			}
+			if _, ok := last[arr]; ok {
+				last[arr]++
+			} else {
+				last[arr] = 0
+			}
+			current = fmt.Sprintf("%s[%d]", arr, last[arr])
+			p.lines[current] = lineno
+			continue
+		}
+		if m := tableHeader.FindStringSubmatch(line); m != nil {
+			current = resolve(strings.Split(m[1], "."))
+			p.lines[current] = lineno
+			continue
+		}
+		if m := keyLine.FindStringSubmatch(line); m != nil {
+			key := strings.Trim(m[1], `"`)
+			if current != "" {
+				key = current + "." + key
+			}
+			if _, ok := p.lines[key]; !ok {
+				p.lines[key] = lineno
+			}
+		}
+	}
+	return p, sc.Err()
+}
+
+// line returns the line on which path is defined. If the exact path isn't known, the
+// closest known parent is used instead.
+func (p *positions) line(path string) int {
+	for path != "" {
+		if l, ok := p.lines[path]; ok {
+			return l
+		}
+		if i := strings.LastIndexAny(path, ".["); i >= 0 {
+			path = path[:i]
+		} else {
+			break
+		}
+	}
+	return 0
+}
+
+// find returns all indexed paths which match the unindexed key, e.g. "project.roles.rol"
+// matches "project[2].roles[0].rol"
+func (p *positions) find(key string) (paths []string) {
+	for path := range p.lines {
+		if indexSuffix.ReplaceAllString(path, "") == key {
+			paths = append(paths, path)
+		}
+	}
+	return
+}
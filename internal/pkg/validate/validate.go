@@ -0,0 +1,651 @@
+// Package validate checks a permbot config for mistakes which would otherwise be silently
+// ignored, such as typos in keys or references to roles which don't exist.
+package validate
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/internal/pkg/k8s"
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+// Problem is a single issue found in a config
+type Problem struct {
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Path    string `json:"path"`
+	Message string `json:"message"`
+	// Warning is set for problems which don't make the config invalid, such as grants
+	// which are about to expire
+	Warning bool `json:"warning,omitempty"`
+}
+
+// String formats the problem as file:line: path: message
+func (p Problem) String() string {
+	msg := p.Message
+	if p.Warning {
+		msg = "warning: " + msg
+	}
+	pos := p.File
+	if p.Line > 0 {
+		pos = fmt.Sprintf("%s:%d", pos, p.Line)
+	}
+	if pos != "" {
+		return fmt.Sprintf("%s: %s: %s", pos, p.Path, msg)
+	}
+	return fmt.Sprintf("%s: %s", p.Path, msg)
+}
+
+// ExpiryWarning is how far ahead Files warns about grants which are going to expire
+var ExpiryWarning = 7 * 24 * time.Hour
+
+func problem(path, format string, args ...interface{}) Problem {
+	return Problem{Path: path, Message: fmt.Sprintf(format, args...)}
+}
+
+// File decodes and validates the config file fn, returning any problems found with their
+// line numbers. If cl is not nil, ClusterRoles referenced by the config are also checked
+// against the cluster. An error is only returned if the file can't be read or parsed at all.
+func File(fn string, cl kubernetes.Interface) ([]Problem, error) {
+	return Files([]string{fn}, cl)
+}
+
+// origin records which file (and which index within it) an element of a combined config
+// came from
+type origin struct {
+	file  string
+	index int
+}
+
+var elementRef = regexp.MustCompile(`\b(role|project)\[(\d+)\]`)
+
+// Files validates several config files as a single combined config, as they are loaded by
+// permbot. Problems are reported against the file and position each element came from.
+func Files(fns []string, cl kubernetes.Interface) ([]Problem, error) {
+	src, err := Load(fns)
+	if err != nil {
+		return nil, err
+	}
+	problems := src.Problems
+	checks := append(Config(&src.Config), Expiries(&src.Config, time.Now(), ExpiryWarning)...)
+	if cl != nil {
+		checks = append(checks, ClusterRoles(&src.Config, cl)...)
+	}
+	for _, p := range checks {
+		problems = append(problems, src.Locate(p))
+	}
+	src.Sort(problems)
+	return problems, nil
+}
+
+// Sources is a set of config files decoded and combined into a single config, remembering
+// which file and line each element came from
+type Sources struct {
+	// Config is the combined (but not merged) config
+	Config types.PermbotConfig
+	// Problems are those found while decoding, such as unknown keys, already located
+	Problems []Problem
+	fns      []string
+	origins  map[string][]origin
+	pos      map[string]*positions
+	dupFrom  string
+}
+
+// Load decodes and combines the config files fns. An error is only returned if a file
+// can't be read or parsed at all.
+func Load(fns []string) (*Sources, error) {
+	src := &Sources{
+		fns:     fns,
+		origins: map[string][]origin{},
+		pos:     make(map[string]*positions, len(fns)),
+	}
+	combined := &src.Config
+	for _, fn := range fns {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to open config")
+		}
+		var pc types.PermbotConfig
+		md, err := toml.Decode(string(data), &pc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to decode config %s", fn)
+		}
+		if src.pos[fn], err = scanPositions(bytes.NewReader(data)); err != nil {
+			return nil, errors.Wrapf(err, "unable to scan config %s", fn)
+		}
+		for _, p := range undecoded(md, src.pos[fn]) {
+			p.File = fn
+			p.Line = src.pos[fn].line(p.Path)
+			src.Problems = append(src.Problems, p)
+		}
+		if pc.Duplicates != "" {
+			if combined.Duplicates != "" && combined.Duplicates != pc.Duplicates {
+				p := problem("duplicates", "duplicates %q conflicts with %q in %s", pc.Duplicates, combined.Duplicates, src.dupFrom)
+				p.File = fn
+				p.Line = src.pos[fn].line(p.Path)
+				src.Problems = append(src.Problems, p)
+			} else {
+				combined.Duplicates, src.dupFrom = pc.Duplicates, fn
+			}
+		}
+		for i := range pc.Roles {
+			src.origins["role"] = append(src.origins["role"], origin{fn, i})
+		}
+		for i := range pc.Projects {
+			src.origins["project"] = append(src.origins["project"], origin{fn, i})
+		}
+		combined.Roles = append(combined.Roles, pc.Roles...)
+		combined.Projects = append(combined.Projects, pc.Projects...)
+	}
+	return src, nil
+}
+
+// locate maps a reference such as role[5] in the combined config back to its file
+func (src *Sources) locate(ref string) (string, string) {
+	m := elementRef.FindStringSubmatch(ref)
+	idx, _ := strconv.Atoi(m[2])
+	o := src.origins[m[1]][idx]
+	return o.file, fmt.Sprintf("%s[%d]", m[1], o.index)
+}
+
+// Locate sets the File and Line of a problem found in the combined config, rewriting its
+// path (and any references in its message) to be relative to that file
+func (src *Sources) Locate(p Problem) Problem {
+	p.File = src.dupFrom
+	if p.File == "" && len(src.fns) > 0 {
+		p.File = src.fns[0]
+	}
+	if loc := elementRef.FindStringIndex(p.Path); loc != nil && loc[0] == 0 {
+		var path string
+		p.File, path = src.locate(p.Path[:loc[1]])
+		p.Path = path + p.Path[loc[1]:]
+	}
+	p.Message = elementRef.ReplaceAllStringFunc(p.Message, func(ref string) string {
+		file, path := src.locate(ref)
+		if len(src.fns) > 1 {
+			return file + " " + path
+		}
+		return path
+	})
+	if pos, ok := src.pos[p.File]; ok {
+		p.Line = pos.line(p.Path)
+	}
+	return p
+}
+
+// Sort orders problems by file (in the order they were loaded) and line
+func (src *Sources) Sort(problems []Problem) {
+	order := make(map[string]int, len(src.fns))
+	for i, fn := range src.fns {
+		order[fn] = i
+	}
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].File != problems[j].File {
+			return order[problems[i].File] < order[problems[j].File]
+		}
+		return problems[i].Line < problems[j].Line
+	})
+}
+
+// undecoded reports every key in the file which doesn't correspond to a config field
+func undecoded(md toml.MetaData, pos *positions) (problems []Problem) {
+	seen := make(map[string]bool)
+	for _, k := range md.Undecoded() {
+		key := k.String()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		// Only report the outermost unknown key, not everything inside an unknown table
+		if len(k) > 1 && seen[toml.Key(k[:len(k)-1]).String()] {
+			continue
+		}
+		paths := pos.find(key)
+		if len(paths) == 0 {
+			paths = []string{key}
+		}
+		sort.Strings(paths)
+		for _, p := range paths {
+			problems = append(problems, problem(p, "unknown key %q", k[len(k)-1]))
+		}
+	}
+	return
+}
+
+// Config runs the cross-reference checks on a decoded config. Problems returned have a
+// Path but no File or Line.
+func Config(pc *types.PermbotConfig) (problems []Problem) {
+	merge := pc.Duplicates == types.DuplicatesMerge
+	if !merge && pc.Duplicates != "" && pc.Duplicates != types.DuplicatesError {
+		problems = append(problems, problem("duplicates", "unknown duplicates mode %q, should be %q or %q", pc.Duplicates, types.DuplicatesError, types.DuplicatesMerge))
+	}
+	// usedBy records the first project using each role, as roles used by projects are
+	// turned into namespaced Roles
+	usedBy := make(map[string]string)
+	for i := range pc.Projects {
+		for _, ru := range pc.Projects[i].Roles {
+			if _, ok := usedBy[ru.Role]; !ok {
+				usedBy[ru.Role] = pc.Projects[i].Namespace
+			}
+		}
+	}
+	roles := make(map[string]int)
+	for i := range pc.Roles {
+		r := &pc.Roles[i]
+		path := fmt.Sprintf("role[%d]", i)
+		if r.Name == "" {
+			problems = append(problems, problem(path+".name", "role has no name"))
+		} else if first, dup := roles[r.Name]; dup && !merge {
+			problems = append(problems, problem(path+".name", "duplicate role %q, first defined at role[%d]", r.Name, first))
+		} else if !dup {
+			roles[r.Name] = i
+		}
+		if r.ClusterRole != "" && len(r.Rules) > 0 {
+			problems = append(problems, problem(path+".clusterRole", "role refers to clusterRole %q but also defines rules, which would be ignored", r.ClusterRole))
+		}
+		for j := range r.Rules {
+			rule := &r.Rules[j]
+			rpath := fmt.Sprintf("%s.rules[%d]", path, j)
+			if len(rule.Verbs) == 0 {
+				problems = append(problems, problem(rpath, "rule has no verbs"))
+			}
+			if len(rule.NonResourceURLs) == 0 {
+				continue
+			}
+			if len(rule.APIGroups) > 0 || len(rule.Resources) > 0 || len(rule.ResourceNames) > 0 {
+				problems = append(problems, problem(rpath+".nonResourceURLs", "rule can't have both nonResourceURLs and apiGroups/resources/resourceNames"))
+			}
+			if ns, ok := usedBy[r.Name]; ok {
+				problems = append(problems, problem(rpath+".nonResourceURLs", "nonResourceURLs are ignored in namespaced roles, but role %q is used by project %q", r.Name, ns))
+			}
+		}
+		problems = append(problems, checkNames(path+".globalUsers", "user", r.GlobalUsers)...)
+		problems = append(problems, checkNames(path+".globalGroups", "group", r.GlobalGroups)...)
+		for j, sa := range r.GlobalServiceAccounts {
+			if msg := checkServiceAccount(sa, true); msg != "" {
+				problems = append(problems, problem(fmt.Sprintf("%s.globalServiceAccounts[%d]", path, j), msg))
+			}
+		}
+	}
+	problems = append(problems, checkExtends(pc.Roles, roles)...)
+	namespaces := make(map[string]int)
+	for i := range pc.Projects {
+		p := &pc.Projects[i]
+		path := fmt.Sprintf("project[%d]", i)
+		if p.NamespaceSelector != nil {
+			problems = append(problems, checkSelector(path, p)...)
+		} else if p.Namespace == "" {
+			problems = append(problems, problem(path+".namespace", "project has no namespace or namespaceSelector"))
+		} else if first, dup := namespaces[p.Namespace]; dup && !merge {
+			problems = append(problems, problem(path+".namespace", "duplicate namespace %q, first defined at project[%d]", p.Namespace, first))
+		} else if !dup {
+			namespaces[p.Namespace] = i
+		}
+		if p.CreateNamespace && p.Namespace != "" {
+			if errs := validation.IsDNS1123Label(p.Namespace); len(errs) > 0 {
+				problems = append(problems, problem(path+".namespace", "invalid namespace %q: %s", p.Namespace, strings.Join(errs, ", ")))
+			}
+		}
+		problems = append(problems, checkMetadata(path, "labels", p.Labels, p.CreateNamespace)...)
+		problems = append(problems, checkMetadata(path, "annotations", p.Annotations, p.CreateNamespace)...)
+		projectRoles := make(map[string]bool)
+		for j := range p.Roles {
+			ru := &p.Roles[j]
+			rpath := fmt.Sprintf("%s.roles[%d]", path, j)
+			if _, ok := roles[ru.Role]; !ok {
+				problems = append(problems, problem(rpath+".role", "undefined role %q", ru.Role))
+			} else if projectRoles[ru.Role] && !merge {
+				problems = append(problems, problem(rpath+".role", "role %q is listed more than once for this project", ru.Role))
+			}
+			projectRoles[ru.Role] = true
+			problems = append(problems, checkNames(rpath+".users", "user", ru.Users)...)
+			problems = append(problems, checkNames(rpath+".groups", "group", ru.Groups)...)
+			for k, sa := range ru.ServiceAccounts {
+				if types.IsTemplate(sa) {
+					// checked once expanded, by checkTemplates
+					continue
+				}
+				if msg := checkServiceAccount(sa, false); msg != "" {
+					problems = append(problems, problem(fmt.Sprintf("%s.serviceAccounts[%d]", rpath, k), msg))
+				}
+			}
+			for _, name := range sortedExpires(ru.Expires) {
+				if !contains(ru.Users, name) && !contains(ru.Groups, name) && !contains(ru.ServiceAccounts, name) {
+					problems = append(problems, problem(rpath+".expires."+name, "expiry for %q, which isn't one of the role's users, groups or serviceAccounts", name))
+				}
+			}
+		}
+	}
+	problems = append(problems, checkTemplates(pc)...)
+	return
+}
+
+// checkTemplates reports template variables which can't be expanded for the projects using
+// them, and template variables in roles with global subjects, which have no project
+func checkTemplates(pc *types.PermbotConfig) (problems []Problem) {
+	byName := make(map[string][]int)
+	for i := range pc.Roles {
+		r := &pc.Roles[i]
+		byName[r.Name] = append(byName[r.Name], i)
+		if len(r.GlobalUsers) == 0 && len(r.GlobalGroups) == 0 && len(r.GlobalServiceAccounts) == 0 {
+			continue
+		}
+		for j := range r.Rules {
+			if t := r.Rules[j].Templates(); len(t) > 0 {
+				problems = append(problems, problem(fmt.Sprintf("role[%d].rules[%d]", i, j), "role has global subjects, so can't use template variables such as %q", t[0]))
+			}
+		}
+		for _, f := range []struct {
+			key   string
+			names []string
+		}{{"globalUsers", r.GlobalUsers}, {"globalGroups", r.GlobalGroups}, {"globalServiceAccounts", r.GlobalServiceAccounts}} {
+			for k, name := range f.names {
+				if types.IsTemplate(name) {
+					problems = append(problems, problem(fmt.Sprintf("role[%d].%s[%d]", i, f.key, k), "template variables can't be used in global subjects"))
+				}
+			}
+		}
+	}
+	// rulesOf returns the indexes of every definition of a role and of the roles it extends
+	rulesOf := func(name string) (out []int) {
+		seen := map[string]bool{}
+		var walk func(string)
+		walk = func(name string) {
+			if seen[name] {
+				return
+			}
+			seen[name] = true
+			for _, i := range byName[name] {
+				out = append(out, i)
+				for _, parent := range pc.Roles[i].Extends {
+					walk(parent)
+				}
+			}
+		}
+		walk(name)
+		return
+	}
+	// Projects with the same namespace have their vars combined when they are merged
+	vars := make(map[string]map[string]string)
+	for i := range pc.Projects {
+		p := &pc.Projects[i]
+		if p.NamespaceSelector != nil {
+			continue
+		}
+		for k, v := range p.Vars {
+			if vars[p.Namespace] == nil {
+				vars[p.Namespace] = make(map[string]string)
+			}
+			vars[p.Namespace][k] = v
+		}
+	}
+	for i := range pc.Projects {
+		project := types.Project{Namespace: pc.Projects[i].Namespace, Vars: vars[pc.Projects[i].Namespace]}
+		if pc.Projects[i].NamespaceSelector != nil {
+			// Selector projects aren't merged, so only have their own vars. Their namespace
+			// isn't known until resolved, so a valid stand-in is used.
+			project.Namespace = "namespace"
+			project.Vars = pc.Projects[i].Vars
+		}
+		for j := range pc.Projects[i].Roles {
+			ru := &pc.Projects[i].Roles[j]
+			rpath := fmt.Sprintf("project[%d].roles[%d]", i, j)
+			for _, ri := range rulesOf(ru.Role) {
+				for k := range pc.Roles[ri].Rules {
+					for _, t := range pc.Roles[ri].Rules[k].Templates() {
+						if _, err := project.Expand(t); err != nil {
+							problems = append(problems, problem(rpath+".role", "role[%d].rules[%d]: %v", ri, k, err))
+						}
+					}
+				}
+			}
+			for _, f := range []struct {
+				key   string
+				names []string
+			}{{"users", ru.Users}, {"groups", ru.Groups}, {"serviceAccounts", ru.ServiceAccounts}} {
+				for k, name := range f.names {
+					path := fmt.Sprintf("%s.%s[%d]", rpath, f.key, k)
+					expanded, err := project.Expand(name)
+					if err != nil {
+						problems = append(problems, problem(path, "%v", err))
+					} else if f.key == "serviceAccounts" && expanded != name {
+						if msg := checkServiceAccount(expanded, false); msg != "" {
+							problems = append(problems, problem(path, "%s (expanded from %q)", msg, name))
+						}
+					}
+				}
+			}
+		}
+	}
+	return
+}
+
+// checkExtends reports roles which extend undefined roles or roles without rules, and
+// roles which extend each other in a cycle. roles maps each role name to its first index.
+func checkExtends(rs []types.Role, roles map[string]int) (problems []Problem) {
+	extends := make(map[string][]string)
+	clusterRoles := make(map[string]string)
+	for i := range rs {
+		extends[rs[i].Name] = append(extends[rs[i].Name], rs[i].Extends...)
+		if rs[i].ClusterRole != "" {
+			clusterRoles[rs[i].Name] = rs[i].ClusterRole
+		}
+	}
+	for i := range rs {
+		r := &rs[i]
+		path := fmt.Sprintf("role[%d].extends", i)
+		if len(r.Extends) > 0 && r.ClusterRole != "" {
+			problems = append(problems, problem(path, "role binds to clusterRole %q, so can't extend other roles", r.ClusterRole))
+		}
+		for j, name := range r.Extends {
+			if _, ok := roles[name]; !ok {
+				problems = append(problems, problem(fmt.Sprintf("%s[%d]", path, j), "undefined role %q", name))
+			} else if cr := clusterRoles[name]; cr != "" {
+				problems = append(problems, problem(fmt.Sprintf("%s[%d]", path, j), "role %q binds to clusterRole %q, so has no rules to include", name, cr))
+			}
+		}
+	}
+	// Each cycle is reported once, against the first role in it
+	reported := make(map[string]bool)
+	for i := range rs {
+		name := rs[i].Name
+		if reported[name] || roles[name] != i {
+			continue
+		}
+		if cycle := findCycle(name, extends); cycle != nil {
+			for _, n := range cycle {
+				reported[n] = true
+			}
+			problems = append(problems, problem(fmt.Sprintf("role[%d].extends", i), "roles extend each other in a cycle: %s", strings.Join(cycle, " -> ")))
+		}
+	}
+	return
+}
+
+// findCycle returns the roles extended from start back to start, or nil if start isn't in
+// a cycle
+func findCycle(start string, extends map[string][]string) []string {
+	visited := make(map[string]bool)
+	var walk func(chain []string) []string
+	walk = func(chain []string) []string {
+		for _, next := range extends[chain[len(chain)-1]] {
+			if next == start {
+				return append(chain, next)
+			}
+			if visited[next] {
+				continue
+			}
+			visited[next] = true
+			if cycle := walk(append(chain, next)); cycle != nil {
+				return cycle
+			}
+		}
+		return nil
+	}
+	return walk([]string{start})
+}
+
+// Expiries warns about grants in the config which have expired, or will expire within the
+// given duration of now
+func Expiries(pc *types.PermbotConfig, now time.Time, within time.Duration) (problems []Problem) {
+	for i := range pc.Projects {
+		p := &pc.Projects[i]
+		for j := range p.Roles {
+			ru := &p.Roles[j]
+			for _, name := range sortedExpires(ru.Expires) {
+				t := ru.Expires[name]
+				path := fmt.Sprintf("project[%d].roles[%d].expires.%s", i, j, name)
+				var pr Problem
+				switch {
+				case !now.Before(t):
+					pr = problem(path, "role %q for %q expired %s and is no longer granted", ru.Role, name, t.Format(time.RFC3339))
+				case t.Sub(now) <= within:
+					pr = problem(path, "role %q for %q expires %s", ru.Role, name, t.Format(time.RFC3339))
+				default:
+					continue
+				}
+				pr.Warning = true
+				problems = append(problems, pr)
+			}
+		}
+	}
+	return
+}
+
+// ClusterRoles checks that every existing ClusterRole referenced by a role's clusterRole
+// field exists in the cluster
+func ClusterRoles(pc *types.PermbotConfig, cl kubernetes.Interface) (problems []Problem) {
+	for i := range pc.Roles {
+		name := pc.Roles[i].ClusterRole
+		if name == "" {
+			continue
+		}
+		path := fmt.Sprintf("role[%d].clusterRole", i)
+		_, err := cl.RbacV1().ClusterRoles().Get(name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			problems = append(problems, problem(path, "clusterRole %q doesn't exist in the cluster", name))
+		} else if err != nil {
+			problems = append(problems, problem(path, "unable to check clusterRole %q: %v", name, err))
+		}
+	}
+	return
+}
+
+// checkSelector checks the namespaceSelector of project p, which can't also have a
+// namespace or create one
+func checkSelector(path string, p *types.Project) (problems []Problem) {
+	if p.Namespace != "" {
+		problems = append(problems, problem(path+".namespace", "project has both namespace and namespaceSelector"))
+	}
+	if p.CreateNamespace {
+		problems = append(problems, problem(path+".createNamespace", "createNamespace can't be used with namespaceSelector, which only matches existing namespaces"))
+	}
+	if err := k8s.ValidateSelector(p.NamespaceSelector); err != nil {
+		problems = append(problems, problem(path+".namespaceSelector", "%v", err))
+	}
+	return
+}
+
+// checkMetadata checks the keys (and for labels, values) of a project's namespace labels or
+// annotations. These are only used when the project sets createNamespace.
+func checkMetadata(path, field string, m map[string]string, createNamespace bool) (problems []Problem) {
+	if len(m) > 0 && !createNamespace {
+		problems = append(problems, problem(path+"."+field, "%s are only applied to namespaces when createNamespace = true", field))
+	}
+	for _, k := range sortedKeys(m) {
+		kpath := path + "." + field + "." + k
+		if strings.HasPrefix(k, "dafni.ac.uk/permbot-") {
+			problems = append(problems, problem(kpath, "%q is reserved for permbot", k))
+		} else if errs := validation.IsQualifiedName(k); len(errs) > 0 {
+			problems = append(problems, problem(kpath, "invalid key %q: %s", k, strings.Join(errs, ", ")))
+		}
+		if field != "labels" {
+			continue
+		}
+		if errs := validation.IsValidLabelValue(m[k]); len(errs) > 0 {
+			problems = append(problems, problem(kpath, "invalid label value %q: %s", m[k], strings.Join(errs, ", ")))
+		}
+	}
+	return
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedExpires(m map[string]time.Time) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNames reports empty and repeated entries in a list of user or group names
+func checkNames(path, kind string, names []string) (problems []Problem) {
+	seen := make(map[string]bool, len(names))
+	for i, n := range names {
+		ipath := fmt.Sprintf("%s[%d]", path, i)
+		if strings.TrimSpace(n) == "" {
+			problems = append(problems, problem(ipath, "empty %s name", kind))
+		} else if seen[n] {
+			problems = append(problems, problem(ipath, "%s %q is listed more than once", kind, n))
+		}
+		seen[n] = true
+	}
+	return
+}
+
+// checkServiceAccount checks a service account is either "name" or "namespace:name", with
+// both parts being valid Kubernetes names. It returns a description of the problem, or an
+// empty string if the service account is valid.
+func checkServiceAccount(sa string, global bool) string {
+	parts := strings.Split(sa, ":")
+	if len(parts) > 2 {
+		return fmt.Sprintf("malformed service account %q, should be name or namespace:name", sa)
+	}
+	name := parts[len(parts)-1]
+	if len(parts) == 2 {
+		if errs := validation.IsDNS1123Label(parts[0]); len(errs) > 0 {
+			return fmt.Sprintf("malformed service account %q, invalid namespace: %s", sa, strings.Join(errs, ", "))
+		}
+		if global && name == "" {
+			// CreateGlobalResources treats "name:" as a service account in the default
+			// namespace, so this is allowed for global service accounts
+			return ""
+		}
+	}
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return fmt.Sprintf("malformed service account %q, invalid name: %s", sa, strings.Join(errs, ", "))
+	}
+	return ""
+}
@@ -0,0 +1,367 @@
+package validate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"gitlab.dafni.rl.ac.uk/dafni/tools/permbot/pkg/types"
+)
+
+const badConfig = `# A config with lots of mistakes
+[[role]]
+name = "execute"
+
+[[role.rules]]
+apiGroups = [""]
+resources = ["pods/exec"]
+verb = ["create"] # typo, should be verbs
+
+[[role]]
+name = "execute"
+globalServiceAccounts = ["a:b:c"]
+
+[[role]]
+name = "edit"
+clusterRole = "edit"
+
+[[role.rules]]
+verbs = ["get"]
+
+[[role]]
+name = "admin"
+clusterRole = "admin"
+globalGroups = ["oidc:admins", ""]
+
+[[role]]
+name = "metrics"
+globalUsers = ["prometheus"]
+
+[[role.rules]]
+nonResourceURLs = ["/metrics"]
+resources = ["pods"]
+verbs = ["get"]
+
+[[project]]
+namespace = "xyzzy"
+
+[[project.roles]]
+role = "metrics"
+
+[[project.roles]]
+role = "exce"
+users = ["someone"]
+groups = ["oidc:devs", "oidc:devs"]
+serviceAccounts = ["ok", "otherns:ok", "Not_Valid"]
+
+[[project]]
+namespace = "xyzzy"
+gitlabPath = "x/y"
+`
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permbot-validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "perms.toml")
+	if err := ioutil.WriteFile(fn, []byte(badConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := File(fn, nil)
+	if err != nil {
+		t.Fatalf("File() error = %v", err)
+	}
+	var got []string
+	for _, p := range problems {
+		got = append(got, p.String()[len(dir)+1:])
+	}
+	want := []string{
+		`perms.toml:5: role[0].rules[0]: rule has no verbs`,
+		`perms.toml:8: role[0].rules[0].verb: unknown key "verb"`,
+		`perms.toml:11: role[1].name: duplicate role "execute", first defined at role[0]`,
+		`perms.toml:12: role[1].globalServiceAccounts[0]: malformed service account "a:b:c", should be name or namespace:name`,
+		`perms.toml:16: role[2].clusterRole: role refers to clusterRole "edit" but also defines rules, which would be ignored`,
+		`perms.toml:24: role[3].globalGroups[1]: empty group name`,
+		`perms.toml:31: role[4].rules[0].nonResourceURLs: rule can't have both nonResourceURLs and apiGroups/resources/resourceNames`,
+		`perms.toml:31: role[4].rules[0].nonResourceURLs: nonResourceURLs are ignored in namespaced roles, but role "metrics" is used by project "xyzzy"`,
+		`perms.toml:42: project[0].roles[1].role: undefined role "exce"`,
+		`perms.toml:44: project[0].roles[1].groups[1]: group "oidc:devs" is listed more than once`,
+		`perms.toml:45: project[0].roles[1].serviceAccounts[2]: malformed service account "Not_Valid", invalid name: a DNS-1123 subdomain must consist of lower case alphanumeric characters, '-' or '.', and must start and end with an alphanumeric character (e.g. 'example.com', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*')`,
+		`perms.toml:48: project[1].namespace: duplicate namespace "xyzzy", first defined at project[0]`,
+		`perms.toml:49: project[1].gitlabPath: unknown key "gitlabPath"`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("File() problems:\n%v\nwant:\n%v", got, want)
+	}
+
+	// Only the admin ClusterRole exists in the cluster
+	cl := fake.NewSimpleClientset(&rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: "admin"}})
+	problems, err = File(fn, cl)
+	if err != nil {
+		t.Fatalf("File() error = %v", err)
+	}
+	missing := `perms.toml:16: role[2].clusterRole: clusterRole "edit" doesn't exist in the cluster`
+	found := false
+	for _, p := range problems {
+		if p.String()[len(dir)+1:] == missing {
+			found = true
+		}
+		if p.Path == "role[3].clusterRole" {
+			t.Errorf("unexpected problem for existing clusterRole: %v", p)
+		}
+	}
+	if !found {
+		t.Errorf("File() problems missing %q", missing)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permbot-validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"a.toml": `[[role]]
+name = "view"
+clusterRole = "view"
+
+[[project]]
+namespace = "team-a"
+
+[[project.roles]]
+role = "view"
+users = ["alice"]
+`,
+		"b.toml": `[[role]]
+name = "execute"
+
+[[role.rules]]
+verbs = ["create"]
+
+[[project]]
+namespace = "team-b"
+
+[[project]]
+namespace = "team-a"
+
+[[project.roles]]
+role = "exce"
+`,
+	}
+	var fns []string
+	for _, name := range []string{"a.toml", "b.toml"} {
+		fn := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fn, []byte(files[name]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fns = append(fns, fn)
+	}
+	problems, err := Files(fns, nil)
+	if err != nil {
+		t.Fatalf("Files() error = %v", err)
+	}
+	var got []string
+	for _, p := range problems {
+		got = append(got, strings.Replace(p.String(), dir+string(filepath.Separator), "", -1))
+	}
+	want := []string{
+		`b.toml:11: project[1].namespace: duplicate namespace "team-a", first defined at a.toml project[0]`,
+		`b.toml:14: project[1].roles[0].role: undefined role "exce"`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Files() problems:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestConfigNamespaceMetadata(t *testing.T) {
+	pc := &types.PermbotConfig{
+		Projects: []types.Project{
+			{
+				Namespace:       "Team_A",
+				CreateNamespace: true,
+				Labels:          map[string]string{"team": "a", "dafni.ac.uk/permbot-owner": "me", "bad value": "x y"},
+			},
+			{
+				Namespace:   "team-b",
+				Annotations: map[string]string{"contact": "b@example.com"},
+			},
+		},
+	}
+	var got []string
+	for _, p := range Config(pc) {
+		got = append(got, p.Path+": "+p.Message)
+	}
+	want := []string{
+		`project[0].namespace: invalid namespace "Team_A": a DNS-1123 label must consist of lower case alphanumeric characters or '-', and must start and end with an alphanumeric character (e.g. 'my-name',  or '123-abc', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?')`,
+		`project[0].labels.bad value: invalid key "bad value": name part must consist of alphanumeric characters, '-', '_' or '.', and must start and end with an alphanumeric character (e.g. 'MyName',  or 'my.name',  or '123-abc', regex used for validation is '([A-Za-z0-9][-A-Za-z0-9_.]*)?[A-Za-z0-9]')`,
+		`project[0].labels.bad value: invalid label value "x y": a valid label must be an empty string or consist of alphanumeric characters, '-', '_' or '.', and must start and end with an alphanumeric character (e.g. 'MyValue',  or 'my_value',  or '12345', regex used for validation is '(([A-Za-z0-9][-A-Za-z0-9_.]*)?[A-Za-z0-9])?')`,
+		`project[0].labels.dafni.ac.uk/permbot-owner: "dafni.ac.uk/permbot-owner" is reserved for permbot`,
+		`project[1].annotations: annotations are only applied to namespaces when createNamespace = true`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Config() problems:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestConfigExtends(t *testing.T) {
+	pc := &types.PermbotConfig{
+		Roles: []types.Role{
+			{Name: "view", Rules: []types.Rule{{Verbs: []string{"get"}}}},
+			{Name: "debug", Extends: []string{"view", "veiw", "edit"}},
+			{Name: "edit", ClusterRole: "edit", Extends: []string{"view"}},
+			{Name: "a", Extends: []string{"b"}},
+			{Name: "b", Extends: []string{"view", "a"}},
+		},
+	}
+	var got []string
+	for _, p := range Config(pc) {
+		got = append(got, p.Path+": "+p.Message)
+	}
+	want := []string{
+		`role[1].extends[1]: undefined role "veiw"`,
+		`role[1].extends[2]: role "edit" binds to clusterRole "edit", so has no rules to include`,
+		`role[2].extends: role binds to clusterRole "edit", so can't extend other roles`,
+		`role[3].extends: roles extend each other in a cycle: a -> b -> a`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Config() problems:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestConfigTemplates(t *testing.T) {
+	pc := &types.PermbotConfig{
+		Projects: []types.Project{
+			{Namespace: "a", Vars: map[string]string{"cm": "a-config"}, Roles: []types.RoleUsers{
+				{Role: "debug", Users: []string{"{{ .Vars.owner }}"}, ServiceAccounts: []string{"{{ .Vars.cm }}:{{ .Namespace }}", "{{ .Namespace }}:b:c"}},
+			}},
+			{Namespace: "b", Roles: []types.RoleUsers{{Role: "debug"}}},
+		},
+		Roles: []types.Role{
+			{Name: "config", Rules: []types.Rule{{Resources: []string{"configmaps"}, ResourceNames: []string{"{{ .Vars.cm }}"}, Verbs: []string{"get"}}}},
+			{Name: "debug", Extends: []string{"config"}},
+			{Name: "global", Rules: []types.Rule{{Resources: []string{"{{ .Namespace }}"}, Verbs: []string{"get"}}}, GlobalUsers: []string{"{{ .Vars.x }}"}},
+		},
+	}
+	var got []string
+	for _, p := range Config(pc) {
+		got = append(got, p.Path+": "+p.Message)
+	}
+	want := []string{
+		`role[2].rules[0]: role has global subjects, so can't use template variables such as "{{ .Namespace }}"`,
+		`role[2].globalUsers[0]: template variables can't be used in global subjects`,
+		`project[0].roles[0].users[0]: undefined variable "owner" in "{{ .Vars.owner }}"`,
+		`project[0].roles[0].serviceAccounts[1]: malformed service account "a:b:c", should be name or namespace:name (expanded from "{{ .Namespace }}:b:c")`,
+		`project[1].roles[0].role: role[0].rules[0]: undefined variable "cm" in "{{ .Vars.cm }}"`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Config() problems:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestExpiries(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	pc := &types.PermbotConfig{
+		Projects: []types.Project{{
+			Namespace: "a",
+			Roles: []types.RoleUsers{{
+				Role:   "execute",
+				Users:  []string{"alice", "bob", "carol"},
+				Groups: []string{"devs"},
+				Expires: map[string]time.Time{
+					"alice":   now.Add(-time.Hour),
+					"bob":     now.Add(48 * time.Hour),
+					"carol":   now.Add(30 * 24 * time.Hour),
+					"mallory": now.Add(time.Hour),
+				},
+			}},
+		}},
+		Roles: []types.Role{{Name: "execute"}},
+	}
+	var got []string
+	for _, p := range append(Config(pc), Expiries(pc, now, 7*24*time.Hour)...) {
+		got = append(got, p.String())
+	}
+	want := []string{
+		`project[0].roles[0].expires.mallory: expiry for "mallory", which isn't one of the role's users, groups or serviceAccounts`,
+		`project[0].roles[0].expires.alice: warning: role "execute" for "alice" expired 2020-06-01T11:00:00Z and is no longer granted`,
+		`project[0].roles[0].expires.bob: warning: role "execute" for "bob" expires 2020-06-03T12:00:00Z`,
+		`project[0].roles[0].expires.mallory: warning: role "execute" for "mallory" expires 2020-06-01T13:00:00Z`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("problems:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestCheckServiceAccount(t *testing.T) {
+	tests := []struct {
+		sa     string
+		global bool
+		valid  bool
+	}{
+		{sa: "name", valid: true},
+		{sa: "ns:name", valid: true},
+		{sa: "ns:", global: true, valid: true},
+		{sa: "ns:", valid: false},
+		{sa: ":name", valid: false},
+		{sa: "", valid: false},
+		{sa: "a:b:c", valid: false},
+		{sa: "NS:name", valid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sa, func(t *testing.T) {
+			if got := checkServiceAccount(tt.sa, tt.global) == ""; got != tt.valid {
+				t.Errorf("checkServiceAccount(%q, %v) valid = %v, want %v", tt.sa, tt.global, got, tt.valid)
+			}
+		})
+	}
+}
+
+func TestConfigNamespaceSelector(t *testing.T) {
+	pc := &types.PermbotConfig{
+		Projects: []types.Project{
+			{NamespaceSelector: &types.NamespaceSelector{Glob: "review-*"}, Roles: []types.RoleUsers{
+				{Role: "view", ServiceAccounts: []string{"{{ .Namespace }}:ci"}},
+			}},
+			{NamespaceSelector: &types.NamespaceSelector{Glob: "team-*"}, Vars: map[string]string{"cm": "x"}, Roles: []types.RoleUsers{{Role: "config"}}},
+			{Namespace: "a", NamespaceSelector: &types.NamespaceSelector{Regex: "a("}, CreateNamespace: true},
+			{NamespaceSelector: &types.NamespaceSelector{}},
+			{NamespaceSelector: &types.NamespaceSelector{Labels: "env in (a"}},
+			{},
+		},
+		Roles: []types.Role{
+			{Name: "view", Rules: []types.Rule{{Resources: []string{"pods"}, Verbs: []string{"get"}}}},
+			{Name: "config", Rules: []types.Rule{{Resources: []string{"configmaps"}, ResourceNames: []string{"{{ .Vars.cm }}"}, Verbs: []string{"get"}}}},
+		},
+	}
+	var got []string
+	for _, p := range Config(pc) {
+		got = append(got, p.Path+": "+p.Message)
+	}
+	want := []string{
+		`project[2].namespace: project has both namespace and namespaceSelector`,
+		`project[2].createNamespace: createNamespace can't be used with namespaceSelector, which only matches existing namespaces`,
+		"project[2].namespaceSelector: bad namespaceSelector regex \"a(\": error parsing regexp: missing closing ): `^(?:a()$`",
+		`project[3].namespaceSelector: namespaceSelector must set glob, regex or labels`,
+		// the rest of the message is from the label selector parser
+		`project[4].namespaceSelector: bad namespaceSelector labels "env in (a": `,
+		`project[5].namespace: project has no namespace or namespaceSelector`,
+	}
+	ok := len(got) == len(want)
+	for i := 0; ok && i < len(want); i++ {
+		ok = strings.HasPrefix(got[i], want[i])
+	}
+	if !ok {
+		t.Errorf("Config() problems:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,42 @@
+package types
+
+import "time"
+
+// Expired reports whether the grant to a user, group or service account listed in ru has
+// expired by now
+func (ru *RoleUsers) Expired(name string, now time.Time) bool {
+	t, ok := ru.Expires[name]
+	return ok && !now.Before(t)
+}
+
+// Active returns the names (from ru's Users, Groups or ServiceAccounts) whose grant hasn't
+// expired by now
+func (ru *RoleUsers) Active(names []string, now time.Time) []string {
+	if len(ru.Expires) == 0 {
+		return names
+	}
+	var active []string
+	for _, n := range names {
+		if !ru.Expired(n, now) {
+			active = append(active, n)
+		}
+	}
+	return active
+}
+
+// NextExpiry returns the earliest time after now at which a grant in the config expires,
+// and false if nothing expires after now
+func (pc *PermbotConfig) NextExpiry(now time.Time) (time.Time, bool) {
+	var next time.Time
+	found := false
+	for i := range pc.Projects {
+		for _, ru := range pc.Projects[i].Roles {
+			for _, t := range ru.Expires {
+				if t.After(now) && (!found || t.Before(next)) {
+					next, found = t, true
+				}
+			}
+		}
+	}
+	return next, found
+}
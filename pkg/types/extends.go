@@ -0,0 +1,63 @@
+package types
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// flattenExtends includes in each role the rules of the roles it extends (and of those they
+// extend in turn) ahead of its own, and clears its Extends. The roles must already have
+// unique names.
+func flattenExtends(roles []Role) error {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	idx := make(map[string]int, len(roles))
+	for i := range roles {
+		idx[roles[i].Name] = i
+	}
+	state := make(map[string]int, len(roles))
+	var visit func(i int, chain []string) error
+	visit = func(i int, chain []string) error {
+		r := &roles[i]
+		chain = append(chain, r.Name)
+		switch state[r.Name] {
+		case done:
+			return nil
+		case visiting:
+			return errors.Errorf("roles extend each other in a cycle: %s", strings.Join(chain, " -> "))
+		}
+		state[r.Name] = visiting
+		if len(r.Extends) > 0 && r.ClusterRole != "" {
+			return errors.Errorf("role %q binds to clusterRole %q, so can't extend other roles", r.Name, r.ClusterRole)
+		}
+		var rules []Rule
+		for _, name := range r.Extends {
+			j, ok := idx[name]
+			if !ok {
+				return errors.Errorf("role %q extends undefined role %q", r.Name, name)
+			}
+			if err := visit(j, chain); err != nil {
+				return err
+			}
+			if roles[j].ClusterRole != "" {
+				return errors.Errorf("role %q extends role %q, which binds to clusterRole %q so has no rules to include", r.Name, name, roles[j].ClusterRole)
+			}
+			rules = unionRules(rules, roles[j].Rules)
+		}
+		if len(r.Extends) > 0 {
+			r.Rules = unionRules(rules, r.Rules)
+			r.Extends = nil
+		}
+		state[r.Name] = done
+		return nil
+	}
+	for i := range roles {
+		if err := visit(i, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
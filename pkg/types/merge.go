@@ -0,0 +1,221 @@
+package types
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DuplicatesError makes duplicate role names and project namespaces an error
+	DuplicatesError = "error"
+	// DuplicatesMerge combines duplicate roles (unioning rules, global subjects and lintIgnore) and
+	// duplicate projects (unioning the users, groups and service accounts of each role)
+	DuplicatesMerge = "merge"
+)
+
+// Merged returns a copy of the config in which every role name and project namespace
+// appears only once, and the rules of roles each role extends are included in its own. If
+// the config contains duplicates and doesn't set duplicates = "merge", or roles extend
+// each other in a cycle or extend undefined roles, an error is returned instead.
+func (pc *PermbotConfig) Merged() (*PermbotConfig, error) {
+	merge := false
+	switch pc.Duplicates {
+	case "", DuplicatesError:
+	case DuplicatesMerge:
+		merge = true
+	default:
+		return nil, errors.Errorf("unknown duplicates mode %q, should be %q or %q", pc.Duplicates, DuplicatesError, DuplicatesMerge)
+	}
+	out := &PermbotConfig{Duplicates: pc.Duplicates}
+	roleIdx := make(map[string]int)
+	for _, r := range pc.Roles {
+		i, dup := roleIdx[r.Name]
+		if !dup {
+			roleIdx[r.Name] = len(out.Roles)
+			out.Roles = append(out.Roles, Role{
+				Name:                  r.Name,
+				Rules:                 unionRules(nil, r.Rules),
+				ClusterRole:           r.ClusterRole,
+				Extends:               union(nil, r.Extends),
+				GlobalUsers:           union(nil, r.GlobalUsers),
+				GlobalGroups:          union(nil, r.GlobalGroups),
+				GlobalServiceAccounts: union(nil, r.GlobalServiceAccounts),
+				LintIgnore:            union(nil, r.LintIgnore),
+			})
+			continue
+		}
+		if !merge {
+			return nil, errors.Errorf("duplicate role %q (set duplicates = %q to combine them)", r.Name, DuplicatesMerge)
+		}
+		m := &out.Roles[i]
+		if m.ClusterRole != r.ClusterRole {
+			return nil, errors.Errorf("duplicate role %q has conflicting clusterRole values %q and %q", r.Name, m.ClusterRole, r.ClusterRole)
+		}
+		m.Rules = unionRules(m.Rules, r.Rules)
+		m.Extends = union(m.Extends, r.Extends)
+		m.GlobalUsers = union(m.GlobalUsers, r.GlobalUsers)
+		m.GlobalGroups = union(m.GlobalGroups, r.GlobalGroups)
+		m.GlobalServiceAccounts = union(m.GlobalServiceAccounts, r.GlobalServiceAccounts)
+		m.LintIgnore = union(m.LintIgnore, r.LintIgnore)
+	}
+	if err := flattenExtends(out.Roles); err != nil {
+		return nil, err
+	}
+	projIdx := make(map[string]int)
+	for _, p := range pc.Projects {
+		if p.NamespaceSelector != nil {
+			// Projects with selectors are only given a namespace once resolved against the
+			// cluster's namespaces, so are never duplicates
+			out.Projects = append(out.Projects, p)
+			continue
+		}
+		i, dup := projIdx[p.Namespace]
+		if !dup {
+			projIdx[p.Namespace] = len(out.Projects)
+			out.Projects = append(out.Projects, Project{Namespace: p.Namespace})
+			i = len(out.Projects) - 1
+		} else if !merge {
+			return nil, errors.Errorf("duplicate project namespace %q (set duplicates = %q to combine them)", p.Namespace, DuplicatesMerge)
+		}
+		m := &out.Projects[i]
+		m.CreateNamespace = m.CreateNamespace || p.CreateNamespace
+		var err error
+		if m.Labels, err = unionMap(m.Labels, p.Labels); err != nil {
+			return nil, errors.Wrapf(err, "duplicate project namespace %q has conflicting labels", p.Namespace)
+		}
+		if m.Annotations, err = unionMap(m.Annotations, p.Annotations); err != nil {
+			return nil, errors.Wrapf(err, "duplicate project namespace %q has conflicting annotations", p.Namespace)
+		}
+		if m.Vars, err = unionMap(m.Vars, p.Vars); err != nil {
+			return nil, errors.Wrapf(err, "duplicate project namespace %q has conflicting vars", p.Namespace)
+		}
+		for _, ru := range p.Roles {
+			j := -1
+			for k := range m.Roles {
+				if m.Roles[k].Role == ru.Role {
+					j = k
+				}
+			}
+			if j < 0 {
+				m.Roles = append(m.Roles, RoleUsers{
+					Role:            ru.Role,
+					Users:           union(nil, ru.Users),
+					Groups:          union(nil, ru.Groups),
+					ServiceAccounts: union(nil, ru.ServiceAccounts),
+					Expires:         ru.Expires,
+				})
+				continue
+			}
+			if !merge {
+				return nil, errors.Errorf("role %q is listed more than once for project namespace %q (set duplicates = %q to combine them)", ru.Role, p.Namespace, DuplicatesMerge)
+			}
+			expires, err := unionExpires(&m.Roles[j], &ru)
+			if err != nil {
+				return nil, errors.Wrapf(err, "role %q for duplicate project namespace %q has conflicting expiry", ru.Role, p.Namespace)
+			}
+			m.Roles[j].Users = union(m.Roles[j].Users, ru.Users)
+			m.Roles[j].Groups = union(m.Roles[j].Groups, ru.Groups)
+			m.Roles[j].ServiceAccounts = union(m.Roles[j].ServiceAccounts, ru.ServiceAccounts)
+			m.Roles[j].Expires = expires
+		}
+	}
+	return out, nil
+}
+
+// union appends the values in add which aren't already in list, keeping the original order
+func union(list, add []string) []string {
+	for _, a := range add {
+		found := false
+		for _, l := range list {
+			if l == a {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, a)
+		}
+	}
+	return list
+}
+
+// unionRules appends the rules in add which aren't already in list
+func unionRules(list, add []Rule) []Rule {
+	for _, a := range add {
+		found := false
+		for _, l := range list {
+			if reflect.DeepEqual(l, a) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, a)
+		}
+	}
+	return list
+}
+
+// unionMap returns the entries of a followed by those of b, it is an error for both to
+// have different values for the same key
+func unionMap(a, b map[string]string) (map[string]string, error) {
+	if len(b) == 0 {
+		return a, nil
+	}
+	out := make(map[string]string, len(a)+len(b))
+	for k, v := range a {
+		out[k] = v
+	}
+	for k, v := range b {
+		if av, ok := out[k]; ok && av != v {
+			return nil, errors.Errorf("%q is both %q and %q", k, av, v)
+		}
+		out[k] = v
+	}
+	return out, nil
+}
+
+// unionExpires returns the expiry times of the subjects of a and b, it is an error for both
+// to have different times for the same subject. A subject either lists without an expiry
+// is granted permanently, so has no expiry in the result.
+func unionExpires(a, b *RoleUsers) (map[string]time.Time, error) {
+	if len(a.Expires) == 0 && len(b.Expires) == 0 {
+		return nil, nil
+	}
+	out := make(map[string]time.Time, len(a.Expires)+len(b.Expires))
+	for k, v := range a.Expires {
+		out[k] = v
+	}
+	for k, v := range b.Expires {
+		if av, ok := out[k]; ok && !av.Equal(v) {
+			return nil, errors.Errorf("%q expires both %s and %s", k, av.Format(time.RFC3339), v.Format(time.RFC3339))
+		}
+		out[k] = v
+	}
+	for k := range out {
+		if a.permanent(k) || b.permanent(k) {
+			delete(out, k)
+		}
+	}
+	if len(out) == 0 {
+		return nil, nil
+	}
+	return out, nil
+}
+
+// permanent reports whether ru lists subject (as written) without an expiry
+func (ru *RoleUsers) permanent(subject string) bool {
+	if _, ok := ru.Expires[subject]; ok {
+		return false
+	}
+	for _, list := range [][]string{ru.Users, ru.Groups, ru.ServiceAccounts} {
+		for _, s := range list {
+			if s == subject {
+				return true
+			}
+		}
+	}
+	return false
+}
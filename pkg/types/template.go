@@ -0,0 +1,94 @@
+package types
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// TemplateData is what template variables in rules and project subjects are expanded with,
+// so {{ .Namespace }} is the project's namespace and {{ .Vars.name }} one of its vars
+type TemplateData struct {
+	Namespace string
+	Vars      map[string]string
+}
+
+// varRef matches uses of project vars, so undefined ones can be reported by name
+var varRef = regexp.MustCompile(`\.Vars\.([A-Za-z_][A-Za-z0-9_]*)`)
+
+// IsTemplate reports whether s contains template variables
+func IsTemplate(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+// Expand expands the template variables in s for the project. Using a variable the
+// project doesn't define is an error.
+func (p *Project) Expand(s string) (string, error) {
+	if !IsTemplate(s) {
+		return s, nil
+	}
+	t, err := template.New("").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return "", errors.Wrapf(err, "bad template %q", s)
+	}
+	for _, m := range varRef.FindAllStringSubmatch(s, -1) {
+		if _, ok := p.Vars[m[1]]; !ok {
+			return "", errors.Errorf("undefined variable %q in %q", m[1], s)
+		}
+	}
+	var buf bytes.Buffer
+	vars := p.Vars
+	if vars == nil {
+		vars = map[string]string{}
+	}
+	if err := t.Execute(&buf, TemplateData{Namespace: p.Namespace, Vars: vars}); err != nil {
+		return "", errors.Wrapf(err, "unable to expand %q", s)
+	}
+	return buf.String(), nil
+}
+
+// ExpandAll expands the template variables in every string of list
+func (p *Project) ExpandAll(list []string) ([]string, error) {
+	if list == nil {
+		return nil, nil
+	}
+	out := make([]string, len(list))
+	for i, s := range list {
+		var err error
+		if out[i], err = p.Expand(s); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// ExpandRules returns a copy of rules with the template variables in every field expanded
+// for the project
+func (p *Project) ExpandRules(rules []Rule) ([]Rule, error) {
+	out := make([]Rule, len(rules))
+	for i, r := range rules {
+		var err error
+		out[i] = r
+		for _, f := range []*[]string{&out[i].APIGroups, &out[i].Resources, &out[i].ResourceNames, &out[i].NonResourceURLs, &out[i].Verbs} {
+			if *f, err = p.ExpandAll(*f); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return out, nil
+}
+
+// Templates returns the strings in a rule which contain template variables
+func (r *Rule) Templates() (out []string) {
+	for _, f := range [][]string{r.APIGroups, r.Resources, r.ResourceNames, r.NonResourceURLs, r.Verbs} {
+		for _, s := range f {
+			if IsTemplate(s) {
+				out = append(out, s)
+			}
+		}
+	}
+	return
+}
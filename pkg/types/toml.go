@@ -1,36 +1,99 @@
 package types
 
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
 // PermbotConfig is for unmarshalling a TOMl struct into
 type PermbotConfig struct {
-	Projects []Project `toml:"project" json:"project"`
-	Roles    []Role    `toml:"role" json:"role"`
+	// Duplicates controls how roles with the same name and projects with the same namespace
+	// are handled, either DuplicatesError (the default) or DuplicatesMerge
+	Duplicates string    `toml:"duplicates" json:"duplicates,omitempty"`
+	Projects   []Project `toml:"project" json:"project"`
+	Roles      []Role    `toml:"role" json:"role"`
 }
 
 // Project defines a single namespace and the applicable roles
 type Project struct {
 	Namespace string `toml:"namespace" json:"namespace"`
+	// NamespaceSelector applies the project to every existing namespace it matches, instead
+	// of a single Namespace
+	NamespaceSelector *NamespaceSelector `toml:"namespaceSelector" json:"namespaceSelector,omitempty"`
 	// GitlabPath  string      `toml:"gitlabPath",json:"gitlabPath"`
 	Roles []RoleUsers `toml:"roles" json:"roles"`
+	// CreateNamespace makes permbot create the namespace (labelled with the owner) if it
+	// doesn't exist, instead of skipping the project
+	CreateNamespace bool `toml:"createNamespace" json:"createNamespace,omitempty"`
+	// Labels and Annotations are set on the project's namespace
+	Labels      map[string]string `toml:"labels" json:"labels,omitempty"`
+	Annotations map[string]string `toml:"annotations" json:"annotations,omitempty"`
+	// Vars are available as {{ .Vars.name }} in the rules of the project's roles and in its
+	// subjects, as well as {{ .Namespace }}
+	Vars map[string]string `toml:"vars" json:"vars,omitempty"`
+}
+
+// NamespaceSelector matches namespaces by name or label. Every field which is set must match.
+type NamespaceSelector struct {
+	// Glob is a pattern as in path.Match, e.g. myapp-review-*
+	Glob string `toml:"glob" json:"glob,omitempty"`
+	// Regex must match the whole namespace name
+	Regex string `toml:"regex" json:"regex,omitempty"`
+	// Labels is a Kubernetes label selector, e.g. "env=review,team in (a,b)"
+	Labels string `toml:"labels" json:"labels,omitempty"`
+}
+
+// String formats the fields of the selector which are set, e.g. glob="review-*"
+func (s NamespaceSelector) String() string {
+	var parts []string
+	for _, f := range []struct{ name, value string }{{"glob", s.Glob}, {"regex", s.Regex}, {"labels", s.Labels}} {
+		if f.value != "" {
+			parts = append(parts, fmt.Sprintf("%s=%q", f.name, f.value))
+		}
+	}
+	return strings.Join(parts, " ")
 }
 
 // RoleUsers links a Role to a set of Users
 type RoleUsers struct {
 	Role            string   `toml:"role" json:"role"`
 	Users           []string `toml:"users" json:"users"`
+	Groups          []string `toml:"groups" json:"groups,omitempty"`
 	ServiceAccounts []string `toml:"serviceAccounts" json:"serviceAccounts"`
+	// Expires optionally maps a user, group or service account (as listed above) to the time
+	// its grant expires, after which it is left out of the RoleBinding
+	Expires map[string]time.Time `toml:"expires" json:"expires,omitempty"`
 }
 
 // Role is a defined Role (or ClusterRole, if global users are specified)
 type Role struct {
-	Name                  string   `toml:"name" json:"name"`
-	Rules                 []Rule   `toml:"rules" json:"rules"`
+	Name  string `toml:"name" json:"name"`
+	Rules []Rule `toml:"rules" json:"rules"`
+	// ClusterRole is the name of an existing ClusterRole (e.g. the built-in "edit") to bind
+	// to instead of defining Rules. No Role/ClusterRole is created for the role, only bindings.
+	ClusterRole string `toml:"clusterRole" json:"clusterRole,omitempty"`
+	// Extends lists other roles whose rules (but not global subjects) are included in this
+	// role's, e.g. ["view"] for a role which is "view plus something"
+	Extends               []string `toml:"extends" json:"extends,omitempty"`
 	GlobalUsers           []string `toml:"globalUsers" json:"globalUsers"`
+	GlobalGroups          []string `toml:"globalGroups" json:"globalGroups,omitempty"`
 	GlobalServiceAccounts []string `toml:"globalServiceAccounts" json:"globalServiceAccounts"`
+	// LintIgnore lists lint check IDs (e.g. "PB003") whose findings are suppressed for every
+	// rule of the role
+	LintIgnore []string `toml:"lintIgnore" json:"lintIgnore,omitempty"`
 }
 
 // Rule is a specific rule allowed as part of a Role/ClusterRole
 type Rule struct {
 	APIGroups []string `toml:"apiGroups" json:"apiGroups"`
 	Resources []string `toml:"resources" json:"resources"`
-	Verbs     []string `toml:"verbs" json:"verbs"`
+	// ResourceNames optionally restricts the rule to specific named objects
+	ResourceNames []string `toml:"resourceNames" json:"resourceNames,omitempty"`
+	// NonResourceURLs are paths such as /metrics, these are only meaningful for global
+	// roles (ClusterRoles) and can't be combined with APIGroups/Resources
+	NonResourceURLs []string `toml:"nonResourceURLs" json:"nonResourceURLs,omitempty"`
+	Verbs           []string `toml:"verbs" json:"verbs"`
+	// LintIgnore lists lint check IDs whose findings are suppressed for this rule
+	LintIgnore []string `toml:"lintIgnore" json:"lintIgnore,omitempty"`
 }